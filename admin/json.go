@@ -1,7 +1,12 @@
 package admin
 
 type TokenJson struct {
-	Jwt   string `json:"jwt"`
-	Token string `json:"token"`
-	Href  string `json:"href"`
+	Jwt          string                 `json:"jwt"`
+	TokenHash    string                 `json:"token_hash"`
+	Subject      string                 `json:"sub,omitempty"`
+	IssuedAt     string                 `json:"iat,omitempty"`
+	Expires      string                 `json:"expires,omitempty"`
+	Applications []string               `json:"applications,omitempty"`
+	Scopes       []string               `json:"scopes,omitempty"`
+	Claims       map[string]interface{} `json:"claims,omitempty"`
 }
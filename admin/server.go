@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/go-zoo/bone"
@@ -13,6 +13,11 @@ import (
 	"github.com/op/go-logging"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 func writeError(res http.ResponseWriter, msg string) {
 	res.WriteHeader(500)
 	_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"%s"}`, msg)))
@@ -28,34 +33,83 @@ func NewAdminServer(
 
 	mux.Get("/tokens", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
-		tokenStream, err := tokenStore.GetAllTokens()
+
+		query := req.URL.Query()
+		filter := auth.TokenFilter{
+			Subject:     query.Get("subject"),
+			Application: query.Get("application"),
+		}
+
+		for param, target := range map[string]*int64{"expires_before": &filter.ExpiresBefore, "expires_after": &filter.ExpiresAfter} {
+			if v := query.Get(param); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					res.WriteHeader(400)
+					_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"invalid value for '%s', expected RFC3339 date"}`, param)))
+					return
+				}
+				*target = t.Unix()
+			}
+		}
+
+		limit := defaultPageSize
+		if v := query.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l <= 0 || l > maxPageSize {
+				res.WriteHeader(400)
+				_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"limit must be between 1 and %d"}`, maxPageSize)))
+				return
+			}
+			limit = l
+		}
+
+		tokens, next, err := tokenStore.ListTokens(filter, query.Get("cursor"), limit)
 		if err != nil {
 			logger.Error(err.Error())
 			writeError(res, "could not load tokens")
 			return
 		}
 
-		enc := json.NewEncoder(res)
 		scheme := "http"
 
 		if req.URL.Scheme != "" {
 			scheme = req.URL.Scheme
 		}
 
-		_, _ = res.Write([]byte{'['})
-		for v := range tokenStream {
-			err := enc.Encode(TokenJson{
-				Jwt:   v.Jwt,
-				Token: v.Token,
-				Href:  fmt.Sprintf("%s://%s/tokens/%s", scheme, req.Host, url.QueryEscape(v.Token)),
-			})
-			if err != nil {
-				logger.Error(err)
-				writeError(res, "could not encode tokens")
-				return
+		result := make([]TokenJson, len(tokens))
+		for i, v := range tokens {
+			result[i] = TokenJson{
+				Jwt:          v.Jwt,
+				TokenHash:    v.TokenHash,
+				Subject:      v.Subject,
+				Applications: v.Applications,
+				Scopes:       v.Scopes,
+			}
+
+			if v.IssuedAt != 0 {
+				result[i].IssuedAt = time.Unix(v.IssuedAt, 0).Format(time.RFC3339)
 			}
+
+			if v.ExpiresAt != 0 {
+				result[i].Expires = time.Unix(v.ExpiresAt, 0).Format(time.RFC3339)
+			}
+
+			if claims, err := tokenVerifier.DecodeClaims(v.Jwt); err == nil {
+				result[i].Claims = claims
+			} else {
+				logger.Warningf("could not decode claims of stored token: %s", err)
+			}
+		}
+
+		if next != "" {
+			query.Set("cursor", next)
+			res.Header().Set("Link", fmt.Sprintf(`<%s://%s/tokens?%s>; rel="next"`, scheme, req.Host, query.Encode()))
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Error(err)
+			writeError(res, "could not encode tokens")
 		}
-		_, _ = res.Write([]byte{']'})
 	}))
 
 	mux.Put("/tokens/#token^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
@@ -83,9 +137,16 @@ func NewAdminServer(
 			return
 		}
 
+		scopes := req.URL.Query()["scope"]
+		if _, err := auth.ParseScopes(scopes); err != nil {
+			res.WriteHeader(400)
+			_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"invalid scope","reason":"%s"}`, err)))
+			return
+		}
+
 		tokenString := bone.GetValue(req, "token")
 
-		exp, err := tokenStore.SetToken(tokenString, &auth.JWTResponse{JWT: jwt})
+		exp, err := tokenStore.SetToken(tokenString, &auth.JWTResponse{JWT: jwt, Scopes: scopes})
 		if err != nil {
 			logger.Errorf("error while storing token: %s", err)
 			res.WriteHeader(500)
@@ -127,7 +188,14 @@ func NewAdminServer(
 			return
 		}
 
-		tokenString, exp, err := tokenStore.AddToken(&auth.JWTResponse{JWT: jwt})
+		scopes := req.URL.Query()["scope"]
+		if _, err := auth.ParseScopes(scopes); err != nil {
+			res.WriteHeader(400)
+			_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"invalid scope","reason":"%s"}`, err)))
+			return
+		}
+
+		tokenString, exp, err := tokenStore.AddToken(&auth.JWTResponse{JWT: jwt, Scopes: scopes})
 		if err != nil {
 			logger.Errorf("error while storing token: %s", err)
 			res.WriteHeader(500)
@@ -143,5 +211,29 @@ func NewAdminServer(
 		}
 	}))
 
+	if lockout := authHandler.Lockout(); lockout != nil {
+		mux.Delete("/lockouts/#kind^(username|ip)$/#key^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json")
+
+			kind := bone.GetValue(req, "kind")
+			key := bone.GetValue(req, "key")
+
+			unlocked, err := lockout.Unlock(kind, key)
+			if err != nil {
+				logger.Errorf("error while lifting lockout of %s %s: %s", kind, key, err)
+				writeError(res, "could not lift lockout")
+				return
+			}
+
+			if !unlocked {
+				res.WriteHeader(404)
+				_, _ = res.Write([]byte(`{"msg":"not locked out"}`))
+				return
+			}
+
+			res.WriteHeader(204)
+		}))
+	}
+
 	return mux, nil
 }
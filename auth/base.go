@@ -35,6 +35,12 @@ var InvalidCredentialsError = errors.New("invalid credentials given")
 
 type AuthenticationIncompleteError struct {
 	AdditionalProperties map[string]interface{}
+
+	// Username and Restrictions (the allowed applications and scopes set by
+	// the pre-authentication hook) are needed to continue the authentication
+	// with a challenge.
+	Username     string
+	Restrictions *JWTResponse
 }
 
 type InvalidResponseBodyContentTypeError struct {
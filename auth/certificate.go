@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/tracing"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type clientCertificateRequest struct {
+	Subject        string   `json:"subject"`
+	CommonName     string   `json:"common_name"`
+	Issuer         string   `json:"issuer"`
+	SerialNumber   string   `json:"serial_number"`
+	Fingerprint    string   `json:"fingerprint"`
+	DNSNames       []string `json:"dns_names"`
+	EmailAddresses []string `json:"email_addresses"`
+}
+
+// ClientCertificate returns the verified client certificate of a TLS
+// connection, or nil. Certificates that were not verified against the client
+// CA bundle are ignored.
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+func (h *AuthenticationHandler) clientCertificateEnabled() bool {
+	return h.config.ProviderConfig.ClientCertificate.Enabled
+}
+
+// TokenFromCertificate maps a client certificate to a JWT by asking the
+// authentication provider. Results are cached until the JWT expires, but for
+// no longer than the configured cache TTL. The provider request is bound to
+// ctx and recorded as a span of its trace.
+func (h *AuthenticationHandler) TokenFromCertificate(ctx context.Context, cert *x509.Certificate) (*JWTResponse, error) {
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	if cached, ok := h.certTokens.Get(fingerprint); ok {
+		return cached.(*JWTResponse), nil
+	}
+
+	request := clientCertificateRequest{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		Issuer:         cert.Issuer.String(),
+		SerialNumber:   cert.SerialNumber.String(),
+		Fingerprint:    fingerprint,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+	}
+
+	jsonString, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	requestURL := h.config.ProviderConfig.ClientCertificate.Url
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/authenticate/certificate"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(jsonString))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set("Content-Type", "application/json")
+
+	providerCtx, providerSpan := tracing.Start(ctx, "auth.certificate_provider")
+	tracing.Inject(providerCtx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := h.httpClient.Do(req.WithContext(providerCtx))
+	tracing.End(providerSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+		requestid.NewLogger(ctx, h.logger).Warningf("client certificate %s was rejected by authentication provider", request.Subject)
+		return nil, InvalidCredentialsError
+	} else if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status code %d while mapping client certificate %s: %s", resp.StatusCode, request.Subject, body)
+	}
+
+	token := JWTResponse{JWT: string(body)}
+
+	valid, claims, _, err := h.verifier.VerifyToken(token.JWT)
+	if err != nil || !valid {
+		return nil, fmt.Errorf("authentication provider returned invalid JWT for client certificate %s: %s", request.Subject, err)
+	}
+
+	ttl := h.certCacheTtl
+	if claims.ExpiresAt != 0 {
+		if untilExpiry := time.Until(time.Unix(claims.ExpiresAt, 0)); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+
+	if ttl > 0 {
+		h.certTokens.Set(fingerprint, &token, ttl)
+	}
+
+	requestid.NewLogger(ctx, h.logger).Infof("mapped client certificate %s to JWT", request.Subject)
+
+	return &token, nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTestCertificateRequest returns a request that was made with a verified
+// client certificate with the given common name.
+func newTestCertificateRequest(t *testing.T, commonName string) *http.Request {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	key, keyPEM := newTestKey(t)
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "svc", "exp": time.Now().Add(time.Hour).Unix()}).SignedString(key)
+
+	var calls int32
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		var body clientCertificateRequest
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		if req.URL.Path != "/authenticate/certificate" || body.CommonName != "svc" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write([]byte(signed))
+	}))
+	defer provider.Close()
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: keyPEM,
+		KeyCacheTtl:     "5m",
+		ProviderConfig: config.ProviderAuthConfig{
+			Url:               provider.URL,
+			ClientCertificate: config.ProviderClientCertConfig{Enabled: true},
+		},
+	}
+
+	verifier, _ := NewJwtVerifier(cfg)
+	handler, err := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, nil, NewMemoryTokenStore(verifier, time.Hour), verifier, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	svc := newTestCertificateRequest(t, "svc")
+	for i := 0; i < 2; i++ {
+		authenticated, token, err := handler.IsAuthenticated(svc)
+		if err != nil || !authenticated || token.JWT != signed {
+			t.Errorf("expected certificate to be mapped to JWT, got %v (%v)", authenticated, err)
+		}
+	}
+
+	if authenticated, _, err := handler.IsAuthenticated(newTestCertificateRequest(t, "other")); err != nil || authenticated {
+		t.Errorf("expected rejected certificate not to be authenticated, got %v (%v)", authenticated, err)
+	}
+
+	unverified := httptest.NewRequest("GET", "/", nil)
+	unverified.TLS = &tls.ConnectionState{}
+	if authenticated, _, _ := handler.IsAuthenticated(unverified); authenticated {
+		t.Error("expected request without verified certificate not to be authenticated")
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected mapped certificate to be cached, got %d provider calls", n)
+	}
+}
+
+func TestClientCertificateMappingIsTraced(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	key, keyPEM := newTestKey(t)
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "svc"}).SignedString(key)
+
+	var traceparent string
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		_, _ = rw.Write([]byte(signed))
+	}))
+	defer provider.Close()
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: keyPEM,
+		KeyCacheTtl:     "5m",
+		ProviderConfig:  config.ProviderAuthConfig{Url: provider.URL, ClientCertificate: config.ProviderClientCertConfig{Enabled: true}},
+	}
+
+	verifier, _ := NewJwtVerifier(cfg)
+	handler, _ := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, nil, NewMemoryTokenStore(verifier, time.Hour), verifier, logging.MustGetLogger("test"), nil)
+
+	if authenticated, _, err := handler.IsAuthenticated(newTestCertificateRequest(t, "svc")); err != nil || !authenticated {
+		t.Fatalf("expected certificate to be mapped to JWT, got %v (%v)", authenticated, err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	mapping, ok := spans["auth.certificate_provider"]
+	if !ok {
+		t.Fatalf("expected provider call to be traced, got %v", spans)
+	}
+	if mapping.Parent().SpanID() != spans["auth.authenticate"].SpanContext().SpanID() {
+		t.Error("expected provider call to be a child of the authentication span")
+	}
+	if !strings.Contains(traceparent, mapping.SpanContext().SpanID().String()) {
+		t.Errorf("expected trace context to be passed to the provider, got %q", traceparent)
+	}
+}
@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/requestid"
+)
+
+var (
+	UnknownChallengeError   = errors.New("unknown or expired challenge")
+	TooManyAttemptsError    = errors.New("too many attempts for challenge")
+	challengeAttemptsScript = redis.NewScript(1, `
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return -1
+		end
+		return redis.call("HINCRBY", KEYS[1], "attempts", 1)
+	`)
+)
+
+// Challenge is the second step of an authentication that the authentication
+// provider did not complete (by responding with 202 Accepted). It is stored in
+// Redis until it expires or is completed.
+type Challenge struct {
+	ID                   string
+	ExpiresAt            int64
+	AdditionalProperties map[string]interface{}
+}
+
+// ChallengeEnabled reports whether incomplete authentications are continued
+// with a challenge.
+func (h *AuthenticationHandler) ChallengeEnabled() bool {
+	return h.config.ProviderConfig.Challenge.Enabled
+}
+
+// CreateChallenge stores the state of an incomplete authentication, so that
+// it can be completed by CompleteChallenge.
+func (h *AuthenticationHandler) CreateChallenge(ctx context.Context, incomplete *AuthenticationIncompleteError) (*Challenge, error) {
+	id, err := newTokenString()
+	if err != nil {
+		return nil, err
+	}
+
+	properties, err := json.Marshal(incomplete.AdditionalProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	restrictions := JWTResponse{}
+	if incomplete.Restrictions != nil {
+		restrictions = *incomplete.Restrictions
+	}
+
+	challenge := Challenge{
+		ID:                   id,
+		ExpiresAt:            time.Now().Add(h.challengeTtl).Unix(),
+		AdditionalProperties: incomplete.AdditionalProperties,
+	}
+
+	conn := h.redisPool.Get()
+	defer conn.Close()
+
+	key := "auth_challenge_" + HashToken(id)
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	if err := conn.Send(
+		"HMSET", key,
+		"username", incomplete.Username,
+		"properties", string(properties),
+		"applications", strings.Join(restrictions.AllowedApplications, ";"),
+		"scopes", strings.Join(restrictions.Scopes, ";"),
+		"attempts", 0,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := conn.Send("EXPIREAT", key, challenge.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+
+	requestid.NewLogger(ctx, h.logger).Infof("created authentication challenge for user %s", incomplete.Username)
+
+	return &challenge, nil
+}
+
+// ChallengeUsername returns the user whose authentication a challenge
+// continues.
+func (h *AuthenticationHandler) ChallengeUsername(id string) (string, error) {
+	conn := h.redisPool.Get()
+	defer conn.Close()
+
+	username, err := redis.String(conn.Do("HGET", "auth_challenge_"+HashToken(id), "username"))
+	if err == redis.ErrNil || (err == nil && username == "") {
+		return "", UnknownChallengeError
+	}
+
+	return username, err
+}
+
+// CompleteChallenge forwards the response to a challenge (like a one-time
+// password) to the authentication provider. If the provider responds with
+// another 202, the challenge is updated and an AuthenticationIncompleteError
+// is returned; the client may then answer the challenge again, within the
+// attempts that are left.
+func (h *AuthenticationHandler) CompleteChallenge(ctx context.Context, id string, answer map[string]interface{}) (*JWTResponse, error) {
+	logger := requestid.NewLogger(ctx, h.logger)
+
+	conn := h.redisPool.Get()
+	defer conn.Close()
+
+	key := "auth_challenge_" + HashToken(id)
+
+	attempts, err := redis.Int(challengeAttemptsScript.Do(conn, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if attempts < 0 {
+		return nil, UnknownChallengeError
+	}
+
+	if attempts > h.challengeMaxAttempts {
+		_, _ = conn.Do("DEL", key)
+		return nil, TooManyAttemptsError
+	}
+
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	if values["username"] == "" {
+		return nil, UnknownChallengeError
+	}
+
+	request := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(values["properties"]), &request); err != nil {
+		return nil, err
+	}
+
+	for k, v := range answer {
+		request[k] = v
+	}
+	request["username"] = values["username"]
+
+	requestURL := h.config.ProviderConfig.Challenge.Url
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/authenticate/challenge"
+	}
+
+	jsonString, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(jsonString))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		logger.Warningf("invalid challenge response for user %s (attempt %d)", values["username"], attempts)
+		return nil, InvalidCredentialsError
+	case resp.StatusCode == http.StatusAccepted:
+		responseBodyContentType := resp.Header.Get("Content-Type")
+		if !strings.HasPrefix(responseBodyContentType, "application/json") {
+			return nil, InvalidResponseBodyContentTypeError{
+				ContentType: responseBodyContentType,
+			}
+		}
+
+		var properties map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&properties); err != nil {
+			return nil, err
+		}
+
+		encoded, err := json.Marshal(properties)
+		if err != nil {
+			return nil, err
+		}
+
+		// further steps count towards the attempts of the challenge, so that
+		// a provider that keeps asking cannot be used to guess answers
+		if _, err := conn.Do("HSET", key, "properties", string(encoded)); err != nil {
+			return nil, err
+		}
+
+		return nil, &AuthenticationIncompleteError{AdditionalProperties: properties, Username: values["username"]}
+	case resp.StatusCode >= 400:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code %d while completing challenge for user %s: %s", resp.StatusCode, values["username"], body)
+	}
+
+	// a challenge must only be completed once
+	deleted, err := redis.Int(conn.Do("DEL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted == 0 {
+		return nil, UnknownChallengeError
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := JWTResponse{
+		JWT:          string(body),
+		RefreshToken: resp.Header.Get(h.refreshTokenHeader),
+	}
+
+	if values["applications"] != "" {
+		response.AllowedApplications = strings.Split(values["applications"], ";")
+	}
+
+	if values["scopes"] != "" {
+		response.Scopes = strings.Split(values["scopes"], ";")
+	}
+
+	logger.Infof("user %s completed authentication challenge", values["username"])
+
+	return &response, nil
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+func post(mux http.Handler, path string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return rec
+}
+
+// newTestChallengeRoutes registers the authentication endpoints with
+// challenges of at most two attempts. The provider asks for a one-time
+// password, accepts "123456" and asks for another one on "next".
+func newTestChallengeRoutes(t *testing.T) *httprouter.Router {
+	t.Helper()
+
+	key, pub := newTestKey(t)
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}).SignedString(key)
+
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		switch {
+		case req.URL.Path == "/authenticate", body["otp"] == "next":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(202)
+			_, _ = rw.Write([]byte(`{"type":"otp","state":"s1"}`))
+		case body["otp"] == "123456" && body["state"] == "s1" && body["username"] == "bob":
+			_, _ = rw.Write([]byte(token))
+		default:
+			rw.WriteHeader(403)
+		}
+	}))
+	t.Cleanup(provider.Close)
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: pub,
+		KeyCacheTtl:     "5m",
+		ProviderConfig: config.ProviderAuthConfig{
+			Url:                 provider.URL,
+			AllowAuthentication: true,
+			Challenge:           config.ProviderChallengeConfig{Enabled: true, MaxAttempts: 2},
+		},
+	}
+
+	logger := logging.MustGetLogger("test")
+	verifier, _ := NewJwtVerifier(cfg)
+	store := NewMemoryTokenStore(verifier, time.Hour)
+
+	handler, err := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, newTestRedisPool(t), store, verifier, logger, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mux := httprouter.New()
+	if err := NewRestAuthDecorator(handler, store, logger).RegisterRoutes(mux); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return mux
+}
+
+// startChallenge logs in and returns the ID of the challenge.
+func startChallenge(t *testing.T, mux http.Handler) string {
+	t.Helper()
+
+	rec := post(mux, "/authenticate", `{"username":"bob","password":"secret"}`)
+
+	var body map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+
+	id, _ := body["challenge_id"].(string)
+	if rec.Code != 202 || id == "" {
+		t.Fatalf("expected 202 with challenge ID, got %d %s", rec.Code, rec.Body.String())
+	}
+	return id
+}
+
+func answerChallenge(mux http.Handler, id string, otp string) *httptest.ResponseRecorder {
+	return post(mux, "/authenticate/challenge", `{"challenge_id":"`+id+`","otp":"`+otp+`"}`)
+}
+
+func TestChallengeCompletion(t *testing.T) {
+	mux := newTestChallengeRoutes(t)
+	id := startChallenge(t, mux)
+
+	if rec := answerChallenge(mux, id, "000000"); rec.Code != 403 {
+		t.Errorf("expected wrong answer to be rejected, got %d", rec.Code)
+	}
+
+	rec := answerChallenge(mux, id, "123456")
+
+	var body map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != 200 || body["token"] == nil {
+		t.Fatalf("expected token, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := answerChallenge(mux, id, "123456"); rec.Code != 403 {
+		t.Errorf("expected completed challenge to be discarded, got %d", rec.Code)
+	}
+}
+
+func TestChallengeMaxAttempts(t *testing.T) {
+	mux := newTestChallengeRoutes(t)
+	id := startChallenge(t, mux)
+
+	for i := 0; i < 2; i++ {
+		answerChallenge(mux, id, "000000")
+	}
+
+	if rec := answerChallenge(mux, id, "123456"); rec.Code != 403 || !strings.Contains(rec.Body.String(), TooManyAttemptsError.Error()) {
+		t.Errorf("expected too many attempts, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestChallengeStepsCountAsAttempts(t *testing.T) {
+	mux := newTestChallengeRoutes(t)
+	id := startChallenge(t, mux)
+
+	// asking for another step must not reset the attempts of the challenge
+	for i := 0; i < 2; i++ {
+		if rec := answerChallenge(mux, id, "next"); rec.Code != 202 {
+			t.Fatalf("step %d: expected 202, got %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := answerChallenge(mux, id, "123456"); rec.Code != 403 || !strings.Contains(rec.Body.String(), TooManyAttemptsError.Error()) {
+		t.Errorf("expected too many attempts, got %d %s", rec.Code, rec.Body.String())
+	}
+}
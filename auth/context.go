@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const requestTokenKey contextKey = iota
+
+// WithRequestToken returns a copy of the request that carries the mapped
+// token of the authenticated user, for use by decorators further down the
+// chain.
+func WithRequestToken(req *http.Request, token *JWTResponse) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestTokenKey, token))
+}
+
+// RequestToken returns the mapped token of an authenticated request, or nil.
+func RequestToken(req *http.Request) *JWTResponse {
+	token, _ := req.Context().Value(requestTokenKey).(*JWTResponse)
+	return token
+}
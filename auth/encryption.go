@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+const (
+	encryptionKeysEnv      = "SERVICEGATEWAY_TOKEN_KEYS"
+	encryptionActiveKeyEnv = "SERVICEGATEWAY_TOKEN_ACTIVE_KEY"
+
+	encryptedPrefix = "enc:v1:"
+)
+
+// TokenEncrypter implements envelope encryption for JWTs stored in a token
+// store. Each JWT is encrypted with its own random data key using AES-GCM; the
+// data key is in turn encrypted ("wrapped") with a key encryption key. The ID
+// of that key is stored with the JWT, so that key encryption keys can be
+// rotated by re-wrapping only the data keys.
+//
+// Encrypted values are encoded as "enc:v1:<key-id>:<wrapped-key>:<ciphertext>".
+// Values without that prefix are treated as (legacy) plain text JWTs.
+type TokenEncrypter struct {
+	keys      map[string]cipher.AEAD
+	activeKey string
+}
+
+// HashToken returns the hash under which an opaque token is stored. Tokens
+// are random, so an unsalted hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewTokenEncrypter builds an encrypter from the configured keys and the keys
+// given in the SERVICEGATEWAY_TOKEN_KEYS environment variable (formatted as
+// "<key-id>:<base64-key>,..."). It returns nil if no keys are configured.
+func NewTokenEncrypter(cfg *config.TokenEncryptionConfiguration) (*TokenEncrypter, error) {
+	encodedKeys := make(map[string]string)
+	for id, key := range cfg.Keys {
+		encodedKeys[id] = key
+	}
+
+	if env := os.Getenv(encryptionKeysEnv); env != "" {
+		for _, pair := range strings.Split(env, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid key specification in %s; expected '<key-id>:<base64-key>'", encryptionKeysEnv)
+			}
+			encodedKeys[kv[0]] = kv[1]
+		}
+	}
+
+	if len(encodedKeys) == 0 {
+		return nil, nil
+	}
+
+	e := TokenEncrypter{
+		keys:      make(map[string]cipher.AEAD, len(encodedKeys)),
+		activeKey: cfg.ActiveKey,
+	}
+
+	if active := os.Getenv(encryptionActiveKeyEnv); active != "" {
+		e.activeKey = active
+	}
+
+	for id, encoded := range encodedKeys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID '%s'", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key '%s' is not valid base64: %s", id, err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key '%s' must be 256 bits long", id)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		e.keys[id] = aead
+	}
+
+	if e.activeKey == "" {
+		if len(e.keys) > 1 {
+			return nil, fmt.Errorf("active_key must be set when more than one encryption key is configured")
+		}
+
+		for id := range e.keys {
+			e.activeKey = id
+		}
+	}
+
+	if _, ok := e.keys[e.activeKey]; !ok {
+		return nil, fmt.Errorf("active encryption key '%s' is not configured", e.activeKey)
+	}
+
+	return &e, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealGCM(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt encrypts a JWT with the active key. The token hash is used as
+// additional data, so that an encrypted JWT cannot be moved to another token.
+// A nil encrypter returns the JWT unencrypted.
+func (e *TokenEncrypter) Encrypt(jwt string, tokenHash string) (string, error) {
+	if e == nil {
+		return jwt, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := sealGCM(dataAEAD, []byte(jwt), []byte(tokenHash))
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := sealGCM(e.keys[e.activeKey], dataKey, []byte(e.activeKey))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + e.activeKey + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (e *TokenEncrypter) parse(value string) (keyID string, wrappedKey []byte, ciphertext []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+
+	wrappedKey, err = base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value: %s", err)
+	}
+
+	ciphertext, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value: %s", err)
+	}
+
+	return parts[0], wrappedKey, ciphertext, nil
+}
+
+func (e *TokenEncrypter) unwrap(keyID string, wrappedKey []byte) ([]byte, error) {
+	keyAEAD, ok := e.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key '%s'", keyID)
+	}
+
+	dataKey, err := openGCM(keyAEAD, wrappedKey, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %s", err)
+	}
+
+	return dataKey, nil
+}
+
+// Decrypt decrypts a value created by Encrypt. Plain text values are returned
+// as they are; they are encrypted by the next re-encryption run.
+func (e *TokenEncrypter) Decrypt(value string, tokenHash string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	if e == nil {
+		return "", fmt.Errorf("token is encrypted, but no encryption keys are configured")
+	}
+
+	keyID, wrappedKey, ciphertext, err := e.parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := e.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openGCM(dataAEAD, ciphertext, []byte(tokenHash))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt token: %s", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Reencrypt returns the value encrypted with the active key. Values that are
+// already encrypted are only re-wrapped. The second return value is false if
+// the value was already up to date.
+func (e *TokenEncrypter) Reencrypt(value string, tokenHash string) (string, bool, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		encrypted, err := e.Encrypt(value, tokenHash)
+		return encrypted, err == nil, err
+	}
+
+	keyID, wrappedKey, ciphertext, err := e.parse(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	if keyID == e.activeKey {
+		return value, false, nil
+	}
+
+	dataKey, err := e.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	wrappedKey, err = sealGCM(e.keys[e.activeKey], dataKey, []byte(e.activeKey))
+	if err != nil {
+		return "", false, err
+	}
+
+	return encryptedPrefix + e.activeKey + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), true, nil
+}
@@ -21,10 +21,12 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -33,9 +35,13 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/jinzhu/copier"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/scripting"
+	"github.com/mittwald/servicegateway/tracing"
 	"github.com/op/go-logging"
 	cache "github.com/patrickmn/go-cache"
-	"github.com/robertkrimen/otto"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type AuthenticationHandler struct {
@@ -46,25 +52,48 @@ type AuthenticationHandler struct {
 	logger      *logging.Logger
 	verifier    *JwtVerifier
 
-	hookPreAuth *otto.Script
+	hookPreAuth *scripting.Runtime
 
 	expCache *cache.Cache
 
-	jsVM     *otto.Otto
-	jsVMLock *sync.Mutex
+	refreshBefore      time.Duration
+	refreshTokenHeader string
+	refreshLock        sync.Mutex
+	refreshCalls       map[string]*refreshCall
+
+	redisPool            *redis.Pool
+	challengeTtl         time.Duration
+	challengeMaxAttempts int
+
+	lockout *Lockout
+
+	certTokens   *cache.Cache
+	certCacheTtl time.Duration
+
+	metrics *monitoring.PromMetrics
 }
 
 type JWTResponse struct {
 	JWT                 string
 	AllowedApplications []string
+	Scopes              []string
+	RefreshToken        string
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token *JWTResponse
+	err   error
 }
 
 func NewAuthenticationHandler(
 	cfg *config.GlobalAuth,
+	scriptingCfg *config.ScriptingConfiguration,
 	redisPool *redis.Pool,
 	tokenStore TokenStore,
 	verifier *JwtVerifier,
 	logger *logging.Logger,
+	metrics *monitoring.PromMetrics,
 ) (*AuthenticationHandler, error) {
 	handler := AuthenticationHandler{
 		config:      cfg,
@@ -74,40 +103,92 @@ func NewAuthenticationHandler(
 		logger:      logger,
 		verifier:    verifier,
 		expCache:    cache.New(cache.NoExpiration, 5*time.Minute),
-		jsVMLock:    &sync.Mutex{},
+		metrics:     metrics,
+
+		refreshTokenHeader: "X-Refresh-Token",
+		refreshCalls:       make(map[string]*refreshCall),
+
+		redisPool: redisPool,
+	}
+
+	if cfg.ProviderConfig.Refresh.TokenHeader != "" {
+		handler.refreshTokenHeader = cfg.ProviderConfig.Refresh.TokenHeader
+	}
+
+	if cfg.ProviderConfig.Refresh.Enabled {
+		refreshBefore := time.Minute
+		if cfg.ProviderConfig.Refresh.RefreshBefore != "" {
+			d, err := time.ParseDuration(cfg.ProviderConfig.Refresh.RefreshBefore)
+			if err != nil {
+				return nil, fmt.Errorf("invalid refresh_before duration: %s", err)
+			}
+			refreshBefore = d
+		}
+		handler.refreshBefore = refreshBefore
+	}
+
+	if cfg.ProviderConfig.Challenge.Enabled {
+		handler.challengeTtl = 5 * time.Minute
+		if cfg.ProviderConfig.Challenge.Ttl != "" {
+			d, err := time.ParseDuration(cfg.ProviderConfig.Challenge.Ttl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid challenge ttl: %s", err)
+			}
+			handler.challengeTtl = d
+		}
+
+		handler.challengeMaxAttempts = 3
+		if cfg.ProviderConfig.Challenge.MaxAttempts > 0 {
+			handler.challengeMaxAttempts = cfg.ProviderConfig.Challenge.MaxAttempts
+		}
+	}
+
+	if cfg.ProviderConfig.ClientCertificate.Enabled {
+		handler.certCacheTtl = 5 * time.Minute
+		if cfg.ProviderConfig.ClientCertificate.CacheTtl != "" {
+			d, err := time.ParseDuration(cfg.ProviderConfig.ClientCertificate.CacheTtl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate cache_ttl: %s", err)
+			}
+			handler.certCacheTtl = d
+		}
+		handler.certTokens = cache.New(handler.certCacheTtl, time.Minute)
+	}
+
+	if cfg.ProviderConfig.Lockout.Enabled {
+		lockout, err := NewLockout(&cfg.ProviderConfig.Lockout, redisPool, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.lockout = lockout
 	}
 
 	if cfg.ProviderConfig.PreAuthenticationHook != "" {
-		handler.jsVM = otto.New()
-		err := handler.jsVM.Set(
-			"log", func(call otto.FunctionCall) otto.Value {
-				format := call.Argument(0).String()
-				args := call.ArgumentList[1:]
-				values := make([]interface{}, len(args))
-
-				for i := range args {
-					values[i], _ = args[i].Export()
-				}
+		source, err := os.ReadFile(cfg.ProviderConfig.PreAuthenticationHook)
+		if err != nil {
+			return nil, fmt.Errorf("could not read JS hook %s: %s", cfg.ProviderConfig.PreAuthenticationHook, err.Error())
+		}
 
-				logger.Debugf(format, values...)
-				return otto.UndefinedValue()
-			},
-		)
+		options, err := scripting.OptionsFromConfig(scriptingCfg)
 		if err != nil {
 			return nil, err
 		}
 
-		script, err := handler.jsVM.Compile(cfg.ProviderConfig.PreAuthenticationHook, nil)
+		runtime, err := scripting.NewRuntime("hook_pre_authentication", string(source), options, logger, metrics)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse JS hook %s: %s", cfg.ProviderConfig.PreAuthenticationHook, err.Error())
+			return nil, fmt.Errorf("could not load JS hook %s: %s", cfg.ProviderConfig.PreAuthenticationHook, err.Error())
 		}
-		handler.hookPreAuth = script
+		handler.hookPreAuth = runtime
 	}
 
 	return &handler, nil
 }
 
-func (h *AuthenticationHandler) Authenticate(username string, password string, additionalBodyProperties map[string]interface{}) (*JWTResponse, error) {
+// Authenticate authenticates a user at the authentication provider. The
+// header of the authentication request is available to the pre-authentication
+// hook; log messages are tagged with the request ID of ctx.
+func (h *AuthenticationHandler) Authenticate(ctx context.Context, username string, password string, additionalBodyProperties map[string]interface{}, header http.Header) (*JWTResponse, error) {
+	logger := requestid.NewLogger(ctx, h.logger)
 	response := JWTResponse{}
 
 	authRequest := make(map[string]interface{})
@@ -121,73 +202,54 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 	requestURL := h.config.ProviderConfig.Url + "/authenticate"
 
 	if h.hookPreAuth != nil {
-		h.jsVMLock.Lock()
-		_, err := h.jsVM.Run(h.hookPreAuth)
-		if err != nil {
-			h.jsVMLock.Unlock()
-			return nil, err
-		}
-
-		export, _ := h.jsVM.Get("exports")
-		if !export.IsFunction() {
-			h.jsVMLock.Unlock()
-			return nil, fmt.Errorf("hook script must export a function!")
-		}
-
-		hookResult, err := export.Call(otto.UndefinedValue(), username, password, additionalBodyProperties)
-		h.jsVMLock.Unlock()
+		hookResult, err := h.hookPreAuth.Call(&scripting.Call{Context: ctx, Header: header}, username, password, additionalBodyProperties)
 		if err != nil {
 			return nil, fmt.Errorf("error while calling hook function: %s", err.Error())
 		}
 
-		hookResultBool, _ := hookResult.ToBoolean()
-		if !hookResultBool {
+		if !scripting.Truthy(hookResult) {
 			return nil, InvalidCredentialsError
 		}
 
-		if !hookResult.IsObject() {
-			return nil, fmt.Errorf("hook function must return object. is: %s", hookResult.Class())
+		hookResultObj, ok := hookResult.(map[string]interface{})
+		if !ok {
+			h.hookPreAuth.CountFailure("invalid_result")
+			return nil, fmt.Errorf("hook function must return object. is: %T", hookResult)
 		}
 
-		hookResultObj := hookResult.Object()
+		if newAuthRequest, ok := hookResultObj["body"].(map[string]interface{}); ok {
+			authRequest = newAuthRequest
+			logger.Debugf("hook mapped authentication request to: %s", authRequest)
+		}
 
-		body, err := hookResultObj.Get("body")
-		if err != nil {
-			return nil, err
+		if url, ok := hookResultObj["url"].(string); ok {
+			requestURL = url
+			logger.Debugf("hook set request URL to: %s", url)
 		}
-		exportedAuthRequest, _ := body.Export()
-		newAuthRequest, ok := exportedAuthRequest.(map[string]interface{})
 
-		if ok {
-			for k := range newAuthRequest {
-				if ottoValue, ok := newAuthRequest[k].(otto.Value); ok {
-					newAuthRequest[k], _ = ottoValue.Export()
-				}
+		if allowedApps, ok := hookResultObj["allowedApplications"]; ok && allowedApps != nil {
+			l, err := scripting.Strings(allowedApps)
+			if err != nil {
+				h.hookPreAuth.CountFailure("invalid_result")
+				return nil, fmt.Errorf("hook function returned invalid allowedApplications: %s", err)
 			}
 
-			authRequest = newAuthRequest
-			h.logger.Debugf("hook mapped authentication request to: %s", authRequest)
-		}
-
-		url, err := hookResultObj.Get("url")
-		if err != nil {
-			return nil, err
-		}
-		if url.IsString() {
-			requestURL = url.String()
-			h.logger.Debugf("hook set request URL to: %s", url)
+			response.AllowedApplications = l
+			logger.Debugf("token will be restricted to apps: %s", l)
 		}
 
-		allowedApps, err := hookResultObj.Get("allowedApplications")
-		if err != nil {
-			return nil, err
-		}
-		if allowedApps.IsDefined() {
-			exported, _ := allowedApps.Export()
-			if l, ok := exported.([]string); ok {
-				response.AllowedApplications = l
-				h.logger.Debugf("token will be restricted to apps: %s", l)
+		if scopes, ok := hookResultObj["scopes"]; ok && scopes != nil {
+			l, err := scripting.Strings(scopes)
+			if err == nil {
+				_, err = ParseScopes(l)
+			}
+			if err != nil {
+				h.hookPreAuth.CountFailure("invalid_result")
+				return nil, fmt.Errorf("hook function returned invalid scopes: %s", err)
 			}
+
+			response.Scopes = l
+			logger.Debugf("token will be restricted to scopes: %s", l)
 		}
 	}
 
@@ -203,10 +265,10 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 
 	debugJsonString, _ := json.Marshal(redactedAuthRequest)
 
-	h.logger.Infof("authenticating user %s", username)
-	h.logger.Debugf("authentication request: %s", debugJsonString)
+	logger.Infof("authenticating user %s", username)
+	logger.Debugf("authentication request: %s", debugJsonString)
 
-	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(jsonString))
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(jsonString))
 	if err != nil {
 		return nil, err
 	}
@@ -225,17 +287,17 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 		body, _ := io.ReadAll(resp.Body)
 
 		if resp.StatusCode == http.StatusForbidden {
-			h.logger.Warningf("invalid credentials for user %s: %s", username, body)
+			logger.Warningf("invalid credentials for user %s: %s", username, body)
 			return nil, InvalidCredentialsError
 		} else {
 			err := fmt.Errorf("unexpected status code %d for user %s: %s", resp.StatusCode, username, body)
-			h.logger.Error(err.Error())
+			logger.Errorf("%s", err)
 			return nil, err
 		}
 	}
 
 	if resp.StatusCode == 202 {
-		h.logger.Infof("user %s has given correct credentials, but additional authentication factor is required", username)
+		logger.Infof("user %s has given correct credentials, but additional authentication factor is required", username)
 		responseBodyContentType := resp.Header.Get("Content-Type")
 		if !strings.HasPrefix(responseBodyContentType, "application/json") {
 			return nil, InvalidResponseBodyContentTypeError{
@@ -249,25 +311,254 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 		}
 		return nil, &AuthenticationIncompleteError{
 			AdditionalProperties: unmarshalledBody,
+			Username:             username,
+			Restrictions:         &response,
 		}
 	}
 
 	body, _ := io.ReadAll(resp.Body)
 
 	response.JWT = string(body)
+	response.RefreshToken = resp.Header.Get(h.refreshTokenHeader)
 
 	return &response, nil
 }
 
+// refreshLockTtl limits how long a gateway instance may hold the lock of a
+// token while it refreshes it, and thereby the duration of the refresh.
+const refreshLockTtl = 10 * time.Second
+
+// releaseRefreshLockScript deletes the refresh lock of a token only if it is
+// still held by the caller.
+var releaseRefreshLockScript = redis.NewScript(1, `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// Refresh obtains a new JWT from the authentication provider using the
+// refresh token of the given token, and stores it under the same opaque
+// token so that clients do not notice. Concurrent refreshes of a token are
+// merged within this process and, using a lock in Redis, across all gateway
+// instances.
+func (h *AuthenticationHandler) Refresh(ctx context.Context, token string, current *JWTResponse) (*JWTResponse, error) {
+	h.refreshLock.Lock()
+	if call, ok := h.refreshCalls[token]; ok {
+		h.refreshLock.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+
+	call := &refreshCall{done: make(chan struct{})}
+	h.refreshCalls[token] = call
+	h.refreshLock.Unlock()
+
+	call.token, call.err = h.refreshLocked(ctx, token, current)
+	close(call.done)
+
+	h.refreshLock.Lock()
+	delete(h.refreshCalls, token)
+	h.refreshLock.Unlock()
+
+	return call.token, call.err
+}
+
+// refreshLocked refreshes a token while holding its lock in Redis. If another
+// instance holds the lock, it waits for that instance to store the refreshed
+// token instead.
+func (h *AuthenticationHandler) refreshLocked(ctx context.Context, token string, current *JWTResponse) (*JWTResponse, error) {
+	conn := h.redisPool.Get()
+	defer conn.Close()
+
+	lockKey := "auth_refresh_" + HashToken(token)
+
+	owner, err := newTokenString()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = redis.String(conn.Do("SET", lockKey, owner, "NX", "PX", refreshLockTtl.Milliseconds()))
+	if err == redis.ErrNil {
+		return h.awaitRefresh(conn, lockKey, token, current)
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_, _ = releaseRefreshLockScript.Do(conn, lockKey, owner)
+	}()
+
+	// another instance may have refreshed the token (and replaced its refresh
+	// token) since it was read from the local cache
+	stored, err := h.reloadToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.JWT != current.JWT {
+		return stored, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshLockTtl)
+	defer cancel()
+
+	return h.refresh(ctx, token, stored)
+}
+
+// awaitRefresh waits until another instance released the refresh lock of a
+// token and returns the token that it stored.
+func (h *AuthenticationHandler) awaitRefresh(conn redis.Conn, lockKey string, token string, current *JWTResponse) (*JWTResponse, error) {
+	for deadline := time.Now().Add(refreshLockTtl); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		locked, err := redis.Bool(conn.Do("EXISTS", lockKey))
+		if err != nil {
+			return nil, err
+		}
+
+		if !locked {
+			break
+		}
+	}
+
+	refreshed, err := h.reloadToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if refreshed.JWT == current.JWT {
+		return nil, fmt.Errorf("token was not refreshed by the instance holding the refresh lock")
+	}
+
+	return refreshed, nil
+}
+
+// reloadToken reads a token from the token store, bypassing the local cache.
+func (h *AuthenticationHandler) reloadToken(token string) (*JWTResponse, error) {
+	if cache, ok := h.storage.(*CacheDecorator); ok {
+		cache.localCache.Remove(token)
+	}
+
+	stored, err := h.storage.GetToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token: %s", err)
+	}
+
+	return stored, nil
+}
+
+func (h *AuthenticationHandler) refresh(ctx context.Context, token string, current *JWTResponse) (*JWTResponse, error) {
+	if current.RefreshToken == "" {
+		return nil, fmt.Errorf("token has no refresh token")
+	}
+
+	requestURL := h.config.ProviderConfig.Refresh.Url
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/refresh"
+	}
+
+	jsonString, err := json.Marshal(map[string]string{"refresh_token": current.RefreshToken})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(jsonString))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while refreshing token: %s", resp.StatusCode, body)
+	}
+
+	refreshed := JWTResponse{
+		JWT:                 string(body),
+		AllowedApplications: current.AllowedApplications,
+		Scopes:              current.Scopes,
+		RefreshToken:        resp.Header.Get(h.refreshTokenHeader),
+	}
+
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = current.RefreshToken
+	}
+
+	if _, err := h.storage.SetToken(token, &refreshed); err != nil {
+		return nil, fmt.Errorf("could not store refreshed token: %s", err)
+	}
+
+	requestid.NewLogger(ctx, h.logger).Debugf("refreshed JWT of mapped token")
+
+	return &refreshed, nil
+}
+
+func (h *AuthenticationHandler) needsRefresh(token *JWTResponse) bool {
+	if !h.config.ProviderConfig.Refresh.Enabled || token.RefreshToken == "" {
+		return false
+	}
+
+	exp, err := h.verifier.ExpiresAt(token.JWT)
+	if err != nil || exp == 0 {
+		return false
+	}
+
+	return time.Until(time.Unix(exp, 0)) < h.refreshBefore
+}
+
 func (h *AuthenticationHandler) IsAuthenticated(req *http.Request) (bool, *JWTResponse, error) {
-	token, err := h.tokenReader.TokenFromRequest(req)
+	ctx, span := tracing.Start(req.Context(), "auth.authenticate")
+	authenticated, token, err := h.isAuthenticated(req.WithContext(ctx))
+	span.SetAttributes(attribute.Bool("auth.authenticated", authenticated))
+	tracing.End(span, err)
+
+	return authenticated, token, err
+}
+
+func (h *AuthenticationHandler) isAuthenticated(req *http.Request) (bool, *JWTResponse, error) {
+	lookupCtx, lookupSpan := tracing.Start(req.Context(), "auth.token_lookup")
+	tokenString, token, err := h.tokenReader.TokenFromRequest(req.WithContext(lookupCtx))
+	if err == NoTokenError {
+		tracing.End(lookupSpan, nil)
+	} else {
+		tracing.End(lookupSpan, err)
+	}
+
 	if err == NoTokenError {
+		if cert := ClientCertificate(req); cert != nil && h.clientCertificateEnabled() {
+			token, err := h.TokenFromCertificate(req.Context(), cert)
+			if err == InvalidCredentialsError {
+				return false, nil, nil
+			} else if err != nil {
+				requestid.NewLogger(req.Context(), h.logger).Warningf("error while mapping client certificate: %s", err)
+				return false, nil, err
+			}
+			return true, token, nil
+		}
+
 		return false, nil, nil
 	} else if err != nil {
-		h.logger.Warningf("error while reading token from request: %s", err)
+		requestid.NewLogger(req.Context(), h.logger).Warningf("error while reading token from request: %s", err)
 		return false, nil, err
 	}
 
+	if h.needsRefresh(token) {
+		refreshed, err := h.Refresh(req.Context(), tokenString, token)
+		if err != nil {
+			requestid.NewLogger(req.Context(), h.logger).Warningf("could not refresh token: %s", err)
+		} else {
+			token = refreshed
+		}
+	}
+
 	exp, ok := h.expCache.Get(token.JWT)
 	var expiry int64
 	if ok {
@@ -277,7 +568,10 @@ func (h *AuthenticationHandler) IsAuthenticated(req *http.Request) (bool, *JWTRe
 	if ok && (exp == 0 || expiry > time.Now().Unix()) {
 		return true, token, nil
 	} else if !ok {
-		valid, stdClaims, _, err := h.verifier.VerifyToken(token.JWT)
+		verifyCtx, verifySpan := tracing.Start(req.Context(), "auth.verify_token")
+		valid, stdClaims, _, err := h.verifier.VerifyTokenContext(verifyCtx, token.JWT)
+		tracing.End(verifySpan, err)
+
 		if err == nil && valid {
 			if stdClaims.ExpiresAt == 0 {
 				h.expCache.Set(token.JWT, 0, cache.NoExpiration)
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+func newTestRedisPool(t *testing.T) *redis.Pool {
+	t.Helper()
+
+	addr := miniredis.RunT(t).Addr()
+	return &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }}
+}
+
+// newTestKey returns a key to sign JWTs with, and its public key as PEM.
+func newTestKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("could not marshal public key: %s", err)
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+// newTestRefreshProvider returns a provider that answers authentication and
+// refresh requests with a new JWT and refresh token in the X-Renewed header,
+// and counts the refresh requests.
+func newTestRefreshProvider(t *testing.T, sign func() string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var refreshes int32
+
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/refresh" {
+			n := atomic.AddInt32(&refreshes, 1)
+			time.Sleep(100 * time.Millisecond)
+			rw.Header().Set("X-Renewed", "refresh-"+string(rune('1'+n)))
+		} else {
+			rw.Header().Set("X-Renewed", "refresh-1")
+		}
+
+		_, _ = rw.Write([]byte(sign()))
+	}))
+	t.Cleanup(provider.Close)
+
+	return provider, &refreshes
+}
+
+func TestRefreshTokenHeader(t *testing.T) {
+	key, keyPEM := newTestKey(t)
+	sign := func() string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString(key)
+		return signed
+	}
+
+	provider, _ := newTestRefreshProvider(t, sign)
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: keyPEM,
+		KeyCacheTtl:     "5m",
+		ProviderConfig: config.ProviderAuthConfig{
+			Url:     provider.URL,
+			Refresh: config.ProviderRefreshConfig{Enabled: true, TokenHeader: "X-Renewed"},
+		},
+	}
+
+	verifier, _ := NewJwtVerifier(cfg)
+	pool := newTestRedisPool(t)
+	store, _ := NewTokenStore(&config.TokenStoreConfiguration{}, pool, verifier, logging.MustGetLogger("test"), TokenStoreOptions{})
+	handler, err := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, pool, store, verifier, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	response, err := handler.Authenticate(context.Background(), "bob", "secret", nil, http.Header{})
+	if err != nil || response.RefreshToken != "refresh-1" {
+		t.Fatalf("expected refresh token from the configured header, got %+v (%v)", response, err)
+	}
+}
+
+func TestRefreshIsSharedAcrossInstances(t *testing.T) {
+	key, keyPEM := newTestKey(t)
+	sign := func() string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "jti": time.Now().String()}).SignedString(key)
+		return signed
+	}
+
+	provider, refreshes := newTestRefreshProvider(t, sign)
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: keyPEM,
+		KeyCacheTtl:     "5m",
+		ProviderConfig: config.ProviderAuthConfig{
+			Url:     provider.URL,
+			Refresh: config.ProviderRefreshConfig{Enabled: true, TokenHeader: "X-Renewed"},
+		},
+	}
+
+	// all instances share the token store and Redis
+	verifier, _ := NewJwtVerifier(cfg)
+	pool := newTestRedisPool(t)
+	store, _ := NewTokenStore(&config.TokenStoreConfiguration{}, pool, verifier, logging.MustGetLogger("test"), TokenStoreOptions{})
+
+	token, _, err := store.AddToken(&JWTResponse{JWT: sign(), RefreshToken: "refresh-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	current, _ := store.GetToken(token)
+
+	var wg sync.WaitGroup
+	results := make([]*JWTResponse, 4)
+
+	for i := range results {
+		handler, err := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, pool, store, verifier, logging.MustGetLogger("test"), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			refreshed, err := handler.Refresh(context.Background(), token, current)
+			if err != nil {
+				t.Errorf("instance %d: unexpected error: %s", i, err)
+				return
+			}
+			results[i] = refreshed
+		}(i)
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(refreshes); n != 1 {
+		t.Fatalf("expected one refresh at the provider, got %d", n)
+	}
+
+	for i, refreshed := range results {
+		if refreshed == nil || refreshed.JWT == current.JWT || refreshed.JWT != results[0].JWT || refreshed.RefreshToken != "refresh-2" {
+			t.Errorf("instance %d: expected the refreshed token, got %+v", i, refreshed)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/tracing"
 
 	"io/ioutil"
 	"net/http"
@@ -65,8 +68,31 @@ func (h *JwtVerifier) GetVerificationKey() ([]byte, error) {
 	return h.cachedKey, nil
 }
 
+// CheckHealth tests whether the verification key can be retrieved and parsed.
+func (h *JwtVerifier) CheckHealth() error {
+	keyPEM, err := h.GetVerificationKey()
+	if err != nil {
+		return err
+	}
+
+	if _, err := jwt.ParseRSAPublicKeyFromPEM(keyPEM); err != nil {
+		return fmt.Errorf("invalid verification key: %s", err)
+	}
+
+	return nil
+}
+
 func (h *JwtVerifier) VerifyToken(token string) (bool, *jwt.StandardClaims, jwt.MapClaims, error) {
+	return h.VerifyTokenContext(context.Background(), token)
+}
+
+// VerifyTokenContext verifies a token like VerifyToken, and records the
+// retrieval of the verification key as a span of the trace in ctx.
+func (h *JwtVerifier) VerifyTokenContext(ctx context.Context, token string) (bool, *jwt.StandardClaims, jwt.MapClaims, error) {
+	_, keySpan := tracing.Start(ctx, "auth.verification_key")
 	keyPEM, err := h.GetVerificationKey()
+	tracing.End(keySpan, err)
+
 	if err != nil {
 		return false, nil, nil, fmt.Errorf("error while getting verification key. Err: '%+v'", err)
 	}
@@ -89,3 +115,34 @@ func (h *JwtVerifier) VerifyToken(token string) (bool, *jwt.StandardClaims, jwt.
 
 	return true, &stdClaims, mapClaims, err
 }
+
+// DecodeClaims returns the claims of a token without verifying its signature.
+// This must only be used for tokens that were already verified when they were
+// stored (like the JWTs held by the token store).
+func (h *JwtVerifier) DecodeClaims(token string) (jwt.MapClaims, error) {
+	mapClaims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, &mapClaims)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding token claims. Err: '%+v'", err)
+	}
+
+	return mapClaims, nil
+}
+
+// ExpiresAt returns the "exp" claim of an (already verified) token, or 0 if
+// the token does not expire.
+func (h *JwtVerifier) ExpiresAt(token string) (int64, error) {
+	mapClaims, err := h.DecodeClaims(token)
+	if err != nil {
+		return 0, err
+	}
+
+	switch exp := mapClaims["exp"].(type) {
+	case float64:
+		return int64(exp), nil
+	case json.Number:
+		return exp.Int64()
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mittwald/servicegateway/config"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestVerifyTokenContextTracesKeyRetrieval(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	verifier, err := NewJwtVerifier(&config.GlobalAuth{VerificationKeyUrl: "http://127.0.0.1:0/key", KeyCacheTtl: "1m"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "auth.verify_token")
+	if valid, _, _, err := verifier.VerifyTokenContext(ctx, "token"); valid || err == nil {
+		t.Fatal("expected verification to fail without a key")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "auth.verification_key" || spans[0].Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("expected one key retrieval span below the verification span, got %v", spans)
+	}
+	if spans[0].Status().Code.String() != "Error" {
+		t.Errorf("expected failed key retrieval to be recorded, got %v", spans[0].Status())
+	}
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+const (
+	LockoutUsername = "username"
+	LockoutIP       = "ip"
+)
+
+// lockoutReserveScript reserves a login attempt of a username and of a
+// client IP. KEYS are the failure counter, lock and pending attempt counter of
+// the username, followed by those of the client IP. Attempts are reserved
+// before they are forwarded to the authentication provider, so that
+// concurrent attempts cannot exceed the remaining failures ARGV[2] - count
+// (or a single attempt, once a lockout has expired). It returns the remaining
+// lockout in milliseconds, 1000 if too many attempts are pending, or 0 if the
+// attempt was reserved.
+var lockoutReserveScript = redis.NewScript(6, `
+	local remaining = math.max(redis.call("PTTL", KEYS[2]), redis.call("PTTL", KEYS[5]))
+	if remaining > 0 then
+		return remaining
+	end
+
+	local max = tonumber(ARGV[2])
+	for i = 1, 4, 3 do
+		local failures = tonumber(redis.call("GET", KEYS[i]) or "0")
+		local pending = tonumber(redis.call("GET", KEYS[i + 2]) or "0")
+		if pending >= math.max(max - failures, 1) then
+			return 1000
+		end
+	end
+
+	for i = 3, 6, 3 do
+		redis.call("INCR", KEYS[i])
+		redis.call("EXPIRE", KEYS[i], ARGV[1])
+	end
+	return 0
+`)
+
+// lockoutFailureScript concludes a pending attempt (KEYS[3]) as failed login
+// and locks the key once the failure count reaches ARGV[2]. The lockout
+// duration doubles with every further failure, starting at ARGV[3] seconds
+// and capped at ARGV[4] seconds. The counter lives at least as long as the
+// lockout, so that failures right after a lockout escalate it further.
+var lockoutFailureScript = redis.NewScript(3, `
+	if tonumber(redis.call("GET", KEYS[3]) or "0") > 0 then
+		redis.call("DECR", KEYS[3])
+	end
+
+	local count = redis.call("INCR", KEYS[1])
+	local window = tonumber(ARGV[1])
+	local duration = 0
+
+	if count >= tonumber(ARGV[2]) then
+		duration = tonumber(ARGV[3]) * 2 ^ (count - tonumber(ARGV[2]))
+		duration = math.floor(math.min(duration, tonumber(ARGV[4])))
+		redis.call("SET", KEYS[2], count, "EX", duration)
+	end
+
+	redis.call("EXPIRE", KEYS[1], window + duration)
+	return {count, duration}
+`)
+
+// lockoutReleaseScript concludes the pending attempts in KEYS.
+var lockoutReleaseScript = redis.NewScript(-1, `
+	for _, key in ipairs(KEYS) do
+		if tonumber(redis.call("GET", key) or "0") > 0 then
+			redis.call("DECR", key)
+		end
+	end
+	return 0
+`)
+
+// LockoutEvent describes a username or client IP that was locked out after
+// too many failed logins.
+type LockoutEvent struct {
+	Kind     string
+	Key      string
+	Username string
+	IP       string
+	Failures int
+	Until    time.Time
+}
+
+type LockoutListener interface {
+	OnLockout(event LockoutEvent)
+}
+
+// Lockout counts failed logins per username and per client IP in Redis and
+// locks out usernames and IPs with too many failures.
+type Lockout struct {
+	redisPool   *redis.Pool
+	logger      *logging.Logger
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+
+	trustedProxies []*net.IPNet
+
+	listenersLock sync.RWMutex
+	listeners     []LockoutListener
+}
+
+func NewLockout(cfg *config.ProviderLockoutConfig, redisPool *redis.Pool, logger *logging.Logger) (*Lockout, error) {
+	l := Lockout{
+		redisPool:   redisPool,
+		logger:      logger,
+		maxFailures: 5,
+		window:      15 * time.Minute,
+		duration:    time.Minute,
+		maxDuration: time.Hour,
+	}
+
+	if cfg.MaxFailures > 0 {
+		l.maxFailures = cfg.MaxFailures
+	}
+
+	for _, d := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"window", cfg.Window, &l.window},
+		{"duration", cfg.Duration, &l.duration},
+		{"max_duration", cfg.MaxDuration, &l.maxDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lockout %s: %s", d.name, err)
+		}
+
+		if parsed < time.Second {
+			return nil, fmt.Errorf("lockout %s must be at least one second", d.name)
+		}
+
+		*d.target = parsed
+	}
+
+	if l.maxDuration < l.duration {
+		l.maxDuration = l.duration
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %s", proxy, err)
+		}
+		l.trustedProxies = append(l.trustedProxies, network)
+	}
+
+	return &l, nil
+}
+
+// Lockout returns the brute-force protection of the authentication endpoint,
+// or nil if it is disabled.
+func (h *AuthenticationHandler) Lockout() *Lockout {
+	return h.lockout
+}
+
+func (l *Lockout) RegisterListener(listener LockoutListener) {
+	l.listenersLock.Lock()
+	defer l.listenersLock.Unlock()
+
+	l.listeners = append(l.listeners, listener)
+}
+
+// ClientIP returns the IP address of the client that sent a request. If the
+// request comes from a trusted proxy, the X-Forwarded-For header is followed
+// back to the first address that is not a trusted proxy.
+func (l *Lockout) ClientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0 && l.isTrustedProxy(ip); i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		ip = forwarded[i]
+	}
+
+	return ip
+}
+
+func (l *Lockout) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range l.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func lockoutKeys(kind string, key string) (string, string) {
+	if kind == LockoutUsername {
+		key = strings.ToLower(key)
+	}
+
+	return "auth_failures_" + kind + "_" + key, "auth_lockout_" + kind + "_" + key
+}
+
+func pendingKey(kind string, key string) string {
+	if kind == LockoutUsername {
+		key = strings.ToLower(key)
+	}
+
+	return "auth_pending_" + kind + "_" + key
+}
+
+// Reserve reserves a login attempt of a username from a client IP. It returns
+// for how long the username or client IP is still locked out; the attempt was
+// only reserved if the duration is zero. Every reserved attempt must be
+// concluded with RecordFailure, RecordSuccess or Release.
+func (l *Lockout) Reserve(username string, ip string) (time.Duration, error) {
+	conn := l.redisPool.Get()
+	defer conn.Close()
+
+	userFailures, userLock := lockoutKeys(LockoutUsername, username)
+	ipFailures, ipLock := lockoutKeys(LockoutIP, ip)
+
+	remaining, err := redis.Int64(lockoutReserveScript.Do(
+		conn,
+		userFailures, userLock, pendingKey(LockoutUsername, username),
+		ipFailures, ipLock, pendingKey(LockoutIP, ip),
+		int(l.window.Seconds()), l.maxFailures,
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(remaining) * time.Millisecond, nil
+}
+
+// RecordFailure concludes a reserved attempt as failed login of the username
+// and the client IP and notifies the listeners when either is locked out.
+func (l *Lockout) RecordFailure(username string, ip string) error {
+	conn := l.redisPool.Get()
+	defer conn.Close()
+
+	for _, kind := range []string{LockoutUsername, LockoutIP} {
+		key := strings.ToLower(username)
+		if kind == LockoutIP {
+			key = ip
+		}
+
+		failures, lock := lockoutKeys(kind, key)
+
+		result, err := redis.Ints(lockoutFailureScript.Do(
+			conn, failures, lock, pendingKey(kind, key),
+			int(l.window.Seconds()), l.maxFailures, int(l.duration.Seconds()), int(l.maxDuration.Seconds()),
+		))
+		if err != nil {
+			return err
+		}
+
+		if result[1] == 0 {
+			continue
+		}
+
+		event := LockoutEvent{
+			Kind:     kind,
+			Key:      key,
+			Username: username,
+			IP:       ip,
+			Failures: result[0],
+			Until:    time.Now().Add(time.Duration(result[1]) * time.Second),
+		}
+
+		l.logger.Warningf("locked out %s %s after %d failed logins until %s", kind, key, event.Failures, event.Until.Format(time.RFC3339))
+
+		l.listenersLock.RLock()
+		for i := range l.listeners {
+			l.listeners[i].OnLockout(event)
+		}
+		l.listenersLock.RUnlock()
+	}
+
+	return nil
+}
+
+// RecordSuccess resets the failure counter of a username after a successful
+// login. The failures of the client IP are kept, so that an attacker cannot
+// reset them by logging into their own account.
+func (l *Lockout) RecordSuccess(username string, ip string) error {
+	conn := l.redisPool.Get()
+	defer conn.Close()
+
+	userFailures, _ := lockoutKeys(LockoutUsername, username)
+
+	if _, err := conn.Do("DEL", userFailures); err != nil {
+		return err
+	}
+
+	_, err := lockoutReleaseScript.Do(conn, 2, pendingKey(LockoutUsername, username), pendingKey(LockoutIP, ip))
+	return err
+}
+
+// Release gives back a reserved attempt that neither failed nor succeeded,
+// like an attempt that failed due to an error of the authentication provider.
+func (l *Lockout) Release(username string, ip string) error {
+	conn := l.redisPool.Get()
+	defer conn.Close()
+
+	_, err := lockoutReleaseScript.Do(conn, 2, pendingKey(LockoutUsername, username), pendingKey(LockoutIP, ip))
+	return err
+}
+
+// Unlock lifts the lockout of a username or client IP and resets its failure
+// counter. It reports whether the username or IP was locked out.
+func (l *Lockout) Unlock(kind string, key string) (bool, error) {
+	if kind != LockoutUsername && kind != LockoutIP {
+		return false, fmt.Errorf("unknown lockout kind '%s'", kind)
+	}
+
+	conn := l.redisPool.Get()
+	defer conn.Close()
+
+	failures, lock := lockoutKeys(kind, key)
+
+	if err := conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+
+	for _, k := range []string{lock, failures} {
+		if err := conn.Send("DEL", k); err != nil {
+			return false, err
+		}
+	}
+
+	deleted, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	if deleted[0] > 0 {
+		l.logger.Noticef("lifted lockout of %s %s", kind, key)
+	}
+
+	return deleted[0] > 0, nil
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+type recordingLockoutListener struct {
+	lock   sync.Mutex
+	events []LockoutEvent
+}
+
+func (l *recordingLockoutListener) OnLockout(event LockoutEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.events = append(l.events, event)
+}
+
+func newTestLockout(t *testing.T, cfg config.ProviderLockoutConfig) *Lockout {
+	t.Helper()
+
+	l, err := NewLockout(&cfg, newTestRedisPool(t), logging.MustGetLogger("test"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return l
+}
+
+// newTestAuthRoutes registers the authentication endpoints with a lockout of
+// three failures. The provider rejects every password except "secret" and
+// every challenge answer.
+func newTestAuthRoutes(t *testing.T) (*httprouter.Router, *recordingLockoutListener) {
+	t.Helper()
+
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		switch {
+		case req.URL.Path == "/authenticate" && body["password"] == "secret":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(202)
+			_, _ = rw.Write([]byte(`{"type":"otp"}`))
+		default:
+			rw.WriteHeader(403)
+		}
+	}))
+	t.Cleanup(provider.Close)
+
+	cfg := &config.GlobalAuth{
+		VerificationKey: []byte("key"),
+		KeyCacheTtl:     "5m",
+		ProviderConfig: config.ProviderAuthConfig{
+			Url:                 provider.URL,
+			AllowAuthentication: true,
+			Challenge:           config.ProviderChallengeConfig{Enabled: true, MaxAttempts: 10},
+			Lockout:             config.ProviderLockoutConfig{Enabled: true, MaxFailures: 3, Duration: "10s"},
+		},
+	}
+
+	logger := logging.MustGetLogger("test")
+	verifier, _ := NewJwtVerifier(cfg)
+	store := NewMemoryTokenStore(verifier, time.Hour)
+
+	handler, err := NewAuthenticationHandler(cfg, &config.ScriptingConfiguration{}, newTestRedisPool(t), store, verifier, logger, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	listener := &recordingLockoutListener{}
+	handler.Lockout().RegisterListener(listener)
+
+	mux := httprouter.New()
+	if err := NewRestAuthDecorator(handler, store, logger).RegisterRoutes(mux); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return mux, listener
+}
+
+func TestLockoutOfAuthentication(t *testing.T) {
+	mux, listener := newTestAuthRoutes(t)
+
+	for i := 0; i < 3; i++ {
+		if rec := post(mux, "/authenticate", `{"username":"Bob","password":"wrong"}`); rec.Code != 403 {
+			t.Fatalf("attempt %d: expected 403, got %d", i+1, rec.Code)
+		}
+	}
+
+	rec := post(mux, "/authenticate", `{"username":"bob","password":"secret"}`)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("expected 429 with Retry-After 10, got %d (%s)", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	if len(listener.events) != 2 || listener.events[0].Kind != LockoutUsername || listener.events[0].Key != "bob" || listener.events[1].Kind != LockoutIP {
+		t.Fatalf("unexpected lockout events %+v", listener.events)
+	}
+
+	if rec := post(mux, "/authenticate", `{"username":"alice","password":"secret"}`); rec.Code != 429 {
+		t.Fatalf("expected client IP to be locked out, got %d", rec.Code)
+	}
+}
+
+func TestLockoutOfChallenge(t *testing.T) {
+	mux, _ := newTestAuthRoutes(t)
+
+	rec := post(mux, "/authenticate", `{"username":"bob","password":"secret"}`)
+
+	var challenge map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil || rec.Code != 202 {
+		t.Fatalf("expected challenge, got %d (%v)", rec.Code, err)
+	}
+
+	answer := `{"challenge_id":"` + challenge["challenge_id"].(string) + `","otp":"000000"}`
+
+	for i := 0; i < 3; i++ {
+		if rec := post(mux, "/authenticate/challenge", answer); rec.Code != 403 {
+			t.Fatalf("attempt %d: expected 403, got %d", i+1, rec.Code)
+		}
+	}
+
+	if rec := post(mux, "/authenticate/challenge", answer); rec.Code != 429 {
+		t.Fatalf("expected challenge to be locked out, got %d", rec.Code)
+	}
+}
+
+func TestLockoutReservesAttemptsAtomically(t *testing.T) {
+	l := newTestLockout(t, config.ProviderLockoutConfig{MaxFailures: 5})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reserved := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			remaining, err := l.Reserve("bob", "192.0.2.1")
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+
+			if remaining == 0 {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if reserved != 5 {
+		t.Fatalf("expected 5 concurrent attempts to be reserved, got %d", reserved)
+	}
+}
+
+func TestLockoutSuccessKeepsFailuresOfClientIP(t *testing.T) {
+	l := newTestLockout(t, config.ProviderLockoutConfig{MaxFailures: 2})
+
+	for _, user := range []string{"mallory", "bob"} {
+		if remaining, err := l.Reserve(user, "192.0.2.1"); err != nil || remaining != 0 {
+			t.Fatalf("expected attempt to be reserved, got %s (%v)", remaining, err)
+		}
+	}
+
+	if err := l.RecordFailure("mallory", "192.0.2.1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := l.RecordSuccess("bob", "192.0.2.1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if remaining, _ := l.Reserve("alice", "192.0.2.1"); remaining != 0 {
+		t.Fatal("expected successful login not to count as failure of the client IP")
+	}
+	if err := l.RecordFailure("alice", "192.0.2.1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if remaining, _ := l.Reserve("carol", "192.0.2.1"); remaining == 0 {
+		t.Fatal("expected client IP to be locked out after two failures")
+	}
+}
+
+func TestLockoutClientIP(t *testing.T) {
+	l := newTestLockout(t, config.ProviderLockoutConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.10"}})
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"198.51.100.1:1234", "", "198.51.100.1"},
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.1", "203.0.113.1"},
+		{"10.0.0.1:1234", "203.0.113.1, 192.0.2.10", "203.0.113.1"},
+		{"10.0.0.1:1234", "1.1.1.1, 203.0.113.1, 10.1.1.1", "203.0.113.1"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/authenticate", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		if ip := l.ClientIP(req); ip != c.expected {
+			t.Errorf("%s via %s: expected %s, got %s", c.forwarded, c.remoteAddr, c.expected, ip)
+		}
+	}
+}
+
+func TestNewLockoutRejectsInvalidTrustedProxies(t *testing.T) {
+	if _, err := NewLockout(&config.ProviderLockoutConfig{TrustedProxies: []string{"proxy.local"}}, nil, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
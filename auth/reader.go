@@ -10,27 +10,27 @@ import (
 var NoTokenError = errors.New("no authentication token found in request")
 
 type TokenReader interface {
-	TokenFromRequest(*http.Request) (*JWTResponse, error)
+	TokenFromRequest(*http.Request) (string, *JWTResponse, error)
 }
 
 type BearerTokenReader struct {
 	store TokenStore
 }
 
-func (b *BearerTokenReader) TokenFromRequest(req *http.Request) (*JWTResponse, error) {
+func (b *BearerTokenReader) TokenFromRequest(req *http.Request) (string, *JWTResponse, error) {
 	tokenString, err := b.tokenStringFromRequest(req)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	token, err := b.store.GetToken(tokenString)
 	if err == NoTokenError {
-		return nil, err
+		return "", nil, err
 	} else if err != nil {
-		return nil, fmt.Errorf("error while loading JWT for token: %s", err)
+		return "", nil, fmt.Errorf("error while loading JWT for token: %s", err)
 	}
 
-	return token, nil
+	return tokenString, token, nil
 }
 
 func (b *BearerTokenReader) tokenStringFromRequest(req *http.Request) (string, error) {
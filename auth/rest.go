@@ -24,15 +24,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/cors"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// errLoginRejected is returned by guardLogin for attempts that were rejected
+// by the lockout; the response has already been written.
+var errLoginRejected = errors.New("login rejected")
+
 type RestAuthDecorator struct {
 	authHandler *AuthenticationHandler
 	tokenStore  TokenStore
@@ -87,14 +98,15 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 		responseRecorder := httptest.NewRecorder()
 
 		handleError := func(err error, rw http.ResponseWriter, statusCode int) {
-			a.logger.Errorf("error while handling authentication request: %s", err)
-			rw.Header().Set("Content-Type", "application/json;charset=utf8")
-			rw.WriteHeader(statusCode)
-			_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+			requestid.NewLogger(req.Context(), a.logger).Errorf("error while handling authentication request: %s", err)
+			writeError(rw, req, statusCode, "internal server error")
 		}
 
+		outcome := "authenticated"
+
 		authenticated, token, err := a.authHandler.IsAuthenticated(req)
 		if err != nil {
+			a.countResult(appName, "error")
 			handleError(err, res, 503)
 			return
 		}
@@ -102,26 +114,49 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 		if cfg.Authentication.ProviderConfig.Service == appName ||
 			(cfg.Applications[appName].Backend.Url != "" && cfg.Authentication.ProviderConfig.Url != "" &&
 				cfg.Applications[appName].Backend.Url == cfg.Authentication.ProviderConfig.Url) {
+			outcome = "provider"
 			goto valid
 		}
 
 		if !authenticated {
+			outcome = "unauthenticated"
 			goto invalid
 		}
 
 		if token.AllowedApplications != nil && len(token.AllowedApplications) > 0 {
 			for i := range token.AllowedApplications {
 				if token.AllowedApplications[i] == appName {
-					goto valid
+					goto scoped
 				}
 			}
 
-			a.logger.Warningf("token is not whitelisted for app %s. whitelisted apps: %s", appName, token.AllowedApplications)
+			requestid.NewLogger(req.Context(), a.logger).Warningf("token is not whitelisted for app %s. whitelisted apps: %s", appName, token.AllowedApplications)
+			outcome = "forbidden_application"
 			goto invalid
 		}
 
+	scoped:
+		if !ScopesAllow(token.Scopes, appName, req) {
+			requiredScope := RequiredScope(appName, req)
+			requestid.NewLogger(req.Context(), a.logger).Warningf("token lacks scope %s. scopes: %s", requiredScope, token.Scopes)
+			a.countResult(appName, "insufficient_scope")
+
+			body, _ := json.Marshal(map[string]string{"msg": "insufficient scope", "required_scope": requiredScope, "request_id": requestid.FromRequest(req)})
+
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, requiredScope))
+			res.WriteHeader(403)
+			_, _ = res.Write(body)
+			return
+		}
+
 	valid:
+		a.countResult(appName, outcome)
+
 		if token != nil {
+			requestinfo.Get(req).JWT = token.JWT
+
+			req = WithRequestToken(req, token)
 			_ = writer.WriteTokenToRequest(token.JWT, req)
 
 			for i := range a.listeners {
@@ -156,10 +191,80 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 		return
 
 	invalid:
+		a.countResult(appName, outcome)
+
 		res.Header().Set("Content-Type", "application/json")
 		res.WriteHeader(403)
-		_, _ = res.Write([]byte("{\"msg\": \"not authenticated\"}"))
+		_, _ = res.Write([]byte(fmt.Sprintf("{\"msg\": \"not authenticated\", \"request_id\": \"%s\"}", requestid.FromRequest(req))))
+	}
+}
+
+// writeError writes a JSON error response that includes the request ID, so
+// that clients can refer to the request when reporting problems.
+func writeError(rw http.ResponseWriter, req *http.Request, statusCode int, msg string) {
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	rw.WriteHeader(statusCode)
+	_, _ = rw.Write([]byte(fmt.Sprintf(`{"msg":"%s","request_id":"%s"}`, msg, requestid.FromRequest(req))))
+}
+
+func (a *RestAuthDecorator) countResult(appName string, outcome string) {
+	if a.authHandler.metrics == nil {
+		return
+	}
+	a.authHandler.metrics.AuthResults.With(prometheus.Labels{"application": appName, "outcome": outcome}).Inc()
+}
+
+func (a *RestAuthDecorator) countLogin(endpoint string, outcome string) {
+	if a.authHandler.metrics == nil {
+		return
+	}
+	a.authHandler.metrics.Logins.With(prometheus.Labels{"endpoint": endpoint, "outcome": outcome}).Inc()
+}
+
+// guardLogin reserves a login attempt of a user with the lockout (if it is
+// enabled), runs the attempt and records its outcome. If the user or client
+// is locked out, it writes the response itself and returns errLoginRejected.
+func (a *RestAuthDecorator) guardLogin(rw http.ResponseWriter, req *http.Request, endpoint string, username string, attempt func() (*JWTResponse, error)) (*JWTResponse, error) {
+	lockout := a.authHandler.Lockout()
+	if lockout == nil {
+		return attempt()
+	}
+
+	clientIP := lockout.ClientIP(req)
+
+	remaining, err := lockout.Reserve(username, clientIP)
+	if err != nil {
+		a.countLogin(endpoint, "error")
+		requestid.NewLogger(req.Context(), a.logger).Errorf("could not check lockout of user %s: %s", username, err)
+		writeError(rw, req, 503, "service unavailable")
+		return nil, errLoginRejected
+	}
+
+	if remaining > 0 {
+		a.countLogin(endpoint, "locked_out")
+		retryAfter := int(math.Ceil(remaining.Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(rw, req, 429, "too many failed login attempts")
+		return nil, errLoginRejected
+	}
+
+	authResponse, err := attempt()
+
+	var lockoutErr error
+	switch {
+	case err == InvalidCredentialsError:
+		lockoutErr = lockout.RecordFailure(username, clientIP)
+	case err == nil:
+		lockoutErr = lockout.RecordSuccess(username, clientIP)
+	default:
+		lockoutErr = lockout.Release(username, clientIP)
 	}
+
+	if lockoutErr != nil {
+		requestid.NewLogger(req.Context(), a.logger).Errorf("could not record login of user %s: %s", username, lockoutErr)
+	}
+
+	return authResponse, err
 }
 
 func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
@@ -172,107 +277,201 @@ func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
 		uri = "/authenticate"
 	}
 
-	handleError := func(err error, rw http.ResponseWriter) {
-		a.logger.Errorf("error while handling authentication request: %s", err)
-		rw.Header().Set("Content-Type", "application/json;charset=utf8")
-		rw.WriteHeader(500)
-		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	policy, err := cors.AuthenticationPolicy(a.authHandler.config)
+	if err != nil {
+		return fmt.Errorf("invalid CORS configuration of authentication: %s", err)
 	}
 
-	handleIncompleteAuthentication := func(authenticationIncompleteErr *AuthenticationIncompleteError, rw http.ResponseWriter) error {
-		rw.Header().Set("Content-Type", "application/json;charset=utf8")
-		rw.WriteHeader(202)
+	withCORS := func(handler httprouter.Handle) httprouter.Handle {
+		if policy == nil {
+			return handler
+		}
+		return policy.DecorateHandler(handler)
+	}
+
+	handleError := func(err error, rw http.ResponseWriter, req *http.Request) {
+		requestid.NewLogger(req.Context(), a.logger).Errorf("error while handling authentication request: %s", err)
+		writeError(rw, req, 500, "internal server error")
+	}
+
+	handleIncompleteAuthentication := func(authenticationIncompleteErr *AuthenticationIncompleteError, rw http.ResponseWriter, req *http.Request, challengeID string) error {
+		properties := authenticationIncompleteErr.AdditionalProperties
+
+		if a.authHandler.ChallengeEnabled() {
+			if properties == nil {
+				properties = make(map[string]interface{})
+			}
+
+			if challengeID == "" {
+				challenge, err := a.authHandler.CreateChallenge(req.Context(), authenticationIncompleteErr)
+				if err != nil {
+					return err
+				}
+				challengeID = challenge.ID
+				properties["challenge_expires"] = time.Unix(challenge.ExpiresAt, 0).Format(time.RFC3339)
+			}
+
+			properties["challenge_id"] = challengeID
+		}
 
-		jsonString, err := json.Marshal(authenticationIncompleteErr.AdditionalProperties)
+		jsonString, err := json.Marshal(properties)
 		if err != nil {
 			return err
 		}
+
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(202)
 		_, _ = rw.Write(jsonString)
 		return nil
 	}
 
-	if a.authHandler.config.EnableCORS {
+	handleAuthenticated := func(authResponse *JWTResponse, rw http.ResponseWriter, req *http.Request) {
+		token, exp, err := a.tokenStore.AddToken(authResponse)
+		if err != nil {
+			handleError(err, rw, req)
+			return
+		}
+
+		response := ExternalAuthenticationResponse{
+			Token:   token,
+			Expires: time.Unix(exp, 0).Format(time.RFC3339),
+		}
+		jsonResponse, err := json.Marshal(&response)
+		if err != nil {
+			handleError(err, rw, req)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		_, _ = rw.Write(jsonResponse)
+	}
+
+	if policy != nil {
 		mux.OPTIONS(
-			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-				setCORSHeaders(rw.Header())
+			uri, withCORS(func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
 				rw.WriteHeader(200)
-			},
+			}),
 		)
 	}
 
 	mux.POST(
-		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		uri, withCORS(func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
 			var authRequest ExternalAuthenticationRequest
 			var genericBody map[string]interface{}
 
-			h := rw.Header()
-			if a.authHandler.config.EnableCORS {
-				setCORSHeaders(h)
-			}
-
 			requestBody, err := io.ReadAll(req.Body)
 			if err != nil {
-				handleError(err, rw)
+				handleError(err, rw, req)
 				return
 			}
 
 			if err := json.Unmarshal(requestBody, &authRequest); err != nil {
-				handleError(err, rw)
+				handleError(err, rw, req)
 				return
 			}
 			if err := json.Unmarshal(requestBody, &genericBody); err != nil {
-				handleError(err, rw)
+				handleError(err, rw, req)
+				return
+			}
+
+			authResponse, err := a.guardLogin(rw, req, "authenticate", authRequest.Username, func() (*JWTResponse, error) {
+				return a.authHandler.Authenticate(req.Context(), authRequest.Username, authRequest.Password, genericBody, req.Header)
+			})
+			if err == errLoginRejected {
 				return
 			}
 
-			authResponse, err := a.authHandler.Authenticate(authRequest.Username, authRequest.Password, genericBody)
 			if err == InvalidCredentialsError {
-				rw.Header().Set("Content-Type", "application/json;charset=utf8")
-				rw.WriteHeader(403)
-				_, _ = rw.Write([]byte(`{"msg":"invalid credentials"}`))
+				a.countLogin("authenticate", "invalid_credentials")
+				writeError(rw, req, 403, "invalid credentials")
 				return
 			} else if errors.Is(err, AuthenticationIncompleteError{}) {
-				if innerErr := handleIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw); innerErr != nil {
-					handleError(innerErr, rw)
+				a.countLogin("authenticate", "incomplete")
+				if innerErr := handleIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw, req, ""); innerErr != nil {
+					handleError(innerErr, rw, req)
 					return
 				}
 				return
 			} else if err != nil || authResponse == nil {
-				handleError(err, rw)
+				a.countLogin("authenticate", "error")
+				handleError(err, rw, req)
 				return
 			}
 
-			token, exp, err := a.tokenStore.AddToken(authResponse)
-			if err != nil {
-				handleError(err, rw)
+			a.countLogin("authenticate", "success")
+			handleAuthenticated(authResponse, rw, req)
+		}),
+	)
+
+	if !a.authHandler.ChallengeEnabled() {
+		return nil
+	}
+
+	challengeUri := a.authHandler.config.ProviderConfig.Challenge.Uri
+	if challengeUri == "" {
+		challengeUri = strings.TrimRight(uri, "/") + "/challenge"
+	}
+
+	if policy != nil {
+		mux.OPTIONS(
+			challengeUri, withCORS(func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				rw.WriteHeader(200)
+			}),
+		)
+	}
+
+	mux.POST(
+		challengeUri, withCORS(func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			var answer map[string]interface{}
+
+			if err := json.NewDecoder(req.Body).Decode(&answer); err != nil {
+				writeError(rw, req, 400, "invalid request body")
 				return
 			}
 
-			response := ExternalAuthenticationResponse{
-				Token:   token,
-				Expires: time.Unix(exp, 0).Format(time.RFC3339),
+			challengeID, _ := answer["challenge_id"].(string)
+			delete(answer, "challenge_id")
+
+			var authResponse *JWTResponse
+
+			username, err := a.authHandler.ChallengeUsername(challengeID)
+			if err == nil {
+				authResponse, err = a.guardLogin(rw, req, "challenge", username, func() (*JWTResponse, error) {
+					return a.authHandler.CompleteChallenge(req.Context(), challengeID, answer)
+				})
+				if err == errLoginRejected {
+					return
+				}
 			}
-			jsonResponse, err := json.Marshal(&response)
-			if err != nil {
-				handleError(err, rw)
+
+			if err == InvalidCredentialsError {
+				a.countLogin("challenge", "invalid_credentials")
+				writeError(rw, req, 403, "invalid credentials")
+				return
+			} else if err == UnknownChallengeError || err == TooManyAttemptsError {
+				a.countLogin("challenge", "invalid_challenge")
+				writeError(rw, req, 403, err.Error())
+				return
+			} else if errors.Is(err, AuthenticationIncompleteError{}) {
+				a.countLogin("challenge", "incomplete")
+				if innerErr := handleIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw, req, challengeID); innerErr != nil {
+					handleError(innerErr, rw, req)
+				}
+				return
+			} else if err != nil || authResponse == nil {
+				a.countLogin("challenge", "error")
+				handleError(err, rw, req)
 				return
 			}
 
-			h.Set("Content-Type", "application/json;charset=utf8")
-			_, _ = rw.Write(jsonResponse)
-		},
+			a.countLogin("challenge", "success")
+			handleAuthenticated(authResponse, rw, req)
+		}),
 	)
 
 	return nil
 }
 
-func setCORSHeaders(headers http.Header) {
-	headers.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	headers.Set("Access-Control-Allow-Headers", "X-Requested-With, Authorization, Content-Type")
-	headers.Set("Access-Control-Allow-Origin", "*")
-	headers.Set("Access-Control-Allow-Credentials", "true")
-}
-
 func rewriteAccessTokens(resp *httptest.ResponseRecorder, req *http.Request, a *RestAuthDecorator) error {
 	err := rewriteBodyAccessTokens(resp, req, a)
 	if err != nil {
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/op/go-logging"
+)
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("expected JSON error body, got %q (%s)", rec.Body, err)
+	}
+	return body
+}
+
+func TestLoginErrorsIncludeRequestID(t *testing.T) {
+	mux, _ := newTestAuthRoutes(t)
+	handler := requestid.NewHandler(mux)
+
+	requests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/authenticate", `{"username":"bob","password":"wrong"}`, 403},
+		{"/authenticate", `{"username":`, 500},
+		{"/authenticate/challenge", `{"challenge_id":`, 400},
+		{"/authenticate/challenge", `{"challenge_id":"unknown","otp":"000000"}`, 403},
+		{"/authenticate", `{"username":"bob","password":"wrong"}`, 403},
+		{"/authenticate", `{"username":"bob","password":"wrong"}`, 403},
+		{"/authenticate", `{"username":"bob","password":"wrong"}`, 429},
+	}
+
+	for _, r := range requests {
+		req := httptest.NewRequest("POST", r.path, strings.NewReader(r.body))
+		req.Header.Set(requestid.Header, "req-1")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != r.status {
+			t.Fatalf("%s %s: expected %d, got %d", r.path, r.body, r.status, rec.Code)
+		}
+		if body := decodeError(t, rec); body["request_id"] != "req-1" || body["msg"] == "" {
+			t.Errorf("%s %s: expected message and request ID, got %v", r.path, r.body, body)
+		}
+	}
+}
+
+func TestInsufficientScopeIncludesRequestID(t *testing.T) {
+	key, keyPEM := newTestKey(t)
+
+	cfg := config.Configuration{
+		Authentication: config.GlobalAuth{
+			VerificationKey: keyPEM,
+			KeyCacheTtl:     "5m",
+		},
+		Applications: map[string]config.Application{"items": {}},
+	}
+
+	logger := logging.MustGetLogger("test")
+	verifier, _ := NewJwtVerifier(&cfg.Authentication)
+	store := NewMemoryTokenStore(verifier, time.Hour)
+
+	handler, err := NewAuthenticationHandler(&cfg.Authentication, &config.ScriptingConfiguration{}, newTestRedisPool(t), store, verifier, logger, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString(key)
+	token, _, err := store.AddToken(&JWTResponse{JWT: signed, Scopes: []string{"items:GET:/items/*"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	app := cfg.Applications["items"]
+	decorated := NewRestAuthDecorator(handler, store, logger).DecorateHandler(func(rw http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		t.Error("expected request to be rejected")
+	}, "items", &app, &cfg)
+
+	req := httptest.NewRequest("DELETE", "/items/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(requestid.Header, "req-2")
+
+	rec := httptest.NewRecorder()
+	requestid.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		decorated(rw, req, nil)
+	})).ServeHTTP(rec, req)
+
+	body := decodeError(t, rec)
+	if rec.Code != 403 || body["required_scope"] != "items:DELETE:/items/1" || body["request_id"] != "req-2" {
+		t.Errorf("expected insufficient scope error with request ID, got %d %v", rec.Code, body)
+	}
+}
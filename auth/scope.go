@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Scope restricts a token to certain requests within an application. Scopes
+// are written as "<application>:<methods>:<path>", for example
+// "billing:GET,HEAD:/billing/invoices/*". Methods and path may be omitted
+// ("billing", "billing:read"); they then match any method or path.
+//
+// Methods are a comma-separated list of HTTP methods; "*" matches any
+// method and "read" matches the safe methods GET, HEAD and OPTIONS. Paths are
+// matched against the request path using path.Match; a path ending in "/**"
+// additionally matches everything below it.
+type Scope struct {
+	Application string
+	Methods     []string
+	Path        string
+}
+
+var readMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+func ParseScope(scope string) (Scope, error) {
+	parts := strings.SplitN(scope, ":", 3)
+	s := Scope{Application: parts[0]}
+
+	if s.Application == "" {
+		return s, fmt.Errorf("scope '%s' does not name an application", scope)
+	}
+
+	if strings.ContainsAny(scope, "; ") {
+		return s, fmt.Errorf("scope '%s' must not contain spaces or semicolons", scope)
+	}
+
+	if len(parts) > 1 && parts[1] != "" && parts[1] != "*" {
+		for _, method := range strings.Split(parts[1], ",") {
+			switch method = strings.ToUpper(method); method {
+			case "":
+				return s, fmt.Errorf("scope '%s' contains an empty method", scope)
+			case "READ":
+				s.Methods = append(s.Methods, readMethods...)
+			default:
+				s.Methods = append(s.Methods, method)
+			}
+		}
+	}
+
+	if len(parts) > 2 && parts[2] != "" {
+		s.Path = parts[2]
+
+		if !strings.HasPrefix(s.Path, "/") {
+			return s, fmt.Errorf("path of scope '%s' must start with '/'", scope)
+		}
+
+		if _, err := path.Match(strings.TrimSuffix(s.Path, "/**"), "/"); err != nil {
+			return s, fmt.Errorf("path of scope '%s' is not a valid pattern: %s", scope, err)
+		}
+	}
+
+	return s, nil
+}
+
+// ParseScopes parses a list of scopes, failing on the first invalid scope.
+func ParseScopes(scopes []string) ([]Scope, error) {
+	parsed := make([]Scope, len(scopes))
+	for i := range scopes {
+		s, err := ParseScope(scopes[i])
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = s
+	}
+	return parsed, nil
+}
+
+func (s Scope) Allows(application string, method string, requestPath string) bool {
+	if s.Application != application {
+		return false
+	}
+
+	if len(s.Methods) > 0 {
+		allowed := false
+		for _, m := range s.Methods {
+			if m == method {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	if s.Path == "" {
+		return true
+	}
+
+	if prefix := strings.TrimSuffix(s.Path, "/**"); prefix != s.Path {
+		if ok, _ := path.Match(prefix, requestPath); ok {
+			return true
+		}
+
+		// match the pattern against the leading segments of the path
+		segments := strings.Count(prefix, "/")
+		requestSegments := strings.Split(requestPath, "/")
+		if len(requestSegments) <= segments+1 {
+			return false
+		}
+
+		ok, _ := path.Match(prefix, strings.Join(requestSegments[:segments+1], "/"))
+		return ok
+	}
+
+	ok, _ := path.Match(s.Path, requestPath)
+	return ok
+}
+
+// RequiredScope returns the most specific scope that would allow a request.
+func RequiredScope(application string, req *http.Request) string {
+	return application + ":" + req.Method + ":" + req.URL.Path
+}
+
+// ScopesAllow checks if any of the given scopes allows a request. Tokens
+// without scopes are not restricted. Scopes with a path never allow requests
+// whose path is not canonical, since the upstream service might resolve it to
+// a path outside of the scope.
+func ScopesAllow(scopes []string, application string, req *http.Request) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+
+	canonical := isCanonicalPath(req)
+
+	for i := range scopes {
+		s, err := ParseScope(scopes[i])
+		if err != nil {
+			continue
+		}
+
+		if s.Path != "" && !canonical {
+			continue
+		}
+
+		if s.Allows(application, req.Method, req.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCanonicalPath checks that the path of a request contains no dot segments,
+// empty segments or escaped slashes.
+func isCanonicalPath(req *http.Request) bool {
+	p := req.URL.Path
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	if cleaned != p {
+		return false
+	}
+
+	escaped := strings.ToLower(req.URL.EscapedPath())
+	return !strings.Contains(escaped, "%2f") && !strings.Contains(escaped, "%5c")
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScopesAllow(t *testing.T) {
+	cases := []struct {
+		scope  string
+		method string
+		path   string
+		ok     bool
+	}{
+		{"a", "DELETE", "/x", true},
+		{"a:read", "GET", "/x", true},
+		{"a:read", "POST", "/x", false},
+		{"a:GET,post:/items/*", "POST", "/items/1", true},
+		{"a:GET:/items/*", "GET", "/items/1/x", false},
+		{"a:*:/items/**", "GET", "/items/1/x", true},
+		{"a:*:/items/**", "GET", "/items", true},
+		{"a:*:/items/**", "GET", "/items/", true},
+		{"a:*:/items/**", "GET", "/itemsx", false},
+		{"a:*:/v1/*/items/**", "GET", "/v1/z/items/3", true},
+		{"b", "GET", "/x", false},
+
+		// Paths that the upstream service might resolve differently.
+		{"a:*:/items/**", "GET", "/items/../admin", false},
+		{"a:*:/items/**", "GET", "/items/%2E%2E/admin", false},
+		{"a:*:/items/**", "GET", "/items/./1", false},
+		{"a:*:/items/**", "GET", "/items//1", false},
+		{"a:*:/items/*", "GET", "/items/1%2F..%2F..%2Fadmin", false},
+		{"a:*:/items/*", "GET", "/items/1%5C..%5Cadmin", false},
+		{"a:*:/items/*", "GET", "/items/a%20b", true},
+		{"a", "GET", "/items/../admin", true},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+
+		if ScopesAllow([]string{c.scope}, "a", req) != c.ok {
+			t.Errorf("scope %s, %s %s: expected %t", c.scope, c.method, c.path, c.ok)
+		}
+	}
+}
+
+func TestScopesAllowUnrestrictedTokens(t *testing.T) {
+	if !ScopesAllow(nil, "a", httptest.NewRequest("GET", "/x", nil)) {
+		t.Error("expected token without scopes to be unrestricted")
+	}
+}
+
+func TestParseScopeRejectsInvalidScopes(t *testing.T) {
+	for _, scope := range []string{"", ":GET", "a:GET:items", "a:GET:/[", "a;b", "a:GET,,POST"} {
+		if _, err := ParseScope(scope); err == nil {
+			t.Errorf("%q: expected an error", scope)
+		}
+	}
+}
@@ -4,15 +4,35 @@ import (
 	"crypto/rand"
 	"encoding/base32"
 	"fmt"
-	"strings"
+	"os"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
 )
 
 type MappedToken struct {
-	Jwt   string
-	Token string
+	Jwt          string
+	TokenHash    string
+	Subject      string
+	IssuedAt     int64
+	ExpiresAt    int64
+	Applications []string
+	Scopes       []string
+}
+
+// TokenFilter restricts the tokens returned by TokenStore.ListTokens. Zero
+// values are ignored. Application matches the tokens that may access the
+// application, which includes tokens that are not restricted to any
+// application.
+type TokenFilter struct {
+	Subject       string
+	Application   string
+	ExpiresBefore int64
+	ExpiresAfter  int64
 }
 
 type TokenStore interface {
@@ -20,6 +40,20 @@ type TokenStore interface {
 	SetToken(string, *JWTResponse) (int64, error)
 	GetToken(string) (*JWTResponse, error)
 	GetAllTokens() (<-chan MappedToken, error)
+
+	// ListTokens returns one page of tokens matching the filter, starting at
+	// the given cursor ("" for the first page). It also returns the cursor of
+	// the next page, which is "" when there are no more tokens. A page may
+	// contain fewer than limit tokens even if more tokens follow. A limit of 0
+	// does not limit the size of a page; negative limits are rejected.
+	ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error)
+}
+
+// reencrypter is implemented by token stores that encrypt stored JWTs.
+type reencrypter interface {
+	// ReencryptTokens encrypts all stored tokens with the currently active
+	// key and returns the number of updated tokens.
+	ReencryptTokens() (int, error)
 }
 
 type CacheDecorator struct {
@@ -32,16 +66,66 @@ type CacheRecord struct {
 	exp   int64
 }
 
-type RedisTokenStore struct {
-	redisPool *redis.Pool
-	verifier  *JwtVerifier
-}
-
 type TokenStoreOptions struct {
 	LocalCacheBucketSize int
+
+	// RefreshTtl is the time for which a token that can be refreshed is kept
+	// after its JWT has expired. Each refresh extends the lifetime again.
+	RefreshTtl time.Duration
+
+	// Metrics receives the durations of token store operations, if set.
+	Metrics *monitoring.PromMetrics
 }
 
-func NewTokenStore(redisPool *redis.Pool, verifier *JwtVerifier, options TokenStoreOptions) (TokenStore, error) {
+func NewTokenStore(
+	cfg *config.TokenStoreConfiguration,
+	redisPool *redis.Pool,
+	verifier *JwtVerifier,
+	logger *logging.Logger,
+	options TokenStoreOptions,
+) (TokenStore, error) {
+	var store TokenStore
+
+	encrypter, err := NewTokenEncrypter(&cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case "", "redis":
+		store = &RedisTokenStore{
+			redisPool:  redisPool,
+			verifier:   verifier,
+			encrypter:  encrypter,
+			refreshTtl: options.RefreshTtl,
+		}
+	case "memory":
+		if encrypter != nil {
+			return nil, fmt.Errorf("token encryption is not supported by the memory token store")
+		}
+		return instrumentTokenStore(NewMemoryTokenStore(verifier, options.RefreshTtl), options.Metrics), nil
+	case "sql":
+		sqlStore, err := NewSQLTokenStore(cfg.Driver, cfg.Dsn, verifier, encrypter, options.RefreshTtl, logger)
+		if err != nil {
+			return nil, err
+		}
+		store = sqlStore
+	default:
+		return nil, fmt.Errorf("unsupported token store type: '%s'", cfg.Type)
+	}
+
+	if encrypter != nil {
+		interval := time.Hour
+		if cfg.Encryption.ReencryptInterval != "" {
+			interval, err = time.ParseDuration(cfg.Encryption.ReencryptInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid re-encryption interval: %s", err)
+			}
+		}
+
+		go reencryptTokens(store.(reencrypter), redisPool, interval, logger)
+	}
+
 	bucketSize := 128
 
 	if options.LocalCacheBucketSize != 0 {
@@ -54,55 +138,118 @@ func NewTokenStore(redisPool *redis.Pool, verifier *JwtVerifier, options TokenSt
 	}
 
 	return &CacheDecorator{
-		wrapped: &RedisTokenStore{
-			redisPool: redisPool,
-			verifier:  verifier,
-		},
+		wrapped:    instrumentTokenStore(store, options.Metrics),
 		localCache: cache,
 	}, nil
 }
 
-func (s *RedisTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
-	valid, stdClaims, _, err := s.verifier.VerifyToken(jwt.JWT)
+// reencryptLockKey must not start with "token_", since the Redis token store
+// treats all those keys as tokens.
+const reencryptLockKey = "reencrypt_tokens_lock"
+
+// reencryptTokens re-encrypts all tokens once on startup and then in the
+// given interval, so that tokens are moved to a new key after key rotation.
+// All gateway instances share the token store, so each run first acquires a
+// lock in Redis that is held for one interval; instances that do not get the
+// lock skip the run.
+func reencryptTokens(store reencrypter, redisPool *redis.Pool, interval time.Duration, logger *logging.Logger) {
+	for {
+		if locked, err := acquireReencryptLock(redisPool, interval); err != nil {
+			logger.Errorf("error while acquiring re-encryption lock: %s", err)
+		} else if locked {
+			n, err := store.ReencryptTokens()
+			if err != nil {
+				logger.Errorf("error while re-encrypting tokens: %s", err)
+			} else if n > 0 {
+				logger.Infof("re-encrypted %d tokens", n)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// acquireReencryptLock returns whether this instance may re-encrypt the
+// tokens in the current interval. Without a Redis pool, there is nothing to
+// coordinate with.
+func acquireReencryptLock(redisPool *redis.Pool, interval time.Duration) (bool, error) {
+	if redisPool == nil {
+		return true, nil
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	hostname, _ := os.Hostname()
+
+	_, err := redis.String(conn.Do("SET", reencryptLockKey, fmt.Sprintf("%s:%d", hostname, os.Getpid()), "NX", "PX", interval.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+type tokenLifetime struct {
+	subject   string
+	issuedAt  int64
+	expiresAt int64
+}
+
+// tokenLifetimeOf verifies a JWT and determines how long the token mapped to
+// it should be stored. Tokens that can be refreshed live for refreshTtl longer
+// than their JWT.
+func tokenLifetimeOf(verifier *JwtVerifier, jwt *JWTResponse, refreshTtl time.Duration) (*tokenLifetime, error) {
+	valid, stdClaims, _, err := verifier.VerifyToken(jwt.JWT)
 	if !valid {
-		return 0, fmt.Errorf("JWT is invalid. Err: '%+v'", err)
+		return nil, fmt.Errorf("JWT is invalid. Err: '%+v'", err)
 	}
 
 	if err != nil {
-		return 0, fmt.Errorf("bad JWT: %s", err)
+		return nil, fmt.Errorf("bad JWT: %s", err)
 	}
 
-	key := "token_" + token
+	lifetime := tokenLifetime{
+		subject:   stdClaims.Subject,
+		issuedAt:  stdClaims.IssuedAt,
+		expiresAt: stdClaims.ExpiresAt,
+	}
 
-	conn := s.redisPool.Get()
-	defer conn.Close()
+	if lifetime.issuedAt == 0 {
+		lifetime.issuedAt = time.Now().Unix()
+	}
 
-	_, err = conn.Do("HMSET", key, "jwt", jwt.JWT, "token", token, "applications", strings.Join(jwt.AllowedApplications, ";"))
-	if err != nil {
-		return 0, err
+	if lifetime.expiresAt > 0 && jwt.RefreshToken != "" {
+		lifetime.expiresAt += int64(refreshTtl.Seconds())
 	}
 
-	if stdClaims.ExpiresAt > 0 {
-		_, err = conn.Do("EXPIREAT", key, stdClaims.ExpiresAt)
-		if err != nil {
-			return 0, err
-		}
+	if lifetime.expiresAt > 0 && lifetime.expiresAt <= time.Now().Unix() {
+		return nil, fmt.Errorf("JWT has already expired")
 	}
 
-	return stdClaims.ExpiresAt, nil
+	return &lifetime, nil
 }
 
-func (s *RedisTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+func newTokenString() (string, error) {
 	randomBytes := make([]byte, 32)
 
 	_, err := rand.Read(randomBytes)
 	if err != nil {
-		return "", 0, err
+		return "", err
 	}
 
-	tokenStr := base32.StdEncoding.EncodeToString(randomBytes)
+	return base32.StdEncoding.EncodeToString(randomBytes), nil
+}
+
+func addToken(store TokenStore, jwt *JWTResponse) (string, int64, error) {
+	tokenStr, err := newTokenString()
+	if err != nil {
+		return "", 0, err
+	}
 
-	exp, err := s.SetToken(tokenStr, jwt)
+	exp, err := store.SetToken(tokenStr, jwt)
 	if err != nil {
 		return "", 0, err
 	}
@@ -110,55 +257,42 @@ func (s *RedisTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
 	return tokenStr, exp, nil
 }
 
-func (s *RedisTokenStore) GetToken(token string) (*JWTResponse, error) {
-	conn := s.redisPool.Get()
-	defer conn.Close()
-
-	key := "token_" + token
-	response := JWTResponse{}
-
-	results, err := redis.Strings(conn.Do("HMGET", key, "jwt", "applications"))
-	if err == redis.ErrNil {
-		return nil, NoTokenError
-	} else if err != nil {
-		return nil, err
+// checkListLimit rejects the page sizes that ListTokens does not accept.
+func checkListLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", limit)
 	}
+	return nil
+}
 
-	response.JWT = results[0]
-	if results[1] != "" {
-		response.AllowedApplications = strings.Split(results[1], ";")
+func (f *TokenFilter) Matches(token *MappedToken) bool {
+	if f.Subject != "" && token.Subject != f.Subject {
+		return false
 	}
 
-	return &response, nil
-}
-
-func (s *RedisTokenStore) GetAllTokens() (<-chan MappedToken, error) {
-	conn := s.redisPool.Get()
+	if f.Application != "" && len(token.Applications) > 0 {
+		found := false
+		for _, app := range token.Applications {
+			if app == f.Application {
+				found = true
+				break
+			}
+		}
 
-	keys, err := redis.Strings(conn.Do("KEYS", "token_*"))
-	if err != nil {
-		conn.Close()
-		return nil, err
+		if !found {
+			return false
+		}
 	}
 
-	c := make(chan MappedToken)
-	if len(keys) == 0 {
-		close(c)
-		conn.Close()
-		return c, nil
+	if f.ExpiresBefore != 0 && (token.ExpiresAt == 0 || token.ExpiresAt >= f.ExpiresBefore) {
+		return false
 	}
 
-	go func() {
-		for _, key := range keys {
-			values, _ := redis.StringMap(conn.Do("HGETALL", key))
-			c <- MappedToken{Jwt: values["jwt"], Token: values["token"]}
-		}
-
-		conn.Close()
-		close(c)
-	}()
+	if f.ExpiresAfter != 0 && token.ExpiresAt != 0 && token.ExpiresAt <= f.ExpiresAfter {
+		return false
+	}
 
-	return c, nil
+	return true
 }
 
 func (s *CacheDecorator) SetToken(token string, jwt *JWTResponse) (int64, error) {
@@ -188,7 +322,10 @@ func (s *CacheDecorator) GetToken(token string) (*JWTResponse, error) {
 		case string:
 			return &JWTResponse{JWT: t}, nil
 		case *CacheRecord:
-			return t.token, nil
+			if t.exp == 0 || t.exp > time.Now().Unix() {
+				return t.token, nil
+			}
+			s.localCache.Remove(token)
 		default:
 			return nil, fmt.Errorf("invalid data type for token %s", token)
 		}
@@ -200,3 +337,7 @@ func (s *CacheDecorator) GetToken(token string) (*JWTResponse, error) {
 func (s *CacheDecorator) GetAllTokens() (<-chan MappedToken, error) {
 	return s.wrapped.GetAllTokens()
 }
+
+func (s *CacheDecorator) ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error) {
+	return s.wrapped.ListTokens(filter, cursor, limit)
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"sort"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// MemoryTokenStore keeps all tokens in the memory of the gateway process. It
+// is intended for local development and single-instance installations; tokens
+// are lost when the gateway is restarted. Like the other stores, it keeps
+// tokens only by their hash; JWTs are not encrypted since they never leave
+// the process.
+type MemoryTokenStore struct {
+	tokens     *cache.Cache
+	verifier   *JwtVerifier
+	refreshTtl time.Duration
+}
+
+type memoryRecord struct {
+	token  JWTResponse
+	mapped MappedToken
+}
+
+func NewMemoryTokenStore(verifier *JwtVerifier, refreshTtl time.Duration) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:     cache.New(cache.NoExpiration, 5*time.Minute),
+		verifier:   verifier,
+		refreshTtl: refreshTtl,
+	}
+}
+
+func (s *MemoryTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	lifetime, err := tokenLifetimeOf(s.verifier, jwt, s.refreshTtl)
+	if err != nil {
+		return 0, err
+	}
+
+	ttl := cache.NoExpiration
+	if lifetime.expiresAt > 0 {
+		ttl = time.Until(time.Unix(lifetime.expiresAt, 0))
+	}
+
+	tokenHash := HashToken(token)
+	record := memoryRecord{
+		token: *jwt,
+		mapped: MappedToken{
+			Jwt:          jwt.JWT,
+			TokenHash:    tokenHash,
+			Subject:      lifetime.subject,
+			IssuedAt:     lifetime.issuedAt,
+			ExpiresAt:    lifetime.expiresAt,
+			Applications: jwt.AllowedApplications,
+			Scopes:       jwt.Scopes,
+		},
+	}
+
+	s.tokens.Set(tokenHash, &record, ttl)
+
+	return lifetime.expiresAt, nil
+}
+
+func (s *MemoryTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	return addToken(s, jwt)
+}
+
+func (s *MemoryTokenStore) GetToken(token string) (*JWTResponse, error) {
+	record, ok := s.tokens.Get(HashToken(token))
+	if !ok {
+		return nil, NoTokenError
+	}
+
+	jwt := record.(*memoryRecord).token
+	return &jwt, nil
+}
+
+func (s *MemoryTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	tokens := s.sortedTokens()
+	c := make(chan MappedToken)
+
+	go func() {
+		for _, token := range tokens {
+			c <- token
+		}
+		close(c)
+	}()
+
+	return c, nil
+}
+
+// ListTokens uses the last token hash of a page as cursor for the next page,
+// since tokens are listed in lexical order of their hashes.
+func (s *MemoryTokenStore) ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error) {
+	if err := checkListLimit(limit); err != nil {
+		return nil, "", err
+	}
+
+	tokens := s.sortedTokens()
+
+	start := sort.Search(len(tokens), func(i int) bool {
+		return tokens[i].TokenHash > cursor
+	})
+
+	page := make([]MappedToken, 0, limit)
+	for _, token := range tokens[start:] {
+		if !filter.Matches(&token) {
+			continue
+		}
+
+		page = append(page, token)
+		if len(page) == limit {
+			return page, token.TokenHash, nil
+		}
+	}
+
+	return page, "", nil
+}
+
+func (s *MemoryTokenStore) sortedTokens() []MappedToken {
+	items := s.tokens.Items()
+	tokens := make([]MappedToken, 0, len(items))
+
+	for _, item := range items {
+		tokens = append(tokens, item.Object.(*memoryRecord).mapped)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].TokenHash < tokens[j].TokenHash
+	})
+
+	return tokens
+}
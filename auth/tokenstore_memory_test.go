@@ -0,0 +1,24 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/auth/tokenstoretest"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	tokenstoretest.Run(t, func(t *testing.T, v *auth.JwtVerifier) auth.TokenStore {
+		return auth.NewMemoryTokenStore(v, tokenstoretest.RefreshTtl)
+	})
+}
+
+func TestMemoryTokenStoreRejectsEncryption(t *testing.T) {
+	cfg := config.TokenStoreConfiguration{Type: "memory", Encryption: testEncryption}
+
+	if _, err := auth.NewTokenStore(&cfg, nil, nil, logging.MustGetLogger("test"), auth.TokenStoreOptions{}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsTokenStore records the duration of each operation of the wrapped
+// token store.
+type metricsTokenStore struct {
+	wrapped   TokenStore
+	durations *prometheus.HistogramVec
+}
+
+func instrumentTokenStore(store TokenStore, metrics *monitoring.PromMetrics) TokenStore {
+	if metrics == nil {
+		return store
+	}
+
+	return &metricsTokenStore{wrapped: store, durations: metrics.TokenStoreDurations}
+}
+
+func (s *metricsTokenStore) observe(operation string, started time.Time, err error) {
+	result := "ok"
+	if err == NoTokenError {
+		result = "miss"
+	} else if err != nil {
+		result = "error"
+	}
+
+	s.durations.With(prometheus.Labels{"operation": operation, "result": result}).Observe(time.Since(started).Seconds())
+}
+
+func (s *metricsTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	started := time.Now()
+	token, exp, err := s.wrapped.AddToken(jwt)
+	s.observe("add", started, err)
+	return token, exp, err
+}
+
+func (s *metricsTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	started := time.Now()
+	exp, err := s.wrapped.SetToken(token, jwt)
+	s.observe("set", started, err)
+	return exp, err
+}
+
+func (s *metricsTokenStore) GetToken(token string) (*JWTResponse, error) {
+	started := time.Now()
+	jwt, err := s.wrapped.GetToken(token)
+	s.observe("get", started, err)
+	return jwt, err
+}
+
+func (s *metricsTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	started := time.Now()
+	tokens, err := s.wrapped.GetAllTokens()
+	s.observe("get_all", started, err)
+	return tokens, err
+}
+
+func (s *metricsTokenStore) ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error) {
+	started := time.Now()
+	tokens, next, err := s.wrapped.ListTokens(filter, cursor, limit)
+	s.observe("list", started, err)
+	return tokens, next, err
+}
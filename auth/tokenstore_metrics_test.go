@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTokenStoreMetrics(t *testing.T) {
+	verifier, _ := NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "durations"}, []string{"operation", "result"})
+	store := instrumentTokenStore(NewMemoryTokenStore(verifier, time.Hour), &monitoring.PromMetrics{TokenStoreDurations: durations})
+
+	if _, err := store.GetToken("unknown"); err != NoTokenError {
+		t.Fatalf("expected unknown token, got %v", err)
+	}
+	if _, _, err := store.ListTokens(TokenFilter{}, "", -1); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	cases := []struct {
+		operation string
+		result    string
+		expected  uint64
+	}{
+		{"get", "miss", 1},
+		{"get", "error", 0},
+		{"list", "error", 1},
+	}
+
+	for _, c := range cases {
+		var m dto.Metric
+		_ = durations.WithLabelValues(c.operation, c.result).(prometheus.Histogram).Write(&m)
+
+		if count := m.GetHistogram().GetSampleCount(); count != c.expected {
+			t.Errorf("expected %d %s operations with result %s, got %d", c.expected, c.operation, c.result, count)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisTokenStore stores each token in a hash "token_<hash>", using the
+// SHA-256 hash of the opaque token. Tokens stored by earlier versions under
+// "token_<token>" are migrated when they are first read.
+type RedisTokenStore struct {
+	redisPool  *redis.Pool
+	verifier   *JwtVerifier
+	encrypter  *TokenEncrypter
+	refreshTtl time.Duration
+}
+
+func (s *RedisTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	lifetime, err := tokenLifetimeOf(s.verifier, jwt, s.refreshTtl)
+	if err != nil {
+		return 0, err
+	}
+
+	tokenHash := HashToken(token)
+	key := "token_" + tokenHash
+
+	encryptedJWT, err := s.encrypter.Encrypt(jwt.JWT, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+
+	encryptedRefreshToken := ""
+	if jwt.RefreshToken != "" {
+		encryptedRefreshToken, err = s.encrypter.Encrypt(jwt.RefreshToken, tokenHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do(
+		"HMSET", key,
+		"jwt", encryptedJWT,
+		"applications", strings.Join(jwt.AllowedApplications, ";"),
+		"scopes", strings.Join(jwt.Scopes, ";"),
+		"refresh_token", encryptedRefreshToken,
+		"sub", lifetime.subject,
+		"iat", lifetime.issuedAt,
+		"exp", lifetime.expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.expireAt(conn, key, lifetime.expiresAt); err != nil {
+		return 0, err
+	}
+
+	if lifetime.subject != "" {
+		if err := s.addToSubjectIndex(conn, lifetime.subject, tokenHash, lifetime.expiresAt); err != nil {
+			return 0, err
+		}
+	}
+
+	return lifetime.expiresAt, nil
+}
+
+func (s *RedisTokenStore) expireAt(conn redis.Conn, key string, expiresAt int64) error {
+	if expiresAt > 0 {
+		_, err := conn.Do("EXPIREAT", key, expiresAt)
+		return err
+	}
+
+	_, err := conn.Do("PERSIST", key)
+	return err
+}
+
+// addToSubjectIndex adds a token to the set of tokens of its subject. The set
+// lives as long as the longest-living token in it; tokens that expired before
+// that are pruned when the set is read.
+func (s *RedisTokenStore) addToSubjectIndex(conn redis.Conn, subject string, tokenHash string, expiresAt int64) error {
+	key := "subject_tokens_" + subject
+
+	ttl, err := redis.Int64(conn.Do("TTL", key))
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("SADD", key, tokenHash); err != nil {
+		return err
+	}
+
+	if expiresAt == 0 {
+		_, err = conn.Do("PERSIST", key)
+		return err
+	}
+
+	// TTL is -2 for keys that did not exist and -1 for keys without expiry
+	if ttl == -2 || (ttl >= 0 && time.Now().Unix()+ttl < expiresAt) {
+		_, err = conn.Do("EXPIREAT", key, expiresAt)
+	}
+
+	return err
+}
+
+func (s *RedisTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	return addToken(s, jwt)
+}
+
+func (s *RedisTokenStore) GetToken(token string) (*JWTResponse, error) {
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	tokenHash := HashToken(token)
+	key := "token_" + tokenHash
+	response := JWTResponse{}
+
+	results, err := redis.Strings(conn.Do("HMGET", key, "jwt", "applications", "refresh_token", "scopes"))
+	if err == redis.ErrNil {
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	if results[0] == "" {
+		migrated, err := s.migrateLegacyToken(conn, "token_"+token, token)
+		if err != nil {
+			return nil, err
+		}
+
+		if !migrated {
+			return nil, NoTokenError
+		}
+
+		return s.GetToken(token)
+	}
+
+	response.JWT, err = s.encrypter.Decrypt(results[0], tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if results[1] != "" {
+		response.AllowedApplications = strings.Split(results[1], ";")
+	}
+
+	response.RefreshToken, err = s.encrypter.Decrypt(results[2], tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if results[3] != "" {
+		response.Scopes = strings.Split(results[3], ";")
+	}
+
+	return &response, nil
+}
+
+// migrateLegacyToken moves a token that is stored under its plain text key to
+// the key derived from the token hash, and removes the plain text token from
+// the stored hash and the subject index.
+func (s *RedisTokenStore) migrateLegacyToken(conn redis.Conn, legacyKey string, token string) (bool, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", legacyKey))
+	if err != nil {
+		return false, err
+	}
+
+	if values["jwt"] == "" {
+		return false, nil
+	}
+
+	tokenHash := HashToken(token)
+
+	if _, err := conn.Do("RENAME", legacyKey, "token_"+tokenHash); err != nil {
+		return false, err
+	}
+
+	if _, err := conn.Do("HDEL", "token_"+tokenHash, "token"); err != nil {
+		return false, err
+	}
+
+	if sub := values["sub"]; sub != "" {
+		if _, err := conn.Do("SREM", "subject_tokens_"+sub, token); err != nil {
+			return false, err
+		}
+
+		exp, _ := strconv.ParseInt(values["exp"], 10, 64)
+		if err := s.addToSubjectIndex(conn, sub, tokenHash, exp); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (s *RedisTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	conn := s.redisPool.Get()
+
+	cursor, keys, err := s.scan(conn, "0", 100)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := make(chan MappedToken)
+
+	go func() {
+		defer close(c)
+		defer conn.Close()
+
+		for {
+			for _, key := range keys {
+				if token, ok := s.loadMappedToken(conn, key); ok {
+					c <- token
+				}
+			}
+
+			if cursor == "0" {
+				return
+			}
+
+			cursor, keys, err = s.scan(conn, cursor, 100)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// ListTokens returns the tokens of one SCAN batch per page. Since SCAN may
+// return more keys than requested, the tokens of a batch are ordered by hash
+// and split into several pages if necessary; the cursor then consists of the
+// SCAN cursor of the batch and the hash of the last listed token.
+func (s *RedisTokenStore) ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error) {
+	if err := checkListLimit(limit); err != nil {
+		return nil, "", err
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	scanCursor, after := cursor, ""
+	if i := strings.IndexByte(cursor, ':'); i >= 0 {
+		scanCursor, after = cursor[:i], cursor[i+1:]
+	}
+
+	if scanCursor == "" {
+		scanCursor = "0"
+	}
+
+	var next string
+	var keys []string
+	var err error
+
+	if filter.Subject != "" {
+		next, keys, err = s.scanSubject(conn, filter.Subject, scanCursor, limit)
+	} else {
+		next, keys, err = s.scan(conn, scanCursor, limit)
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	tokens := make([]MappedToken, 0, len(keys))
+	for _, key := range keys {
+		token, ok := s.loadMappedToken(conn, key)
+		if !ok {
+			continue
+		}
+
+		if filter.Subject != "" && token.Subject != filter.Subject {
+			_, _ = conn.Do("SREM", "subject_tokens_"+filter.Subject, token.TokenHash)
+			continue
+		}
+
+		if token.TokenHash > after && filter.Matches(&token) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].TokenHash < tokens[j].TokenHash
+	})
+
+	if limit > 0 && len(tokens) > limit {
+		tokens = tokens[:limit]
+		return tokens, scanCursor + ":" + tokens[limit-1].TokenHash, nil
+	}
+
+	if next == "0" {
+		next = ""
+	}
+
+	return tokens, next, nil
+}
+
+func (s *RedisTokenStore) scan(conn redis.Conn, cursor string, count int) (string, []string, error) {
+	values, err := redis.Values(conn.Do("SCAN", scanArgs(count, cursor, "MATCH", "token_*")...))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return parseScanReply(values)
+}
+
+// scanSubject iterates over the subject index and prunes tokens that have
+// expired in the meantime.
+func (s *RedisTokenStore) scanSubject(conn redis.Conn, subject string, cursor string, count int) (string, []string, error) {
+	values, err := redis.Values(conn.Do("SSCAN", scanArgs(count, "subject_tokens_"+subject, cursor)...))
+	if err != nil {
+		return "", nil, err
+	}
+
+	cursor, members, err := parseScanReply(values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		exists, err := redis.Bool(conn.Do("EXISTS", "token_"+member))
+		if err != nil {
+			return "", nil, err
+		}
+
+		if !exists {
+			_, _ = conn.Do("SREM", "subject_tokens_"+subject, member)
+			continue
+		}
+
+		keys = append(keys, "token_"+member)
+	}
+
+	return cursor, keys, nil
+}
+
+// scanArgs appends the COUNT hint to the arguments of a SCAN command. Redis
+// rejects a count of 0, so its default is used for unlimited pages.
+func scanArgs(count int, args ...interface{}) []interface{} {
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	return args
+}
+
+func parseScanReply(values []interface{}) (string, []string, error) {
+	if len(values) != 2 {
+		return "", nil, fmt.Errorf("unexpected SCAN reply with %d elements", len(values))
+	}
+
+	cursor, err := redis.String(values[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cursor, keys, nil
+}
+
+func (s *RedisTokenStore) loadMappedToken(conn redis.Conn, key string) (MappedToken, bool) {
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil || values["jwt"] == "" {
+		return MappedToken{}, false
+	}
+
+	tokenHash := strings.TrimPrefix(key, "token_")
+
+	if legacyToken := values["token"]; legacyToken != "" {
+		if migrated, err := s.migrateLegacyToken(conn, key, legacyToken); err != nil || !migrated {
+			return MappedToken{}, false
+		}
+		tokenHash = HashToken(legacyToken)
+	}
+
+	jwt, err := s.encrypter.Decrypt(values["jwt"], tokenHash)
+	if err != nil {
+		return MappedToken{}, false
+	}
+
+	token := MappedToken{
+		Jwt:       jwt,
+		TokenHash: tokenHash,
+		Subject:   values["sub"],
+	}
+
+	token.IssuedAt, _ = strconv.ParseInt(values["iat"], 10, 64)
+	token.ExpiresAt, _ = strconv.ParseInt(values["exp"], 10, 64)
+
+	if values["applications"] != "" {
+		token.Applications = strings.Split(values["applications"], ";")
+	}
+
+	if values["scopes"] != "" {
+		token.Scopes = strings.Split(values["scopes"], ";")
+	}
+
+	return token, true
+}
+
+// ReencryptTokens encrypts all stored JWTs and refresh tokens with the active
+// encryption key. This also encrypts tokens that were stored before encryption
+// was enabled. Tokens that are modified concurrently are skipped.
+func (s *RedisTokenStore) ReencryptTokens() (int, error) {
+	if s.encrypter == nil {
+		return 0, nil
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	count := 0
+	cursor := "0"
+
+	for {
+		var keys []string
+		var err error
+
+		cursor, keys, err = s.scan(conn, cursor, 100)
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			updated, err := s.reencryptToken(conn, key)
+			if err != nil {
+				return count, fmt.Errorf("error while re-encrypting %s: %s", key, err)
+			}
+
+			if updated {
+				count++
+			}
+		}
+
+		if cursor == "0" {
+			return count, nil
+		}
+	}
+}
+
+func (s *RedisTokenStore) reencryptToken(conn redis.Conn, key string) (bool, error) {
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return false, err
+	}
+
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		_, _ = conn.Do("UNWATCH")
+		return false, err
+	}
+
+	if legacyToken := values["token"]; legacyToken != "" {
+		_, _ = conn.Do("UNWATCH")
+		if _, err := s.migrateLegacyToken(conn, key, legacyToken); err != nil {
+			return false, err
+		}
+		return s.reencryptToken(conn, "token_"+HashToken(legacyToken))
+	}
+
+	tokenHash := strings.TrimPrefix(key, "token_")
+	args := []interface{}{key}
+
+	for _, field := range []string{"jwt", "refresh_token"} {
+		if values[field] == "" {
+			continue
+		}
+
+		reencrypted, changed, err := s.encrypter.Reencrypt(values[field], tokenHash)
+		if err != nil {
+			_, _ = conn.Do("UNWATCH")
+			return false, err
+		}
+
+		if changed {
+			args = append(args, field, reencrypted)
+		}
+	}
+
+	if len(args) == 1 {
+		_, err := conn.Do("UNWATCH")
+		return false, err
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+
+	if err := conn.Send("HMSET", args...); err != nil {
+		return false, err
+	}
+
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+
+	// EXEC returns nil when the token was modified in the meantime
+	return reply != nil, nil
+}
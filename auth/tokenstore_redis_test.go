@@ -0,0 +1,46 @@
+package auth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/auth/tokenstoretest"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+func TestRedisTokenStore(t *testing.T) {
+	for name, enc := range map[string]config.TokenEncryptionConfiguration{"plain": {}, "encrypted": testEncryption} {
+		t.Run(name, func(t *testing.T) {
+			tokenstoretest.Run(t, func(t *testing.T, v *auth.JwtVerifier) auth.TokenStore {
+				m := miniredis.RunT(t)
+				addr := m.Addr()
+				pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }}
+
+				store, err := auth.NewTokenStore(
+					&config.TokenStoreConfiguration{Encryption: enc},
+					pool, v, logging.MustGetLogger("test"),
+					auth.TokenStoreOptions{RefreshTtl: tokenstoretest.RefreshTtl},
+				)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				if enc.Keys != nil {
+					t.Cleanup(func() {
+						for _, key := range m.Keys() {
+							if strings.HasPrefix(key, "token_") && !strings.HasPrefix(m.HGet(key, "jwt"), "enc:v1:k1:") {
+								t.Errorf("JWT of %s is not encrypted", key)
+							}
+						}
+					})
+				}
+
+				return store
+			})
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// SQLTokenStore stores tokens in a relational database using database/sql.
+// SQLite (driver "sqlite") and PostgreSQL (driver "postgres") are supported;
+// the respective driver must be registered by the main package. Expired
+// tokens are purged periodically. Tokens are stored by their hash.
+type SQLTokenStore struct {
+	db         *sql.DB
+	driver     string
+	verifier   *JwtVerifier
+	encrypter  *TokenEncrypter
+	refreshTtl time.Duration
+	logger     *logging.Logger
+}
+
+type sqlMigration func(tx *sql.Tx, s *SQLTokenStore) error
+
+// sqlMigrations must only ever be appended to; the index of each migration
+// (plus one) is its schema version.
+var sqlMigrations = []sqlMigration{
+	func(tx *sql.Tx, s *SQLTokenStore) error {
+		return s.execAll(
+			tx,
+			`CREATE TABLE servicegateway_tokens (
+				token_hash VARCHAR(128) NOT NULL PRIMARY KEY,
+				jwt TEXT NOT NULL,
+				refresh_token TEXT NOT NULL DEFAULT '',
+				applications TEXT NOT NULL DEFAULT '',
+				subject VARCHAR(255) NOT NULL DEFAULT '',
+				issued_at BIGINT NOT NULL DEFAULT 0,
+				expires_at BIGINT NOT NULL DEFAULT 0,
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX servicegateway_tokens_subject ON servicegateway_tokens (subject)`,
+			`CREATE INDEX servicegateway_tokens_expires_at ON servicegateway_tokens (expires_at)`,
+		)
+	},
+	func(tx *sql.Tx, s *SQLTokenStore) error {
+		return s.execAll(tx, `ALTER TABLE servicegateway_tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`)
+	},
+}
+
+func NewSQLTokenStore(driver string, dsn string, verifier *JwtVerifier, encrypter *TokenEncrypter, refreshTtl time.Duration, logger *logging.Logger) (*SQLTokenStore, error) {
+	switch driver {
+	case "sqlite", "postgres":
+	default:
+		return nil, fmt.Errorf("unsupported SQL driver: '%s'", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite" {
+		// SQLite does not cope well with concurrent writers
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLTokenStore{
+		db:         db,
+		driver:     driver,
+		verifier:   verifier,
+		encrypter:  encrypter,
+		refreshTtl: refreshTtl,
+		logger:     logger,
+	}
+
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error while migrating token database: %s", err)
+	}
+
+	go s.purgeExpiredTokens(10 * time.Minute)
+
+	return s, nil
+}
+
+func (s *SQLTokenStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS servicegateway_schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM servicegateway_schema_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		s.logger.Infof("migrating token database to schema version %d", version+1)
+
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := sqlMigrations[version](tx, s); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("schema version %d: %s", version+1, err)
+		}
+
+		if _, err := tx.Exec(s.rebind(`INSERT INTO servicegateway_schema_version (version) VALUES (?)`), version+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLTokenStore) execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind converts "?" placeholders into the "$n" placeholders that PostgreSQL
+// expects.
+func (s *SQLTokenStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+func (s *SQLTokenStore) purgeExpiredTokens(interval time.Duration) {
+	for range time.Tick(interval) {
+		res, err := s.db.Exec(s.rebind(`DELETE FROM servicegateway_tokens WHERE expires_at <> 0 AND expires_at <= ?`), time.Now().Unix())
+		if err != nil {
+			s.logger.Errorf("error while purging expired tokens: %s", err)
+			continue
+		}
+
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			s.logger.Debugf("purged %d expired tokens", n)
+		}
+	}
+}
+
+func (s *SQLTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	lifetime, err := tokenLifetimeOf(s.verifier, jwt, s.refreshTtl)
+	if err != nil {
+		return 0, err
+	}
+
+	tokenHash := HashToken(token)
+
+	encryptedJWT, err := s.encrypter.Encrypt(jwt.JWT, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+
+	encryptedRefreshToken := ""
+	if jwt.RefreshToken != "" {
+		encryptedRefreshToken, err = s.encrypter.Encrypt(jwt.RefreshToken, tokenHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now().Unix()
+
+	_, err = s.db.Exec(
+		s.rebind(`INSERT INTO servicegateway_tokens
+			(token_hash, jwt, refresh_token, applications, scopes, subject, issued_at, expires_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (token_hash) DO UPDATE SET
+				jwt = excluded.jwt,
+				refresh_token = excluded.refresh_token,
+				applications = excluded.applications,
+				scopes = excluded.scopes,
+				subject = excluded.subject,
+				issued_at = excluded.issued_at,
+				expires_at = excluded.expires_at,
+				updated_at = excluded.updated_at`),
+		tokenHash,
+		encryptedJWT,
+		encryptedRefreshToken,
+		strings.Join(jwt.AllowedApplications, ";"),
+		strings.Join(jwt.Scopes, ";"),
+		lifetime.subject,
+		lifetime.issuedAt,
+		lifetime.expiresAt,
+		now,
+		now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return lifetime.expiresAt, nil
+}
+
+func (s *SQLTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	return addToken(s, jwt)
+}
+
+func (s *SQLTokenStore) GetToken(token string) (*JWTResponse, error) {
+	var jwt, applications, scopes, refreshToken string
+	response := JWTResponse{}
+	tokenHash := HashToken(token)
+
+	err := s.db.QueryRow(
+		s.rebind(`SELECT jwt, applications, scopes, refresh_token FROM servicegateway_tokens WHERE token_hash = ? AND (expires_at = 0 OR expires_at > ?)`),
+		tokenHash,
+		time.Now().Unix(),
+	).Scan(&jwt, &applications, &scopes, &refreshToken)
+
+	if err == sql.ErrNoRows {
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	response.JWT, err = s.encrypter.Decrypt(jwt, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	response.RefreshToken, err = s.encrypter.Decrypt(refreshToken, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if applications != "" {
+		response.AllowedApplications = strings.Split(applications, ";")
+	}
+
+	if scopes != "" {
+		response.Scopes = strings.Split(scopes, ";")
+	}
+
+	return &response, nil
+}
+
+func (s *SQLTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	rows, err := s.queryTokens(TokenFilter{}, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan MappedToken)
+
+	go func() {
+		defer close(c)
+		defer rows.Close()
+
+		for rows.Next() {
+			token, err := s.scanMappedToken(rows)
+			if err != nil {
+				s.logger.Errorf("error while reading token: %s", err)
+				return
+			}
+			c <- token
+		}
+	}()
+
+	return c, nil
+}
+
+// ListTokens uses the last token hash of a page as cursor for the next page,
+// since tokens are listed in lexical order of their hashes.
+func (s *SQLTokenStore) ListTokens(filter TokenFilter, cursor string, limit int) ([]MappedToken, string, error) {
+	if err := checkListLimit(limit); err != nil {
+		return nil, "", err
+	}
+
+	rows, err := s.queryTokens(filter, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	tokens := make([]MappedToken, 0, limit)
+	for rows.Next() {
+		token, err := s.scanMappedToken(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if limit > 0 && len(tokens) == limit {
+		next = tokens[len(tokens)-1].TokenHash
+	}
+
+	return tokens, next, nil
+}
+
+func (s *SQLTokenStore) queryTokens(filter TokenFilter, cursor string, limit int) (*sql.Rows, error) {
+	conditions := []string{"token_hash > ?", "(expires_at = 0 OR expires_at > ?)"}
+	args := []interface{}{cursor, time.Now().Unix()}
+
+	if filter.Subject != "" {
+		conditions = append(conditions, "subject = ?")
+		args = append(args, filter.Subject)
+	}
+
+	if filter.Application != "" {
+		conditions = append(conditions, `(applications = '' OR (';' || applications || ';') LIKE ? ESCAPE '\')`)
+		args = append(args, "%;"+likeEscaper.Replace(filter.Application)+";%")
+	}
+
+	if filter.ExpiresBefore != 0 {
+		conditions = append(conditions, "expires_at <> 0 AND expires_at < ?")
+		args = append(args, filter.ExpiresBefore)
+	}
+
+	if filter.ExpiresAfter != 0 {
+		conditions = append(conditions, "(expires_at = 0 OR expires_at > ?)")
+		args = append(args, filter.ExpiresAfter)
+	}
+
+	query := `SELECT token_hash, jwt, subject, issued_at, expires_at, applications, scopes FROM servicegateway_tokens
+		WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY token_hash`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return s.db.Query(s.rebind(query), args...)
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *SQLTokenStore) scanMappedToken(rows *sql.Rows) (MappedToken, error) {
+	var applications, scopes string
+	token := MappedToken{}
+
+	err := rows.Scan(&token.TokenHash, &token.Jwt, &token.Subject, &token.IssuedAt, &token.ExpiresAt, &applications, &scopes)
+	if err != nil {
+		return token, err
+	}
+
+	token.Jwt, err = s.encrypter.Decrypt(token.Jwt, token.TokenHash)
+	if err != nil {
+		return token, err
+	}
+
+	if applications != "" {
+		token.Applications = strings.Split(applications, ";")
+	}
+
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ";")
+	}
+
+	return token, nil
+}
+
+// ReencryptTokens encrypts all stored JWTs and refresh tokens with the active
+// encryption key. Rows are only updated if they did not change in the
+// meantime; concurrently modified tokens are skipped.
+func (s *SQLTokenStore) ReencryptTokens() (int, error) {
+	if s.encrypter == nil {
+		return 0, nil
+	}
+
+	count := 0
+	cursor := ""
+
+	for {
+		type row struct {
+			tokenHash, jwt, refreshToken string
+		}
+
+		rows, err := s.db.Query(
+			s.rebind(`SELECT token_hash, jwt, refresh_token FROM servicegateway_tokens WHERE token_hash > ? ORDER BY token_hash LIMIT 100`),
+			cursor,
+		)
+		if err != nil {
+			return count, err
+		}
+
+		var batch []row
+		for rows.Next() {
+			r := row{}
+			if err := rows.Scan(&r.tokenHash, &r.jwt, &r.refreshToken); err != nil {
+				_ = rows.Close()
+				return count, err
+			}
+			batch = append(batch, r)
+		}
+
+		if err := rows.Close(); err != nil {
+			return count, err
+		}
+
+		if len(batch) == 0 {
+			return count, nil
+		}
+
+		for _, r := range batch {
+			jwt, jwtChanged, err := s.encrypter.Reencrypt(r.jwt, r.tokenHash)
+			if err != nil {
+				return count, fmt.Errorf("error while re-encrypting %s: %s", r.tokenHash, err)
+			}
+
+			refreshToken, refreshTokenChanged := r.refreshToken, false
+			if r.refreshToken != "" {
+				refreshToken, refreshTokenChanged, err = s.encrypter.Reencrypt(r.refreshToken, r.tokenHash)
+				if err != nil {
+					return count, fmt.Errorf("error while re-encrypting %s: %s", r.tokenHash, err)
+				}
+			}
+
+			if !jwtChanged && !refreshTokenChanged {
+				continue
+			}
+
+			res, err := s.db.Exec(
+				s.rebind(`UPDATE servicegateway_tokens SET jwt = ?, refresh_token = ? WHERE token_hash = ? AND jwt = ? AND refresh_token = ?`),
+				jwt,
+				refreshToken,
+				r.tokenHash,
+				r.jwt,
+				r.refreshToken,
+			)
+			if err != nil {
+				return count, err
+			}
+
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				count++
+			}
+		}
+
+		cursor = batch[len(batch)-1].tokenHash
+	}
+}
@@ -0,0 +1,67 @@
+package auth_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/auth/tokenstoretest"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	_ "modernc.org/sqlite"
+)
+
+var testEncryption = config.TokenEncryptionConfiguration{
+	Keys: map[string]string{"k1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+}
+
+func TestSQLTokenStore(t *testing.T) {
+	for name, enc := range map[string]*config.TokenEncryptionConfiguration{"plain": nil, "encrypted": &testEncryption} {
+		t.Run(name, func(t *testing.T) {
+			tokenstoretest.Run(t, func(t *testing.T, v *auth.JwtVerifier) auth.TokenStore {
+				var encrypter *auth.TokenEncrypter
+				if enc != nil {
+					var err error
+					if encrypter, err = auth.NewTokenEncrypter(enc); err != nil {
+						t.Fatalf("unexpected error: %s", err)
+					}
+				}
+
+				dsn := filepath.Join(t.TempDir(), "tokens.db")
+				store, err := auth.NewSQLTokenStore("sqlite", dsn, v, encrypter, tokenstoretest.RefreshTtl, logging.MustGetLogger("test"))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				if enc != nil {
+					t.Cleanup(func() {
+						db, err := sql.Open("sqlite", dsn)
+						if err != nil {
+							t.Fatalf("unexpected error: %s", err)
+						}
+						defer db.Close()
+
+						rows, err := db.Query(`SELECT token_hash, jwt FROM servicegateway_tokens`)
+						if err != nil {
+							t.Fatalf("unexpected error: %s", err)
+						}
+						defer rows.Close()
+
+						for rows.Next() {
+							var tokenHash, jwt string
+							if err := rows.Scan(&tokenHash, &jwt); err != nil {
+								t.Fatalf("unexpected error: %s", err)
+							}
+							if !strings.HasPrefix(jwt, "enc:v1:k1:") {
+								t.Errorf("JWT of %s is not encrypted", tokenHash)
+							}
+						}
+					})
+				}
+				return store
+			})
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReencryptLockIsHeldForOneInterval(t *testing.T) {
+	pool := newTestRedisPool(t)
+
+	if locked, err := acquireReencryptLock(pool, time.Hour); err != nil || !locked {
+		t.Fatalf("expected first instance to acquire the lock, got %t (%v)", locked, err)
+	}
+
+	if locked, err := acquireReencryptLock(pool, time.Hour); err != nil || locked {
+		t.Fatalf("expected second instance to skip the run, got %t (%v)", locked, err)
+	}
+
+	if locked, _ := acquireReencryptLock(nil, time.Hour); !locked {
+		t.Error("expected re-encryption without Redis to run unconditionally")
+	}
+}
@@ -0,0 +1,383 @@
+// Package tokenstoretest contains a conformance test suite that every
+// implementation of auth.TokenStore must pass. Call Run from a test of the
+// respective implementation:
+//
+//	func TestMemoryTokenStore(t *testing.T) {
+//		tokenstoretest.Run(t, func(t *testing.T, v *auth.JwtVerifier) auth.TokenStore {
+//			return auth.NewMemoryTokenStore(v, time.Hour)
+//		})
+//	}
+package tokenstoretest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// Factory creates a new, empty token store. The store must verify JWTs using
+// the given verifier and keep tokens with a refresh token for RefreshTtl
+// after their JWT expired.
+type Factory func(t *testing.T, verifier *auth.JwtVerifier) auth.TokenStore
+
+// RefreshTtl is the refresh TTL that stores created by a Factory must use.
+const RefreshTtl = time.Hour
+
+type suite struct {
+	key      *rsa.PrivateKey
+	verifier *auth.JwtVerifier
+	factory  Factory
+}
+
+func Run(t *testing.T, factory Factory) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("could not marshal public key: %s", err)
+	}
+
+	verifier, err := auth.NewJwtVerifier(&config.GlobalAuth{
+		VerificationKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}),
+		KeyCacheTtl:     "5m",
+	})
+	if err != nil {
+		t.Fatalf("could not create verifier: %s", err)
+	}
+
+	s := &suite{key: key, verifier: verifier, factory: factory}
+
+	t.Run("AddAndGetToken", s.testAddAndGetToken)
+	t.Run("GetUnknownToken", s.testGetUnknownToken)
+	t.Run("SetTokenReplacesJWT", s.testSetTokenReplacesJWT)
+	t.Run("RejectsInvalidJWT", s.testRejectsInvalidJWT)
+	t.Run("Expiry", s.testExpiry)
+	t.Run("RefreshTokenExtendsExpiry", s.testRefreshTokenExtendsExpiry)
+	t.Run("GetAllTokens", s.testGetAllTokens)
+	t.Run("ListTokensPagination", s.testListTokensPagination)
+	t.Run("ListTokensFilter", s.testListTokensFilter)
+	t.Run("ListTokensLimits", s.testListTokensLimits)
+}
+
+func (s *suite) sign(t *testing.T, claims jwt.MapClaims) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(s.key)
+	if err != nil {
+		t.Fatalf("could not sign JWT: %s", err)
+	}
+	return signed
+}
+
+func (s *suite) testAddAndGetToken(t *testing.T) {
+	store := s.factory(t, s.verifier)
+	jwtString := s.sign(t, jwt.MapClaims{"sub": "user-1"})
+
+	token, _, err := store.AddToken(&auth.JWTResponse{
+		JWT:                 jwtString,
+		AllowedApplications: []string{"app-a", "app-b"},
+		Scopes:              []string{"app-a:read:/items/**", "app-b"},
+		RefreshToken:        "refresh",
+	})
+	if err != nil {
+		t.Fatalf("AddToken failed: %s", err)
+	}
+
+	if token == "" {
+		t.Fatal("AddToken returned empty token")
+	}
+
+	response, err := store.GetToken(token)
+	if err != nil {
+		t.Fatalf("GetToken failed: %s", err)
+	}
+
+	if response.JWT != jwtString {
+		t.Errorf("expected JWT %q, got %q", jwtString, response.JWT)
+	}
+
+	if len(response.AllowedApplications) != 2 || response.AllowedApplications[0] != "app-a" || response.AllowedApplications[1] != "app-b" {
+		t.Errorf("unexpected allowed applications: %v", response.AllowedApplications)
+	}
+
+	if len(response.Scopes) != 2 || response.Scopes[0] != "app-a:read:/items/**" || response.Scopes[1] != "app-b" {
+		t.Errorf("unexpected scopes: %v", response.Scopes)
+	}
+
+	if response.RefreshToken != "refresh" {
+		t.Errorf("expected refresh token %q, got %q", "refresh", response.RefreshToken)
+	}
+}
+
+func (s *suite) testGetUnknownToken(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	_, err := store.GetToken("UNKNOWN")
+	if err != auth.NoTokenError {
+		t.Errorf("expected NoTokenError, got %v", err)
+	}
+}
+
+func (s *suite) testSetTokenReplacesJWT(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	token, _, err := store.AddToken(&auth.JWTResponse{JWT: s.sign(t, jwt.MapClaims{"sub": "user-1"}), Scopes: []string{"app-a"}, RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatalf("AddToken failed: %s", err)
+	}
+
+	replacement := s.sign(t, jwt.MapClaims{"sub": "user-1", "v": 2})
+	if _, err := store.SetToken(token, &auth.JWTResponse{JWT: replacement}); err != nil {
+		t.Fatalf("SetToken failed: %s", err)
+	}
+
+	response, err := store.GetToken(token)
+	if err != nil {
+		t.Fatalf("GetToken failed: %s", err)
+	}
+
+	if response.JWT != replacement {
+		t.Errorf("expected replaced JWT %q, got %q", replacement, response.JWT)
+	}
+
+	if response.RefreshToken != "" || len(response.AllowedApplications) != 0 || len(response.Scopes) != 0 {
+		t.Errorf("expected SetToken to replace all properties, got %+v", response)
+	}
+}
+
+func (s *suite) testRejectsInvalidJWT(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	if _, _, err := store.AddToken(&auth.JWTResponse{JWT: "not-a-jwt"}); err == nil {
+		t.Error("expected AddToken to reject invalid JWT")
+	}
+
+	expired := s.sign(t, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+	if _, _, err := store.AddToken(&auth.JWTResponse{JWT: expired}); err == nil {
+		t.Error("expected AddToken to reject expired JWT")
+	}
+}
+
+func (s *suite) testExpiry(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	_, actual, err := store.AddToken(&auth.JWTResponse{JWT: s.sign(t, jwt.MapClaims{"exp": exp})})
+	if err != nil {
+		t.Fatalf("AddToken failed: %s", err)
+	}
+
+	if actual != exp {
+		t.Errorf("expected expiry %d, got %d", exp, actual)
+	}
+
+	_, actual, err = store.AddToken(&auth.JWTResponse{JWT: s.sign(t, jwt.MapClaims{"sub": "forever"})})
+	if err != nil {
+		t.Fatalf("AddToken failed: %s", err)
+	}
+
+	if actual != 0 {
+		t.Errorf("expected no expiry for JWT without exp claim, got %d", actual)
+	}
+}
+
+func (s *suite) testRefreshTokenExtendsExpiry(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	_, actual, err := store.AddToken(&auth.JWTResponse{JWT: s.sign(t, jwt.MapClaims{"exp": exp}), RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatalf("AddToken failed: %s", err)
+	}
+
+	if expected := exp + int64(RefreshTtl.Seconds()); actual != expected {
+		t.Errorf("expected expiry %d, got %d", expected, actual)
+	}
+}
+
+// addTokens returns the hashes of the added tokens.
+func (s *suite) addTokens(t *testing.T, store auth.TokenStore, n int, claims jwt.MapClaims, apps []string) map[string]bool {
+	tokens := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		c := jwt.MapClaims{"n": i}
+		for k, v := range claims {
+			c[k] = v
+		}
+
+		token, _, err := store.AddToken(&auth.JWTResponse{JWT: s.sign(t, c), AllowedApplications: apps})
+		if err != nil {
+			t.Fatalf("AddToken failed: %s", err)
+		}
+		tokens[auth.HashToken(token)] = true
+	}
+	return tokens
+}
+
+func (s *suite) testGetAllTokens(t *testing.T) {
+	store := s.factory(t, s.verifier)
+	expected := s.addTokens(t, store, 5, jwt.MapClaims{"sub": "user-1"}, nil)
+
+	c, err := store.GetAllTokens()
+	if err != nil {
+		t.Fatalf("GetAllTokens failed: %s", err)
+	}
+
+	seen := 0
+	for token := range c {
+		if !expected[token.TokenHash] {
+			t.Errorf("unexpected token %q", token.TokenHash)
+		}
+		if token.Subject != "user-1" {
+			t.Errorf("expected subject %q, got %q", "user-1", token.Subject)
+		}
+		seen++
+	}
+
+	if seen != len(expected) {
+		t.Errorf("expected %d tokens, got %d", len(expected), seen)
+	}
+}
+
+func (s *suite) listAll(t *testing.T, store auth.TokenStore, filter auth.TokenFilter, limit int) []string {
+	var tokens []string
+	cursor := ""
+
+	for i := 0; i < 1000; i++ {
+		page, next, err := store.ListTokens(filter, cursor, limit)
+		if err != nil {
+			t.Fatalf("ListTokens failed: %s", err)
+		}
+
+		if len(page) > limit {
+			t.Errorf("page contains %d tokens, limit is %d", len(page), limit)
+		}
+
+		for _, token := range page {
+			tokens = append(tokens, token.TokenHash)
+		}
+
+		if next == "" {
+			sort.Strings(tokens)
+			return tokens
+		}
+		cursor = next
+	}
+
+	t.Fatal("ListTokens did not terminate")
+	return nil
+}
+
+func (s *suite) testListTokensPagination(t *testing.T) {
+	store := s.factory(t, s.verifier)
+	expected := s.addTokens(t, store, 25, jwt.MapClaims{}, nil)
+
+	tokens := s.listAll(t, store, auth.TokenFilter{}, 10)
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %d tokens, got %d", len(expected), len(tokens))
+	}
+
+	for i, token := range tokens {
+		if !expected[token] {
+			t.Errorf("unexpected token %q", token)
+		}
+		if i > 0 && tokens[i-1] == token {
+			t.Errorf("token %q listed twice", token)
+		}
+	}
+}
+
+func (s *suite) testListTokensFilter(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	soon := time.Now().Add(time.Hour).Unix()
+	later := time.Now().Add(48 * time.Hour).Unix()
+
+	user1 := s.addTokens(t, store, 3, jwt.MapClaims{"sub": "user-1", "exp": soon}, []string{"app-a"})
+	user2 := s.addTokens(t, store, 2, jwt.MapClaims{"sub": "user-2", "exp": later}, []string{"app-a", "app-b"})
+	unrestricted := s.addTokens(t, store, 2, jwt.MapClaims{"sub": "user-3", "exp": later}, nil)
+
+	cases := []struct {
+		name     string
+		filter   auth.TokenFilter
+		expected []map[string]bool
+	}{
+		{"subject", auth.TokenFilter{Subject: "user-2"}, []map[string]bool{user2}},
+		{"application", auth.TokenFilter{Application: "app-b"}, []map[string]bool{user2, unrestricted}},
+		{"application without wildcards", auth.TokenFilter{Application: "app_%"}, []map[string]bool{unrestricted}},
+		{"expires before", auth.TokenFilter{ExpiresBefore: soon + 60}, []map[string]bool{user1}},
+		{"expires after", auth.TokenFilter{ExpiresAfter: soon + 60}, []map[string]bool{user2, unrestricted}},
+		{"combined", auth.TokenFilter{Subject: "user-1", Application: "app-a"}, []map[string]bool{user1}},
+		{"no match", auth.TokenFilter{Subject: "user-1", Application: "app-b"}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expected := make(map[string]bool)
+			for _, set := range c.expected {
+				for token := range set {
+					expected[token] = true
+				}
+			}
+
+			tokens := s.listAll(t, store, c.filter, 2)
+			if len(tokens) != len(expected) {
+				t.Fatalf("expected %d tokens, got %d", len(expected), len(tokens))
+			}
+
+			for _, token := range tokens {
+				if !expected[token] {
+					t.Errorf("unexpected token %q", token)
+				}
+			}
+		})
+	}
+}
+
+func (s *suite) testListTokensLimits(t *testing.T) {
+	store := s.factory(t, s.verifier)
+
+	// A limit of 0 does not limit the page size, even for empty stores.
+	if page, next, err := store.ListTokens(auth.TokenFilter{}, "", 0); err != nil || len(page) != 0 || next != "" {
+		t.Fatalf("expected empty page, got %v, %q, %v", page, next, err)
+	}
+
+	expected := s.addTokens(t, store, 5, jwt.MapClaims{}, nil)
+
+	seen := 0
+	cursor := ""
+	for i := 0; i < 100; i++ {
+		page, next, err := store.ListTokens(auth.TokenFilter{}, cursor, 0)
+		if err != nil {
+			t.Fatalf("ListTokens failed: %s", err)
+		}
+
+		for _, token := range page {
+			if !expected[token.TokenHash] {
+				t.Errorf("unexpected token %q", token.TokenHash)
+			}
+			seen++
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if seen != len(expected) {
+		t.Errorf("expected %d tokens, got %d", len(expected), seen)
+	}
+
+	if _, _, err := store.ListTokens(auth.TokenFilter{}, "", -1); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
@@ -25,18 +25,24 @@ import (
 
 	"github.com/bluele/gcache"
 	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/mittwald/servicegateway/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"io/ioutil"
 	"net/http"
 )
 
 type CacheMiddleware interface {
-	DecorateHandler(handler httprouter.Handle) httprouter.Handle
-	DecorateUnsafeHandler(handler httprouter.Handle) httprouter.Handle
+	DecorateHandler(handler httprouter.Handle, appName string) httprouter.Handle
+	DecorateUnsafeHandler(handler httprouter.Handle, appName string) httprouter.Handle
 }
 
 type inMemoryCacheMiddleware struct {
-	cache gcache.Cache
+	cache   gcache.Cache
+	metrics *monitoring.PromMetrics
 }
 
 type ResponseBuffer struct {
@@ -85,15 +91,22 @@ func (r *ResponseBuffer) Dump(rw http.ResponseWriter) {
 	_, _ = rw.Write(r.body)
 }
 
-func NewCache(s int) CacheMiddleware {
+func NewCache(s int, metrics *monitoring.PromMetrics) CacheMiddleware {
 	c := new(inMemoryCacheMiddleware)
 	c.cache = gcache.New(s).LRU().Build()
+	c.metrics = metrics
 	return c
 }
 
 func (c *inMemoryCacheMiddleware) identifierForRequest(req *http.Request) string {
 	identifier := req.RequestURI
 
+	// Applications with several backends may get different responses from
+	// each of them.
+	if backend := requestinfo.Get(req).Backend; backend != "" {
+		identifier += "_" + backend
+	}
+
 	if accept := req.Header.Get("Accept"); accept != "" {
 		identifier += "_" + accept
 	}
@@ -101,16 +114,25 @@ func (c *inMemoryCacheMiddleware) identifierForRequest(req *http.Request) string
 	return identifier
 }
 
-func (c *inMemoryCacheMiddleware) DecorateUnsafeHandler(handler httprouter.Handle) httprouter.Handle {
+func (c *inMemoryCacheMiddleware) DecorateUnsafeHandler(handler httprouter.Handle, appName string) httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		identifier := c.identifierForRequest(req)
-		c.cache.Remove(identifier)
+		if c.cache.Remove(identifier) && c.metrics != nil {
+			c.metrics.CachePurges.With(prometheus.Labels{"application": appName}).Inc()
+		}
 		rw.Header().Add("X-Cache", "PURGED")
 		handler(rw, req, p)
 	}
 }
 
-func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle, appName string) httprouter.Handle {
+	countResult := func(result string) {
+		if c.metrics == nil {
+			return
+		}
+		c.metrics.CacheResults.With(prometheus.Labels{"application": appName, "result": result}).Inc()
+	}
+
 	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		identifier := c.identifierForRequest(req)
 
@@ -119,7 +141,10 @@ func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle) htt
 			useCache = false
 		}
 
+		_, span := tracing.Start(req.Context(), "cache.lookup")
 		entry, err := c.cache.Get(identifier)
+		span.SetAttributes(attribute.Bool("cache.hit", useCache && err == nil))
+		span.End()
 		if !useCache || err == gcache.KeyNotFoundError {
 			buf := NewResponseBuffer()
 
@@ -132,9 +157,11 @@ func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle) htt
 
 			if useCache {
 				rw.Header().Add("X-Cache", "MISS")
+				countResult("miss")
 				_ = c.cache.Set(identifier, buf)
 			} else {
 				rw.Header().Add("X-Cache", "PASS")
+				countResult("pass")
 			}
 
 			buf.Dump(rw)
@@ -142,6 +169,7 @@ func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle) htt
 			switch entry := entry.(type) {
 			case *ResponseBuffer:
 				rw.Header().Add("X-Cache", "HIT")
+				countResult("hit")
 				entry.Dump(rw)
 			default:
 				fmt.Println("Unknown type in cache")
@@ -0,0 +1,228 @@
+// Package certificates provides TLS certificates for the gateway's listeners.
+// Certificates are chosen by SNI and reloaded when their files change.
+package certificates
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version like "1.2" into its crypto/tls constant.
+// An empty version defaults to TLS 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version '%s'", version)
+	}
+	return v, nil
+}
+
+type Store struct {
+	pairs          []config.TLSCertificate
+	minVersion     uint16
+	reloadInterval time.Duration
+	clientCAs      *x509.CertPool
+	logger         *logging.Logger
+
+	lock         sync.RWMutex
+	certificates []*tls.Certificate
+	modTimes     []time.Time
+}
+
+// NewStore loads all configured certificates. Loading fails if any of the
+// certificates cannot be loaded.
+func NewStore(cfg *config.TLSConfiguration, logger *logging.Logger) (*Store, error) {
+	if !cfg.Enabled() {
+		return nil, fmt.Errorf("no TLS certificates configured")
+	}
+
+	minVersion, err := ParseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Store{
+		pairs:          cfg.Certificates,
+		minVersion:     minVersion,
+		reloadInterval: time.Minute,
+		logger:         logger,
+	}
+
+	if cfg.ReloadInterval != "" {
+		s.reloadInterval, err = time.ParseDuration(cfg.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS reload interval: %s", err)
+		}
+	}
+
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA bundle: %s", err)
+		}
+
+		s.clientCAs = x509.NewCertPool()
+		if !s.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA bundle %s contains no certificates", cfg.ClientCA)
+		}
+	}
+
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// TLSConfig returns a server configuration that uses the certificates of the
+// store and offers HTTP/2. If a client CA bundle is configured, clients may
+// present a certificate signed by one of its CAs.
+func (s *Store) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     s.minVersion,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if s.clientCAs != nil {
+		config.ClientCAs = s.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
+
+// GetCertificate returns the first certificate that is valid for the server
+// name requested by the client, or the first certificate if none is.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, cert := range s.certificates {
+		if err := hello.SupportsCertificate(cert); err == nil {
+			return cert, nil
+		}
+	}
+
+	return s.certificates[0], nil
+}
+
+// Watch reloads the certificates when their files change, until stop is
+// closed. If a changed certificate cannot be loaded, the previous
+// certificates remain in use.
+func (s *Store) Watch(stop <-chan struct{}) {
+	if s.reloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if reloaded, err := s.reload(); err != nil {
+				s.logger.Errorf("could not reload TLS certificates: %s", err)
+			} else if reloaded {
+				s.logger.Notice("reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+func (s *Store) reload() (bool, error) {
+	modTimes := make([]time.Time, len(s.pairs))
+	changed := len(s.modTimes) != len(s.pairs)
+
+	for i, pair := range s.pairs {
+		for _, file := range []string{pair.Cert, pair.Key} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, err
+			}
+
+			if info.ModTime().After(modTimes[i]) {
+				modTimes[i] = info.ModTime()
+			}
+		}
+
+		if !changed && !modTimes[i].Equal(s.modTimes[i]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	certificates := make([]*tls.Certificate, len(s.pairs))
+	for i, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return false, fmt.Errorf("could not load certificate %s: %s", pair.Cert, err)
+		}
+
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false, fmt.Errorf("could not parse certificate %s: %s", pair.Cert, err)
+		}
+
+		s.logger.Infof("loaded TLS certificate for %v (expires %s)", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format(time.RFC3339))
+		certificates[i] = &cert
+	}
+
+	s.lock.Lock()
+	s.certificates = certificates
+	s.modTimes = modTimes
+	s.lock.Unlock()
+
+	return true, nil
+}
+
+// RedirectHandler redirects all requests to HTTPS on the given port.
+func RedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+
+		// 308 preserves the method and body of non-idempotent requests
+		status := http.StatusPermanentRedirect
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+
+		http.Redirect(rw, req, target.String(), status)
+	})
+}
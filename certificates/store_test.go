@@ -0,0 +1,171 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+// writeTestCertificate writes a self-signed certificate for name to dir and
+// sets its modification time to modTime.
+func writeTestCertificate(t *testing.T, dir string, name string, serial int64, modTime time.Time) config.TLSCertificate {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	cert := config.TLSCertificate{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	files := map[string][]byte{
+		cert.Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		cert.Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+
+	for filename, content := range files {
+		if err := os.WriteFile(filename, content, 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	return cert
+}
+
+func servedSerial(t *testing.T, s *Store, serverName string) int64 {
+	t.Helper()
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestStoreSelectsAndReloadsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Minute)
+
+	cfg := config.TLSConfiguration{Certificates: []config.TLSCertificate{
+		writeTestCertificate(t, dir, "a.example", 1, modTime),
+		writeTestCertificate(t, dir, "b.example", 2, modTime),
+	}}
+
+	s, err := NewStore(&cfg, logging.MustGetLogger("test"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := map[string]int64{"a.example": 1, "b.example": 2, "unknown.example": 1}
+	for serverName, serial := range cases {
+		if actual := servedSerial(t, s, serverName); actual != serial {
+			t.Errorf("%s: expected certificate %d, got %d", serverName, serial, actual)
+		}
+	}
+
+	if reloaded, err := s.reload(); err != nil || reloaded {
+		t.Errorf("expected unchanged certificates not to be reloaded, got %v (%v)", reloaded, err)
+	}
+
+	writeTestCertificate(t, dir, "b.example", 3, time.Now())
+	if reloaded, err := s.reload(); err != nil || !reloaded {
+		t.Fatalf("expected changed certificates to be reloaded, got %v (%v)", reloaded, err)
+	}
+	if serial := servedSerial(t, s, "b.example"); serial != 3 {
+		t.Errorf("expected renewed certificate, got %d", serial)
+	}
+
+	// broken certificates are not loaded; the previous ones remain in use
+	if err := os.WriteFile(cfg.Certificates[0].Cert, []byte("broken"), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := s.reload(); err == nil {
+		t.Error("expected an error")
+	}
+	if serial := servedSerial(t, s, "a.example"); serial != 1 {
+		t.Errorf("expected previous certificate, got %d", serial)
+	}
+}
+
+func TestStoreServesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.TLSConfiguration{Certificates: []config.TLSCertificate{writeTestCertificate(t, dir, "a.example", 1, time.Now())}}
+
+	s, err := NewStore(&cfg, logging.MustGetLogger("test"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "a.example", InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		t.Errorf("expected HTTP/2, got %q", protocol)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	cases := []struct {
+		port     int
+		method   string
+		url      string
+		status   int
+		location string
+	}{
+		{443, "GET", "http://example.com:8080/a%2Fb?c=d", http.StatusMovedPermanently, "https://example.com/a%2Fb?c=d"},
+		{8443, "POST", "http://example.com/a", http.StatusPermanentRedirect, "https://example.com:8443/a"},
+		{8443, "HEAD", "http://[::1]:8080/", http.StatusMovedPermanently, "https://[::1]:8443/"},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		RedirectHandler(c.port).ServeHTTP(rec, httptest.NewRequest(c.method, c.url, nil))
+
+		if rec.Code != c.status || rec.Header().Get("Location") != c.location {
+			t.Errorf("%s %s: expected %d to %s, got %d to %s", c.method, c.url, c.status, c.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
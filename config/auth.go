@@ -6,12 +6,47 @@ type AuthWriterConfig struct {
 }
 
 type ProviderAuthConfig struct {
-	Url                   string                 `json:"url"`
-	Parameters            map[string]interface{} `json:"parameters"`
-	PreAuthenticationHook string                 `json:"hook_pre_authentication"`
-	AllowAuthentication   bool                   `json:"allow_authentication"`
-	AuthenticationUri     string                 `json:"authentication_uri"`
-	Service               string                 `json:"service"`
+	Url                   string                   `json:"url"`
+	Parameters            map[string]interface{}   `json:"parameters"`
+	PreAuthenticationHook string                   `json:"hook_pre_authentication"`
+	AllowAuthentication   bool                     `json:"allow_authentication"`
+	AuthenticationUri     string                   `json:"authentication_uri"`
+	Service               string                   `json:"service"`
+	Refresh               ProviderRefreshConfig    `json:"refresh"`
+	Challenge             ProviderChallengeConfig  `json:"challenge"`
+	Lockout               ProviderLockoutConfig    `json:"lockout"`
+	ClientCertificate     ProviderClientCertConfig `json:"client_certificate"`
+}
+
+type ProviderClientCertConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Url      string `json:"url"`
+	CacheTtl string `json:"cache_ttl"`
+}
+
+type ProviderLockoutConfig struct {
+	Enabled        bool     `json:"enabled"`
+	MaxFailures    int      `json:"max_failures"`
+	Window         string   `json:"window"`
+	Duration       string   `json:"duration"`
+	MaxDuration    string   `json:"max_duration"`
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+type ProviderChallengeConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Url         string `json:"url"`
+	Uri         string `json:"uri"`
+	Ttl         string `json:"ttl"`
+	MaxAttempts int    `json:"max_attempts"`
+}
+
+type ProviderRefreshConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Url           string `json:"url"`
+	RefreshBefore string `json:"refresh_before"`
+	SlidingTtl    string `json:"sliding_ttl"`
+	TokenHeader   string `json:"token_header"`
 }
 
 type ApplicationAuth struct {
@@ -26,4 +61,5 @@ type GlobalAuth struct {
 	VerificationKeyUrl string             `json:"verification_key_url"`
 	KeyCacheTtl        string             `json:"key_cache_ttl"`
 	EnableCORS         bool               `json:"enable_cors"`
+	CORS               *CORS              `json:"cors"`
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
@@ -27,13 +28,19 @@ import (
  */
 
 type Configuration struct {
-	Applications   map[string]Application `json:"applications"`
-	RateLimiting   RateLimiting           `json:"rate_limiting"`
-	Authentication GlobalAuth             `json:"authentication"`
-	Consul         ConsulConfiguration    `json:"consul"`
-	Proxy          ProxyConfiguration     `json:"proxy"`
-	Redis          RedisConfiguration     `json:"redis"`
-	Logging        []LoggingConfiguration `json:"logging"`
+	Applications   map[string]Application  `json:"applications"`
+	RateLimiting   RateLimiting            `json:"rate_limiting"`
+	Authentication GlobalAuth              `json:"authentication"`
+	Consul         ConsulConfiguration     `json:"consul"`
+	Proxy          ProxyConfiguration      `json:"proxy"`
+	Redis          RedisConfiguration      `json:"redis"`
+	TokenStore     TokenStoreConfiguration `json:"token_store"`
+	Scripting      ScriptingConfiguration  `json:"scripting"`
+	Logging        []LoggingConfiguration  `json:"logging"`
+	TLS            TLSConfiguration        `json:"tls"`
+	Shutdown       ShutdownConfiguration   `json:"shutdown"`
+	Metrics        MetricsConfiguration    `json:"metrics"`
+	Tracing        TracingConfiguration    `json:"tracing"`
 }
 
 type Application struct {
@@ -42,21 +49,145 @@ type Application struct {
 	Auth         ApplicationAuth `json:"auth"`
 	Caching      Caching         `json:"caching"`
 	RateLimiting bool            `json:"rate_limiting"`
+	RateLimit    *RateLimiting   `json:"rate_limit"`
+	Scripts      Scripts         `json:"scripts"`
+	CORS         *CORS           `json:"cors"`
+	Tracing      *Tracing        `json:"tracing"`
+	Headers      *HeaderPolicy   `json:"headers"`
+}
+
+// HeaderPolicy transforms the headers of requests that are forwarded to an
+// application and of the responses it returns. Headers in StripRequest are
+// removed from client requests before any other processing.
+type HeaderPolicy struct {
+	StripRequest []string    `json:"strip_request"`
+	Request      HeaderRules `json:"request"`
+	Response     HeaderRules `json:"response"`
+}
+
+// HeaderRules are applied in the order rename, copy, remove, set, add. Rename
+// and copy map source to target headers. Values of set and add may contain
+// placeholders like {client_ip}, {request_id}, {claim:sub} or {param:id}.
+type HeaderRules struct {
+	Rename map[string]string `json:"rename"`
+	Copy   map[string]string `json:"copy"`
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+// Tracing overrides the sampling of traces started by an application.
+type Tracing struct {
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+// CORS configures the Cross-Origin Resource Sharing policy of an application
+// or the authentication endpoint. Origins are either matched exactly (or "*"
+// for any origin), or against the regular expressions in OriginPatterns.
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	OriginPatterns   []string `json:"allowed_origin_patterns"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+type Scripts struct {
+	OnRequest  string `json:"on_request"`
+	OnResponse string `json:"on_response"`
 }
 
 type Routing struct {
 	Type     string            `json:"type"`
 	Path     string            `json:"path"`
 	Patterns map[string]string `json:"patterns"`
+	Routes   []Route           `json:"routes"`
+	Rewrite  *Rewrite          `json:"rewrite"`
 	Hostname string            `json:"hostname"`
 }
 
+// Route is a route of an application with "pattern" routing. Pattern is a
+// path pattern like "/users/:id" or "/files/*path". Methods restricts the
+// allowed methods; the other properties override those of the application.
+type Route struct {
+	Pattern      string           `json:"pattern"`
+	Methods      []string         `json:"methods"`
+	Caching      *Caching         `json:"caching"`
+	Auth         *ApplicationAuth `json:"auth"`
+	RateLimiting *bool            `json:"rate_limiting"`
+	RateLimit    *RateLimiting    `json:"rate_limit"`
+	Rewrite
+}
+
+// Rewrite maps the path and query of a request to the upstream URL. The path
+// is stripped of StripPrefix and matched against Match, a regular expression
+// that must match the complete (stripped) path. Target is the upstream path;
+// it may contain the named captures of Match and the route parameters as
+// ":name" placeholders.
+type Rewrite struct {
+	StripPrefix string       `json:"strip_prefix"`
+	Match       string       `json:"match"`
+	Target      string       `json:"target"`
+	Query       QueryRewrite `json:"query"`
+}
+
+// QueryRewrite modifies the query parameters of a request, in the order
+// rename, remove, add.
+type QueryRewrite struct {
+	Rename map[string]string `json:"rename"`
+	Remove []string          `json:"remove"`
+	Add    map[string]string `json:"add"`
+}
+
 type Backend struct {
-	Url      string `json:"url"`
-	Service  string `json:"service"`
-	Tag      string `json:"tag"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Url      string          `json:"url"`
+	Service  string          `json:"service"`
+	Tag      string          `json:"tag"`
+	Username string          `json:"username"`
+	Password string          `json:"password"`
+	TLS      BackendTLS      `json:"tls"`
+	Targets  []BackendTarget `json:"targets"`
+	Rules    []BackendRule   `json:"rules"`
+	Sticky   *BackendSticky  `json:"sticky"`
+}
+
+// BackendTarget is one of several backends of an application. Requests are
+// distributed among the targets according to their weights.
+type BackendTarget struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Service string `json:"service"`
+	Tag     string `json:"tag"`
+	Weight  int    `json:"weight"`
+}
+
+// BackendRule sends requests with a header, cookie or JWT claim to a target,
+// regardless of the weights. Without a Value, any value matches.
+type BackendRule struct {
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+	Claim  string `json:"claim"`
+	Value  string `json:"value"`
+	Target string `json:"target"`
+}
+
+// BackendSticky keeps clients on the target they were assigned to by
+// weight, using a cookie.
+type BackendSticky struct {
+	Cookie string `json:"cookie"`
+	MaxAge int    `json:"max_age"`
+}
+
+// BackendTLS configures connections to HTTPS backends. All files are
+// PEM-encoded.
+type BackendTLS struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+	MinVersion string `json:"min_version"`
 }
 
 type RedisConfiguration struct {
@@ -65,6 +196,92 @@ type RedisConfiguration struct {
 	Database int    `json:"database"`
 }
 
+type TokenStoreConfiguration struct {
+	Type           string                       `json:"type"`
+	Driver         string                       `json:"driver"`
+	Dsn            string                       `json:"dsn"`
+	LocalCacheSize int                          `json:"local_cache_size"`
+	Encryption     TokenEncryptionConfiguration `json:"encryption"`
+}
+
+type TokenEncryptionConfiguration struct {
+	Keys              map[string]string `json:"keys"`
+	ActiveKey         string            `json:"active_key"`
+	ReencryptInterval string            `json:"reencrypt_interval"`
+}
+
+type ScriptingConfiguration struct {
+	PoolSize         int    `json:"pool_size"`
+	Timeout          string `json:"timeout"`
+	MaxCallStackSize int    `json:"max_call_stack_size"`
+	FetchTimeout     string `json:"fetch_timeout"`
+}
+
+type TLSConfiguration struct {
+	Certificates   []TLSCertificate `json:"certificates"`
+	MinVersion     string           `json:"min_version"`
+	ReloadInterval string           `json:"reload_interval"`
+	RedirectHTTP   bool             `json:"redirect_http"`
+	ClientCA       string           `json:"client_ca"`
+}
+
+type TLSCertificate struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (c *TLSConfiguration) Enabled() bool {
+	return len(c.Certificates) > 0
+}
+
+// MetricsConfiguration sets the histogram buckets of the Prometheus metrics.
+// Unset buckets use the defaults of the monitoring package.
+type MetricsConfiguration struct {
+	LatencyBuckets []float64 `json:"latency_buckets"`
+	SizeBuckets    []float64 `json:"size_buckets"`
+}
+
+// TracingConfiguration configures the export of OpenTelemetry traces over
+// OTLP/HTTP.
+type TracingConfiguration struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+	SampleRatio *float64          `json:"sample_ratio"`
+}
+
+// ShutdownConfiguration controls how the gateway drains connections when it
+// is asked to terminate.
+type ShutdownConfiguration struct {
+	DrainDelay string `json:"drain_delay"`
+	Timeout    string `json:"timeout"`
+}
+
+// Durations returns the drain delay and the shutdown timeout, using defaults
+// of 5 and 20 seconds for unset values.
+func (c *ShutdownConfiguration) Durations() (time.Duration, time.Duration, error) {
+	drainDelay, timeout := 5*time.Second, 20*time.Second
+
+	if c.DrainDelay != "" {
+		d, err := time.ParseDuration(c.DrainDelay)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid shutdown drain delay: %s", err)
+		}
+		drainDelay = d
+	}
+
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid shutdown timeout: %s", err)
+		}
+		timeout = d
+	}
+
+	return drainDelay, timeout, nil
+}
+
 type ConsulConfiguration struct {
 	Host       string `json:"host"`
 	Port       int    `json:"port"`
@@ -109,9 +326,12 @@ type Caching struct {
 	AutoFlush bool `json:"auto_flush"`
 }
 
+// RateLimiting configures a rate limit. Requests are counted per client in
+// a bucket; limits with the same Bucket share their counters.
 type RateLimiting struct {
 	Burst  int    `json:"burst"`
 	Window string `json:"window"`
+	Bucket string `json:"bucket"`
 }
 
 type OptionsConfiguration struct {
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownDurations(t *testing.T) {
+	drainDelay, timeout, err := (&ShutdownConfiguration{}).Durations()
+	if err != nil || drainDelay != 5*time.Second || timeout != 20*time.Second {
+		t.Errorf("expected default durations, got %s and %s (%v)", drainDelay, timeout, err)
+	}
+
+	drainDelay, timeout, err = (&ShutdownConfiguration{DrainDelay: "0s", Timeout: "1m"}).Durations()
+	if err != nil || drainDelay != 0 || timeout != time.Minute {
+		t.Errorf("expected configured durations, got %s and %s (%v)", drainDelay, timeout, err)
+	}
+
+	for _, cfg := range []ShutdownConfiguration{{DrainDelay: "soon"}, {Timeout: "10"}} {
+		if _, _, err := cfg.Durations(); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
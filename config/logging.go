@@ -1,17 +1,74 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type AmqpLoggingConfiguration struct {
-	Uri        string `json:"uri"`
-	Exchange   string `json:"exchange"`
-	UnsafeOnly bool   `json:"unsafe_only"`
+	Uri      string `json:"uri"`
+	Exchange string `json:"exchange"`
+}
+
+type KafkaLoggingConfiguration struct {
+	Brokers      []string `json:"brokers"`
+	Topic        string   `json:"topic"`
+	RequiredAcks string   `json:"required_acks"`
+}
+
+type NatsLoggingConfiguration struct {
+	Url       string `json:"url"`
+	Subject   string `json:"subject"`
+	JetStream bool   `json:"jetstream"`
 }
 
 type ApacheLoggingConfiguration struct {
 	Filename string `json:"filename"`
 }
 
+// AuditQueueConfiguration controls how audit loggers buffer events that are
+// not yet published.
+type AuditQueueConfiguration struct {
+	QueueSize      int    `json:"queue_size"`
+	BatchSize      int    `json:"batch_size"`
+	SpoolFile      string `json:"spool_file"`
+	ConfirmTimeout string `json:"confirm_timeout"`
+}
+
+// ConfirmTimeoutDuration returns how long to wait for the broker to confirm a
+// message, using a default of 5 seconds.
+func (c *AuditQueueConfiguration) ConfirmTimeoutDuration() (time.Duration, error) {
+	if c.ConfirmTimeout == "" {
+		return 5 * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(c.ConfirmTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid confirm timeout: %s", err)
+	}
+	return d, nil
+}
+
+// AuditConfiguration controls which events audit loggers publish, and their
+// contents.
+type AuditConfiguration struct {
+	// Events is either "audit" (the default) or "access".
+	Events     string `json:"events"`
+	UnsafeOnly bool   `json:"unsafe_only"`
+
+	// Claims maps fields of the "auth" object of audit events to JWT claims.
+	Claims       map[string]string `json:"claims"`
+	IncludeBody  bool              `json:"include_body"`
+	BodyMaxSize  int               `json:"body_max_size"`
+	RedactFields []string          `json:"redact_fields"`
+}
+
 type LoggingConfiguration struct {
 	Type string `json:"type"`
 	AmqpLoggingConfiguration
+	KafkaLoggingConfiguration
+	NatsLoggingConfiguration
 	ApacheLoggingConfiguration
+	AuditQueueConfiguration
+	AuditConfiguration
 }
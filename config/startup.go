@@ -7,6 +7,7 @@ type Startup struct {
 	ConsulBaseKey   string
 	UiDir           string
 	Port            int
+	TLSPort         int
 	AdminAddress    string
 	AdminPort       int
 	MonitorAddress  string
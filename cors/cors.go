@@ -0,0 +1,273 @@
+// Package cors implements Cross-Origin Resource Sharing policies. A policy
+// answers preflight requests itself and adds CORS headers to all other
+// responses, replacing any CORS headers set by the backend.
+package cors
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+var (
+	defaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	defaultHeaders = []string{"X-Requested-With", "Authorization", "Content-Type"}
+)
+
+type Policy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	patterns         []*regexp.Regexp
+	methods          string
+	headers          string
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           int
+}
+
+// NewPolicy compiles a CORS configuration. Unset methods and headers default
+// to all common methods and to X-Requested-With, Authorization and
+// Content-Type.
+func NewPolicy(cfg *config.CORS) (*Policy, error) {
+	p := Policy{
+		origins:          make(map[string]bool),
+		methods:          strings.Join(defaultMethods, ", "),
+		headers:          strings.Join(defaultHeaders, ", "),
+		exposedHeaders:   strings.Join(cfg.ExposedHeaders, ", "),
+		allowCredentials: cfg.AllowCredentials,
+		maxAge:           cfg.MaxAge,
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		p.origins[strings.ToLower(strings.TrimRight(origin, "/"))] = true
+	}
+
+	for _, pattern := range cfg.OriginPatterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin pattern '%s': %s", pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+
+	if p.anyOrigin && p.allowCredentials {
+		return nil, fmt.Errorf("the origin '*' cannot be combined with allow_credentials; list the allowed origins instead")
+	}
+
+	if len(cfg.AllowedMethods) > 0 {
+		methods := make([]string, len(cfg.AllowedMethods))
+		for i := range cfg.AllowedMethods {
+			methods[i] = strings.ToUpper(cfg.AllowedMethods[i])
+		}
+		p.methods = strings.Join(methods, ", ")
+	}
+
+	if len(cfg.AllowedHeaders) > 0 {
+		p.headers = strings.Join(cfg.AllowedHeaders, ", ")
+	}
+
+	if p.maxAge < 0 {
+		return nil, fmt.Errorf("max_age must not be negative")
+	}
+
+	return &p, nil
+}
+
+// LegacyPolicy returns the policy of the former "cors" switches: any origin
+// may send requests, but without credentials.
+func LegacyPolicy(methods []string, maxAge int) *Policy {
+	p, _ := NewPolicy(&config.CORS{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: methods,
+		MaxAge:         maxAge,
+	})
+	return p
+}
+
+// ApplicationPolicy returns the CORS policy of an application, or nil if CORS
+// is disabled for it.
+func ApplicationPolicy(app *config.Application, cfg *config.Configuration) (*Policy, error) {
+	if app.CORS != nil {
+		return NewPolicy(app.CORS)
+	}
+
+	if cfg.Proxy.OptionsConfiguration.CORS {
+		return LegacyPolicy(nil, 86400), nil
+	}
+
+	return nil, nil
+}
+
+// AuthenticationPolicy returns the CORS policy of the authentication
+// endpoints, or nil if CORS is disabled for them.
+func AuthenticationPolicy(cfg *config.GlobalAuth) (*Policy, error) {
+	if cfg.CORS != nil {
+		return NewPolicy(cfg.CORS)
+	}
+
+	if cfg.EnableCORS {
+		return LegacyPolicy([]string{"POST", "OPTIONS"}, 0), nil
+	}
+
+	return nil, nil
+}
+
+func (p *Policy) AllowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	if p.origins[strings.ToLower(origin)] {
+		return true
+	}
+
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPreflight reports whether a request is a CORS preflight request.
+func IsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// DecorateHandler answers preflight requests and adds CORS headers to the
+// responses of all other requests. Preflight requests from origins that are
+// not allowed are rejected; other requests from such origins are passed on
+// without CORS headers, so that browsers will not expose the response.
+func (p *Policy) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		origin := req.Header.Get("Origin")
+
+		if IsPreflight(req) {
+			addVary(rw.Header())
+
+			if !p.AllowsOrigin(origin) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusForbidden)
+				_, _ = rw.Write([]byte(`{"msg":"origin not allowed"}`))
+				return
+			}
+
+			p.setHeaders(rw.Header(), origin)
+			rw.Header().Set("Access-Control-Allow-Methods", p.methods)
+			rw.Header().Set("Access-Control-Allow-Headers", p.headers)
+			if p.maxAge > 0 {
+				rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+			}
+
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w := &responseWriter{ResponseWriter: rw, policy: p, origin: origin}
+		handler(w, req, params)
+
+		// Handlers that do not write anything respond with an implicit 200.
+		if !w.wroteHeader && !w.hijacked {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func (p *Policy) setHeaders(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func addVary(header http.Header) {
+	for _, v := range header.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if f := strings.TrimSpace(field); f == "*" || strings.EqualFold(f, "Origin") {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", "Origin")
+}
+
+// responseWriter replaces the CORS headers of a response just before it is
+// written.
+type responseWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	origin      string
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		header := w.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				delete(header, name)
+			}
+		}
+
+		addVary(header)
+
+		if w.origin != "" && w.policy.AllowsOrigin(w.origin) {
+			w.policy.setHeaders(header, w.origin)
+			if w.policy.exposedHeaders != "" {
+				header.Set("Access-Control-Expose-Headers", w.policy.exposedHeaders)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	w.hijacked = true
+	return h.Hijack()
+}
@@ -0,0 +1,146 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+func serve(t *testing.T, cfg *config.CORS, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	p, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	handler := p.DecorateHandler(func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.Header().Set("Access-Control-Allow-Methods", "TRACE")
+		_, _ = rw.Write([]byte("ok"))
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, req, nil)
+	return rec
+}
+
+func request(method string, origin string, requestMethod string) *http.Request {
+	req := httptest.NewRequest(method, "/", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if requestMethod != "" {
+		req.Header.Set("Access-Control-Request-Method", requestMethod)
+	}
+	return req
+}
+
+var testCORS = config.CORS{
+	AllowedOrigins:   []string{"https://a.example/"},
+	OriginPatterns:   []string{`https://[a-z]+\.b\.example`},
+	AllowedMethods:   []string{"get", "put"},
+	AllowCredentials: true,
+	ExposedHeaders:   []string{"X-Total"},
+	MaxAge:           60,
+}
+
+func TestPreflight(t *testing.T) {
+	rec := serve(t, &testCORS, request("OPTIONS", "https://A.example", "PUT"))
+
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://A.example",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "X-Requested-With, Authorization, Content-Type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "60",
+		"Vary":                             "Origin",
+	}
+
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Fatalf("expected empty 204 response, got %d (%s)", rec.Code, rec.Body)
+	}
+
+	for name, value := range expected {
+		if actual := rec.Header().Get(name); actual != value {
+			t.Errorf("%s: expected %q, got %q", name, value, actual)
+		}
+	}
+}
+
+func TestPreflightFromUnknownOrigin(t *testing.T) {
+	rec := serve(t, &testCORS, request("OPTIONS", "https://evil.example", "PUT"))
+
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected 403 without CORS headers, got %d (%v)", rec.Code, rec.Header())
+	}
+}
+
+func TestSimpleRequests(t *testing.T) {
+	cases := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{"pattern", "https://x.b.example", true},
+		{"pattern is anchored", "https://x.b.example.evil", false},
+		{"unknown origin", "https://evil.example", false},
+		{"no origin", "", false},
+	}
+
+	for _, c := range cases {
+		rec := serve(t, &testCORS, request("GET", c.origin, ""))
+
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Errorf("%s: expected request to be passed on, got %d", c.name, rec.Code)
+		}
+
+		if rec.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("%s: expected CORS headers of the backend to be removed", c.name)
+		}
+
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); (origin == c.origin && origin != "") != c.allowed {
+			t.Errorf("%s: unexpected Access-Control-Allow-Origin %q", c.name, origin)
+		}
+
+		if exposed := rec.Header().Get("Access-Control-Expose-Headers"); (exposed == "X-Total") != c.allowed {
+			t.Errorf("%s: unexpected Access-Control-Expose-Headers %q", c.name, exposed)
+		}
+
+		if rec.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: expected Vary: Origin", c.name)
+		}
+	}
+}
+
+func TestLegacyPolicyAllowsAnyOrigin(t *testing.T) {
+	p := LegacyPolicy(nil, 0)
+
+	if !p.AllowsOrigin("https://any.example") {
+		t.Fatal("expected legacy policy to allow any origin")
+	}
+
+	rec := httptest.NewRecorder()
+	p.DecorateHandler(func(rw http.ResponseWriter, _ *http.Request, _ httprouter.Params) {})(rec, request("GET", "https://any.example", ""), nil)
+
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("unexpected CORS headers %v", rec.Header())
+	}
+}
+
+func TestNewPolicyRejectsInvalidConfig(t *testing.T) {
+	cases := map[string]config.CORS{
+		"any origin with credentials": {AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		"invalid pattern":             {OriginPatterns: []string{"("}},
+		"negative max age":            {MaxAge: -1},
+	}
+
+	for name, cfg := range cases {
+		if _, err := NewPolicy(&cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -20,17 +20,30 @@ package dispatcher
  */
 
 import (
+	"fmt"
+	"net/http"
+	"os"
+
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/auth"
 	"github.com/mittwald/servicegateway/cache"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/cors"
+	"github.com/mittwald/servicegateway/headers"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/scripting"
+	"github.com/mittwald/servicegateway/tracing"
+	"github.com/op/go-logging"
 )
 
 type cachingBehaviour struct {
 	cache cache.CacheMiddleware
 }
 
+type backendBehaviour struct{}
+
 type authBehaviour struct {
 	auth auth.AuthDecorator
 }
@@ -39,21 +52,57 @@ type ratelimitBehaviour struct {
 	rlim ratelimit.RateLimitingMiddleware
 }
 
+type corsBehaviour struct{}
+
+type headersBehaviour struct {
+	verifier *auth.JwtVerifier
+}
+
+type metricsBehaviour struct {
+	metrics *monitoring.PromMetrics
+}
+
+type tracingBehaviour struct {
+	tracing *tracing.Tracing
+}
+
+type scriptingBehaviour struct {
+	verifier *auth.JwtVerifier
+	logger   *logging.Logger
+	metrics  *monitoring.PromMetrics
+}
+
 func NewCachingBehaviour(c cache.CacheMiddleware) Behavior {
 	return &cachingBehaviour{c}
 }
 
-func (c *cachingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+func (c *cachingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
 	if app.Caching.Enabled {
-		safe = c.cache.DecorateHandler(safe)
+		safe = c.cache.DecorateHandler(safe, appName)
 
 		if app.Caching.AutoFlush {
-			unsafe = c.cache.DecorateUnsafeHandler(unsafe)
+			unsafe = c.cache.DecorateUnsafeHandler(unsafe, appName)
 		}
 	}
 	return safe, unsafe, nil
 }
 
+// NewBackendBehaviour selects the backend of each request. It must be added
+// right after the caching behaviour, so that it runs before the cache: the
+// cache is then keyed by backend and does not store the sticky backend cookie.
+func NewBackendBehaviour() Behavior {
+	return &backendBehaviour{}
+}
+
+func (b *backendBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	backends := d.Backends(appName)
+	if backends == nil {
+		return safe, unsafe, nil
+	}
+
+	return backends.DecorateHandler(safe), backends.DecorateHandler(unsafe), nil
+}
+
 func NewAuthenticationBehaviour(a auth.AuthDecorator) Behavior {
 	return &authBehaviour{a}
 }
@@ -74,10 +123,138 @@ func NewRatelimitBehaviour(rlim ratelimit.RateLimitingMiddleware) Behavior {
 	return &ratelimitBehaviour{rlim}
 }
 
-func (r *ratelimitBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
-	if app.RateLimiting {
-		safe = r.rlim.DecorateHandler(safe)
-		unsafe = r.rlim.DecorateHandler(unsafe)
+func (r *ratelimitBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if !app.RateLimiting && app.RateLimit == nil {
+		return safe, unsafe, nil
 	}
-	return safe, unsafe, nil
+
+	rlim := r.rlim
+
+	// Applications (and routes) with their own limit count requests in a
+	// bucket of their own, unless configured otherwise.
+	if app.RateLimit != nil {
+		limit := *app.RateLimit
+		if limit.Bucket == "" {
+			limit.Bucket = appName
+		}
+
+		var err error
+		if rlim, err = r.rlim.WithLimits(&limit); err != nil {
+			return nil, nil, fmt.Errorf("invalid rate limit of application %s: %s", appName, err)
+		}
+	}
+
+	return rlim.DecorateHandler(safe, appName), rlim.DecorateHandler(unsafe, appName), nil
+}
+
+func NewCORSBehaviour() Behavior {
+	return &corsBehaviour{}
+}
+
+func (c *corsBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	policy, err := cors.ApplicationPolicy(app, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CORS configuration of application %s: %s", appName, err)
+	}
+
+	if policy == nil {
+		return safe, unsafe, nil
+	}
+
+	return policy.DecorateHandler(safe), policy.DecorateHandler(unsafe), nil
+}
+
+func NewHeadersBehaviour(verifier *auth.JwtVerifier) Behavior {
+	return &headersBehaviour{verifier}
+}
+
+func (h *headersBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	policy, err := headers.ApplicationPolicy(app, h.verifier)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid header policy of application %s: %s", appName, err)
+	}
+
+	if policy == nil {
+		return safe, unsafe, nil
+	}
+
+	return policy.DecorateHandler(safe), policy.DecorateHandler(unsafe), nil
+}
+
+func NewMetricsBehaviour(metrics *monitoring.PromMetrics) Behavior {
+	return &metricsBehaviour{metrics}
+}
+
+func (m *metricsBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	return m.metrics.InstrumentHandler(appName, safe), m.metrics.InstrumentHandler(appName, unsafe), nil
+}
+
+func NewTracingBehaviour(t *tracing.Tracing) Behavior {
+	return &tracingBehaviour{t}
+}
+
+func (t *tracingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Tracing != nil && app.Tracing.SampleRatio != nil {
+		if err := t.tracing.SetSampleRatio(appName, *app.Tracing.SampleRatio); err != nil {
+			return nil, nil, fmt.Errorf("invalid tracing configuration of application %s: %s", appName, err)
+		}
+	}
+
+	return t.tracing.DecorateHandler(appName, safe), t.tracing.DecorateHandler(appName, unsafe), nil
+}
+
+func NewScriptingBehaviour(verifier *auth.JwtVerifier, logger *logging.Logger, metrics *monitoring.PromMetrics) Behavior {
+	return &scriptingBehaviour{verifier, logger, metrics}
+}
+
+func (s *scriptingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Scripts.OnRequest == "" && app.Scripts.OnResponse == "" {
+		return safe, unsafe, nil
+	}
+
+	options, err := scripting.OptionsFromConfig(&config.Scripting)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	onRequest, err := s.loadScript(appName, "on_request", app.Scripts.OnRequest, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	onResponse, err := s.loadScript(appName, "on_response", app.Scripts.OnResponse, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims := func(req *http.Request) map[string]interface{} {
+		token := auth.RequestToken(req)
+		if token == nil {
+			return nil
+		}
+
+		claims, err := s.verifier.DecodeClaims(token.JWT)
+		if err != nil {
+			requestid.NewLogger(req.Context(), s.logger).Warningf("could not decode claims for script: %s", err)
+			return nil
+		}
+		return claims
+	}
+
+	hooks := scripting.NewApplicationHooks(appName, onRequest, onResponse, claims, s.logger)
+
+	return hooks.DecorateHandler(safe), hooks.DecorateHandler(unsafe), nil
+}
+
+func (s *scriptingBehaviour) loadScript(appName string, hook string, file string, options scripting.Options) (*scripting.Runtime, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s script of application %s: %s", hook, appName, err)
+	}
+
+	return scripting.NewRuntime(appName+":"+hook, string(source), options, s.logger, s.metrics)
 }
@@ -12,12 +12,15 @@ import (
 	"github.com/mittwald/servicegateway/cache"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
 	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/mittwald/servicegateway/tracing"
 	"github.com/op/go-logging"
 
 	"net/http"
-	"regexp"
 	"strings"
 )
 
@@ -31,6 +34,8 @@ func BuildConsulDispatcher(
 	tokenStore auth.TokenStore,
 	tokenVerifier *auth.JwtVerifier,
 	httpLoggers []httplogging.HttpLogger,
+	metrics *monitoring.PromMetrics,
+	tracer *tracing.Tracing,
 ) (http.Handler, http.Handler, error) {
 	var disp Dispatcher
 	var err error
@@ -42,7 +47,7 @@ func BuildConsulDispatcher(
 
 	switch startup.DispatchingMode {
 	case "path":
-		disp, err = buildConsulPathDispatcher(&localCfg, dispLogger, handler)
+		disp, err = buildConsulPathDispatcher(&localCfg, dispLogger, handler, tokenVerifier)
 	default:
 		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
 	}
@@ -81,7 +86,7 @@ func BuildConsulDispatcher(
 		}
 	}
 
-	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, rpool, tokenStore, tokenVerifier, logger)
+	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, &localCfg.Scripting, rpool, tokenStore, tokenVerifier, logger, metrics)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -91,18 +96,24 @@ func BuildConsulDispatcher(
 		return nil, nil, err
 	}
 
-	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"))
+	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"), metrics)
 	if err != nil {
 		logger.Fatalf("error while configuring rate limiting: %s", err)
 	}
 
-	cch := cache.NewCache(4096)
+	cch := cache.NewCache(4096, metrics)
 
 	// Order is important here! Behaviors will be called in LIFO order;
 	// behaviors that are added last will be called first!
 	disp.AddBehaviour(NewCachingBehaviour(cch))
+	disp.AddBehaviour(NewBackendBehaviour())
+	disp.AddBehaviour(NewScriptingBehaviour(tokenVerifier, logging.MustGetLogger("scripting"), metrics))
 	disp.AddBehaviour(NewAuthenticationBehaviour(authDecorator))
 	disp.AddBehaviour(NewRatelimitBehaviour(rlim))
+	disp.AddBehaviour(NewCORSBehaviour())
+	disp.AddBehaviour(NewMetricsBehaviour(metrics))
+	disp.AddBehaviour(NewTracingBehaviour(tracer))
+	disp.AddBehaviour(NewHeadersBehaviour(tokenVerifier))
 
 	for name, appCfg := range appCfgs {
 		logger.Infof("registering application '%s' from Consul", name)
@@ -139,12 +150,18 @@ func BuildConsulDispatcher(
 			authDecorator.RegisterRequestListener(listener)
 		}
 
+		if listener, ok := httpLogger.(auth.LockoutListener); ok && authHandler.Lockout() != nil {
+			authHandler.Lockout().RegisterListener(listener)
+		}
+
 		server, err = httpLogger.Wrap(server)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	server = requestid.NewHandler(requestinfo.NewHandler(server))
+
 	return server, adminServer, nil
 }
 
@@ -156,6 +173,7 @@ func buildConsulPathDispatcher(
 	cfg *config.Configuration,
 	log *logging.Logger,
 	prx *proxy.ProxyHandler,
+	verifier *auth.JwtVerifier,
 ) (*consulPathDispatcher, error) {
 	dispatcher := &consulPathDispatcher{
 		abstractPathBasedDispatcher: &abstractPathBasedDispatcher{
@@ -164,95 +182,26 @@ func buildConsulPathDispatcher(
 	}
 	dispatcher.cfg = cfg
 	dispatcher.mux = httprouter.New()
+	dispatcher.mux.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
 	dispatcher.log = log
 	dispatcher.prx = prx
+	dispatcher.verifier = verifier
+	dispatcher.backends = make(map[string]*proxy.BackendSelector)
 	dispatcher.behaviors = make([]Behavior, 0, 8)
 
 	return dispatcher, nil
 }
 
 func (c *consulPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
-	routes := make(map[string]httprouter.Handle)
-
-	backendUrl := appCfg.Backend.Url
-	if backendUrl == "" && appCfg.Backend.Service != "" {
-		if appCfg.Backend.Tag != "" {
-			backendUrl = fmt.Sprintf("http://%s.%s.service.consul", appCfg.Backend.Tag, appCfg.Backend.Service)
-		} else {
-			backendUrl = fmt.Sprintf("http://%s.service.consul", appCfg.Backend.Service)
-		}
-	}
-
-	var rewriter proxy.HostRewriter
-
-	if appCfg.Routing.Type == "path" {
-		path := strings.TrimRight(appCfg.Routing.Path, "/")
-		mapping := map[string]string{
-			"/(?P<path>.*)": path + "/:path",
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, c.log)
-
-		closure := new(PathClosure)
-		closure.backendUrl = backendUrl
-		closure.appName = name
-		closure.appCfg = &appCfg
-		closure.proxy = c.prx
-
-		routes[path] = closure.Handle
-		routes[path+"/*path"] = closure.Handle
-	} else if appCfg.Routing.Type == "pattern" {
-		re := regexp.MustCompile(":([a-zA-Z0-9]+)")
-		mapping := make(map[string]string)
-
-		for pattern, target := range appCfg.Routing.Patterns {
-			targetPattern := "^" + re.ReplaceAllString(target, "(?P<$1>[^/]+?)") + "$"
-			mapping[targetPattern] = pattern
-
-			parameters := re.FindAllStringSubmatch(pattern, -1)
-
-			closure := new(PatternClosure)
-			closure.targetUrl = backendUrl + target
-			closure.parameters = parameters
-			closure.appName = name
-			closure.appCfg = &appCfg
-			closure.proxy = c.prx
-
-			routes[pattern] = closure.Handle
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, c.log)
+	backends, err := c.newBackends(name, &appCfg.Backend)
+	if err != nil {
+		return err
 	}
 
-	for route, handler := range routes {
-		handler = rewriter.Decorate(handler)
-
-		safeHandler := handler
-		unsafeHandler := handler
-
-		for _, behavior := range c.behaviors {
-			var err error
-			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, c, name, &appCfg, config)
-			if err != nil {
-				return err
-			}
-		}
-
-		c.mux.GET(route, safeHandler)
-		c.mux.HEAD(route, safeHandler)
-		c.mux.POST(route, unsafeHandler)
-		c.mux.PUT(route, unsafeHandler)
-		c.mux.PATCH(route, unsafeHandler)
-		c.mux.DELETE(route, unsafeHandler)
-
-		// Register a dedicated OPTIONS handler if it was enabled.
-		// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
-		if c.cfg.Proxy.OptionsConfiguration.Enabled {
-			c.mux.OPTIONS(route, c.buildOptionsHandler(safeHandler))
-		} else {
-			c.mux.OPTIONS(route, safeHandler)
-		}
+	routes, rewriter, err := buildRoutes(name, &appCfg, backends, c.prx, c.log)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.registerRoutes(c, name, routes, rewriter, config)
 }
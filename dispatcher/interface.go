@@ -20,9 +20,11 @@ package dispatcher
  */
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/proxy"
 	"github.com/op/go-logging"
@@ -33,6 +35,7 @@ type Dispatcher interface {
 	RegisterApplication(string, config.Application, *config.Configuration) error
 	Initialize() error
 	AddBehaviour(...Behavior)
+	Backends(string) *proxy.BackendSelector
 }
 
 type Behavior interface {
@@ -51,6 +54,9 @@ type abstractDispatcher struct {
 	prx *proxy.ProxyHandler
 	log *logging.Logger
 
+	verifier *auth.JwtVerifier
+	backends map[string]*proxy.BackendSelector
+
 	behaviors []Behavior
 }
 
@@ -61,3 +67,20 @@ func (d *abstractDispatcher) setProxy(p *proxy.ProxyHandler) {
 func (d *abstractDispatcher) AddBehaviour(behaviors ...Behavior) {
 	d.behaviors = append(d.behaviors, behaviors...)
 }
+
+// Backends returns the backend selector of a registered application.
+func (d *abstractDispatcher) Backends(appName string) *proxy.BackendSelector {
+	return d.backends[appName]
+}
+
+// newBackends compiles the backend configuration of an application and
+// remembers it for the behaviours.
+func (d *abstractDispatcher) newBackends(appName string, cfg *config.Backend) (*proxy.BackendSelector, error) {
+	backends, err := proxy.NewBackendSelector(appName, cfg, d.verifier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend configuration of application %s: %s", appName, err)
+	}
+
+	d.backends[appName] = backends
+	return backends, nil
+}
@@ -10,13 +10,15 @@ import (
 	"github.com/mittwald/servicegateway/cache"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
 	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/mittwald/servicegateway/tracing"
 	"github.com/op/go-logging"
 
 	"net/http"
-	"regexp"
-	"strings"
 )
 
 func BuildNoIntegrationDispatcher(
@@ -28,6 +30,8 @@ func BuildNoIntegrationDispatcher(
 	tokenStore auth.TokenStore,
 	tokenVerifier *auth.JwtVerifier,
 	httpLoggers []httplogging.HttpLogger,
+	metrics *monitoring.PromMetrics,
+	tracer *tracing.Tracing,
 ) (http.Handler, http.Handler, error) {
 	var disp Dispatcher
 	var err error
@@ -37,7 +41,7 @@ func BuildNoIntegrationDispatcher(
 
 	switch startup.DispatchingMode {
 	case "path":
-		disp, err = buildNoIntegrationPathDispatcher(&localCfg, dispLogger, handler)
+		disp, err = buildNoIntegrationPathDispatcher(&localCfg, dispLogger, handler, tokenVerifier)
 	default:
 		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
 	}
@@ -46,7 +50,7 @@ func BuildNoIntegrationDispatcher(
 		return nil, nil, fmt.Errorf("error while creating proxy builder: %s", err)
 	}
 
-	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, rpool, tokenStore, tokenVerifier, logger)
+	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, &localCfg.Scripting, rpool, tokenStore, tokenVerifier, logger, metrics)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -56,18 +60,24 @@ func BuildNoIntegrationDispatcher(
 		return nil, nil, err
 	}
 
-	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"))
+	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"), metrics)
 	if err != nil {
 		logger.Fatalf("error while configuring rate limiting: %s", err)
 	}
 
-	cch := cache.NewCache(4096)
+	cch := cache.NewCache(4096, metrics)
 
 	// Order is important here! Behaviors will be called in LIFO order;
 	// behaviors that are added last will be called first!
 	disp.AddBehaviour(NewCachingBehaviour(cch))
+	disp.AddBehaviour(NewBackendBehaviour())
+	disp.AddBehaviour(NewScriptingBehaviour(tokenVerifier, logging.MustGetLogger("scripting"), metrics))
 	disp.AddBehaviour(NewAuthenticationBehaviour(authDecorator))
 	disp.AddBehaviour(NewRatelimitBehaviour(rlim))
+	disp.AddBehaviour(NewCORSBehaviour())
+	disp.AddBehaviour(NewMetricsBehaviour(metrics))
+	disp.AddBehaviour(NewTracingBehaviour(tracer))
+	disp.AddBehaviour(NewHeadersBehaviour(tokenVerifier))
 
 	for name, appCfg := range localCfg.Applications {
 		logger.Infof("registering application '%s' from local config", name)
@@ -97,12 +107,18 @@ func BuildNoIntegrationDispatcher(
 			authDecorator.RegisterRequestListener(listener)
 		}
 
+		if listener, ok := httpLogger.(auth.LockoutListener); ok && authHandler.Lockout() != nil {
+			authHandler.Lockout().RegisterListener(listener)
+		}
+
 		server, err = httpLogger.Wrap(server)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	server = requestid.NewHandler(requestinfo.NewHandler(server))
+
 	return server, adminServer, nil
 }
 
@@ -114,6 +130,7 @@ func buildNoIntegrationPathDispatcher(
 	cfg *config.Configuration,
 	log *logging.Logger,
 	prx *proxy.ProxyHandler,
+	verifier *auth.JwtVerifier,
 ) (*noIntegrationPathDispatcher, error) {
 	dispatcher := &noIntegrationPathDispatcher{
 		abstractPathBasedDispatcher: &abstractPathBasedDispatcher{
@@ -122,95 +139,26 @@ func buildNoIntegrationPathDispatcher(
 	}
 	dispatcher.cfg = cfg
 	dispatcher.mux = httprouter.New()
+	dispatcher.mux.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
 	dispatcher.log = log
 	dispatcher.prx = prx
+	dispatcher.verifier = verifier
+	dispatcher.backends = make(map[string]*proxy.BackendSelector)
 	dispatcher.behaviors = make([]Behavior, 0, 8)
 
 	return dispatcher, nil
 }
 
 func (n *noIntegrationPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
-	routes := make(map[string]httprouter.Handle)
-
-	backendUrl := appCfg.Backend.Url
-	if backendUrl == "" && appCfg.Backend.Service != "" {
-		if appCfg.Backend.Tag != "" {
-			backendUrl = fmt.Sprintf("http://%s.%s.service.consul", appCfg.Backend.Tag, appCfg.Backend.Service)
-		} else {
-			backendUrl = fmt.Sprintf("http://%s.service.consul", appCfg.Backend.Service)
-		}
-	}
-
-	var rewriter proxy.HostRewriter
-
-	if appCfg.Routing.Type == "path" {
-		path := strings.TrimRight(appCfg.Routing.Path, "/")
-		mapping := map[string]string{
-			"/(?P<path>.*)": path + "/:path",
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, n.log)
-
-		closure := new(PathClosure)
-		closure.backendUrl = backendUrl
-		closure.appName = name
-		closure.appCfg = &appCfg
-		closure.proxy = n.prx
-
-		routes[path] = closure.Handle
-		routes[path+"/*path"] = closure.Handle
-	} else if appCfg.Routing.Type == "pattern" {
-		re := regexp.MustCompile(":([a-zA-Z0-9]+)")
-		mapping := make(map[string]string)
-
-		for pattern, target := range appCfg.Routing.Patterns {
-			targetPattern := "^" + re.ReplaceAllString(target, "(?P<$1>[^/]+?)") + "$"
-			mapping[targetPattern] = pattern
-
-			parameters := re.FindAllStringSubmatch(pattern, -1)
-
-			closure := new(PatternClosure)
-			closure.targetUrl = backendUrl + target
-			closure.parameters = parameters
-			closure.appName = name
-			closure.appCfg = &appCfg
-			closure.proxy = n.prx
-
-			routes[pattern] = closure.Handle
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, n.log)
+	backends, err := n.newBackends(name, &appCfg.Backend)
+	if err != nil {
+		return err
 	}
 
-	for route, handler := range routes {
-		handler = rewriter.Decorate(handler)
-
-		safeHandler := handler
-		unsafeHandler := handler
-
-		for _, behavior := range n.behaviors {
-			var err error
-			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, n, name, &appCfg, config)
-			if err != nil {
-				return err
-			}
-		}
-
-		n.mux.GET(route, safeHandler)
-		n.mux.HEAD(route, safeHandler)
-		n.mux.POST(route, unsafeHandler)
-		n.mux.PUT(route, unsafeHandler)
-		n.mux.PATCH(route, unsafeHandler)
-		n.mux.DELETE(route, unsafeHandler)
-
-		// Register a dedicated OPTIONS handler if it was enabled.
-		// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
-		if n.cfg.Proxy.OptionsConfiguration.Enabled {
-			n.mux.OPTIONS(route, n.buildOptionsHandler(safeHandler))
-		} else {
-			n.mux.OPTIONS(route, safeHandler)
-		}
+	routes, rewriter, err := buildRoutes(name, &appCfg, backends, n.prx, n.log)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return n.registerRoutes(n, name, routes, rewriter, config)
 }
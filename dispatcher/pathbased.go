@@ -25,10 +25,14 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
 
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
 )
 
@@ -36,19 +40,14 @@ type abstractPathBasedDispatcher struct {
 	abstractDispatcher
 }
 
-type PatternClosure struct {
-	targetUrl  string
-	parameters [][]string
-	appName    string
-	appCfg     *config.Application
-	proxy      *proxy.ProxyHandler
-}
-
-type PathClosure struct {
-	backendUrl string
-	appName    string
-	appCfg     *config.Application
-	proxy      *proxy.ProxyHandler
+// RouteClosure proxies the requests to a route to the upstream URL that the
+// route's rewriter maps them to.
+type RouteClosure struct {
+	backends *proxy.BackendSelector
+	rewriter *proxy.Rewriter
+	appName  string
+	appCfg   *config.Application
+	proxy    *proxy.ProxyHandler
 }
 
 func (d *abstractPathBasedDispatcher) ServeHTTP(res http.ResponseWriter, req *http.Request) {
@@ -59,53 +58,270 @@ func (d *abstractPathBasedDispatcher) ServeHTTP(res http.ResponseWriter, req *ht
 	d.mux.ServeHTTP(res, req)
 }
 
-func (p *PatternClosure) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	targetUrl := p.targetUrl
-	for _, paramName := range p.parameters {
-		targetUrl = strings.Replace(targetUrl, paramName[0], params.ByName(paramName[1]), -1)
+func (r *RouteClosure) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	target, ok := r.rewriter.Rewrite(req, params)
+	if !ok {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		_, _ = rw.Write([]byte(fmt.Sprintf(`{"msg":"not found","request_id":"%s"}`, requestid.FromRequest(req))))
+		return
+	}
+
+	backend, backendUrl := r.backends.Select(rw, req)
+	requestinfo.Get(req).Backend = backend
+
+	upstream, err := proxy.UpstreamURL(backendUrl, target)
+	if err != nil {
+		r.proxy.UnavailableError(rw, req, r.appName)
+		return
 	}
 
-	p.proxy.HandleProxyRequest(rw, req, targetUrl, p.appName, p.appCfg)
+	r.proxy.HandleProxyRequest(rw, req, upstream.String(), r.appName, r.appCfg)
 }
 
-func (p *PathClosure) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	sanitizedPath := strings.Replace(req.URL.Path, p.appCfg.Routing.Path, "", 1)
-	proxyUrl := p.backendUrl + sanitizedPath
+var (
+	defaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	safeMethods    = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true}
+)
 
-	p.proxy.HandleProxyRequest(rw, req, proxyUrl, p.appName, p.appCfg)
+// route is a path pattern of an application, with the methods it accepts
+// and the application configuration that applies to it.
+type route struct {
+	pattern string
+	methods []string
+	app     *config.Application
+	handler httprouter.Handle
 }
 
-func (d *abstractPathBasedDispatcher) buildOptionsHandler(inner httprouter.Handle) httprouter.Handle {
-	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		recorder := httptest.NewRecorder()
+// buildRoutes returns the routes of an application and the host rewriter that
+// maps the upstream URLs of the routes back to public URLs.
+func buildRoutes(name string, appCfg *config.Application, backends *proxy.BackendSelector, prx *proxy.ProxyHandler, log *logging.Logger) ([]route, proxy.HostRewriter, error) {
+	if err := prx.ValidateBackend(&appCfg.Backend); err != nil {
+		return nil, nil, fmt.Errorf("invalid TLS configuration of backend of application %s: %s", name, err)
+	}
 
-		inner(recorder, req, params)
+	routes := make([]route, 0)
+	patterns := make(map[string]bool)
+	mappings := make([]proxy.UrlMapping, 0)
 
-		allow := recorder.Header().Get("Allow")
-		if allow == "" {
-			allow = "GET, POST, PUT, DELETE, PATCH, OPTIONS"
+	addRoute := func(paths []string, rewrite *config.Rewrite, methods []string, app *config.Application) error {
+		rewriter, err := proxy.NewRewriter(rewrite, paths[len(paths)-1])
+		if err != nil {
+			return fmt.Errorf("invalid rewrite of route %s of application %s: %s", paths[len(paths)-1], name, err)
 		}
 
-		if d.cfg.Proxy.OptionsConfiguration.CORS {
-			recorder.Header().Set("Access-Control-Allow-Methods", allow)
+		closure := new(RouteClosure)
+		closure.backends = backends
+		closure.rewriter = rewriter
+		closure.appName = name
+		closure.appCfg = app
+		closure.proxy = prx
 
-			if recorder.Header().Get("Access-Control-Allow-Origin") == "" {
-				recorder.Header().Set("Access-Control-Allow-Origin", "*")
+		for _, pattern := range paths {
+			if patterns[pattern] {
+				return fmt.Errorf("duplicate route %s of application %s", pattern, name)
 			}
+			patterns[pattern] = true
+			routes = append(routes, route{pattern: pattern, methods: methods, app: app, handler: closure.Handle})
+		}
+
+		if m := rewriter.Mapping(); m != nil {
+			mappings = append(mappings, *m)
+		}
+		return nil
+	}
+
+	switch appCfg.Routing.Type {
+	case "path":
+		path := strings.TrimRight(appCfg.Routing.Path, "/")
+
+		// Unless configured otherwise, the path prefix is stripped from
+		// upstream requests.
+		rewrite := config.Rewrite{}
+		if appCfg.Routing.Rewrite != nil {
+			rewrite = *appCfg.Routing.Rewrite
+		}
+		if rewrite.StripPrefix == "" {
+			rewrite.StripPrefix = path
+		}
 
-			if recorder.Header().Get("Access-Control-Allow-Credentials") == "" {
-				recorder.Header().Set("Access-Control-Allow-Credentials", "true")
+		if err := addRoute([]string{path, path + "/*path"}, &rewrite, defaultMethods, appCfg); err != nil {
+			return nil, nil, err
+		}
+	case "pattern":
+		for i := range appCfg.Routing.Routes {
+			r := &appCfg.Routing.Routes[i]
+
+			methods, err := routeMethods(r.Methods)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid route %s of application %s: %s", r.Pattern, name, err)
+			}
+
+			if err := addRoute([]string{r.Pattern}, &r.Rewrite, methods, routeApplication(name, appCfg, r)); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		paths := make([]string, 0, len(appCfg.Routing.Patterns))
+		for pattern := range appCfg.Routing.Patterns {
+			paths = append(paths, pattern)
+		}
+		sort.Strings(paths)
+
+		for _, pattern := range paths {
+			if err := addRoute([]string{pattern}, &config.Rewrite{Target: appCfg.Routing.Patterns[pattern]}, defaultMethods, appCfg); err != nil {
+				return nil, nil, err
 			}
+		}
+	default:
+		log.Warningf("unsupported routing type '%s' for application '%s'; not registering any routes", appCfg.Routing.Type, name)
+	}
+
+	rewriter, err := proxy.NewHostRewriter(backends.URLs(), mappings, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return routes, rewriter, nil
+}
+
+// routeMethods returns the methods that a route accepts. HEAD is accepted
+// along with GET; OPTIONS requests are always accepted.
+func routeMethods(methods []string) ([]string, error) {
+	if len(methods) == 0 {
+		return defaultMethods, nil
+	}
+
+	result := make([]string, 0, len(methods)+1)
+	seen := make(map[string]bool)
+
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, fmt.Errorf("invalid method '%s'", method)
+		}
+
+		if method == "OPTIONS" || seen[method] {
+			continue
+		}
+
+		seen[method] = true
+		result = append(result, method)
+	}
 
-			if recorder.Header().Get("Access-Control-Allow-Headers") == "" {
-				recorder.Header().Set("Access-Control-Allow-Headers", "X-Requested-With, Authorization")
+	if seen["GET"] && !seen["HEAD"] {
+		result = append(result, "HEAD")
+	}
+
+	return result, nil
+}
+
+// routeApplication returns the configuration of an application, with the
+// overrides of one of its routes applied.
+func routeApplication(name string, app *config.Application, r *config.Route) *config.Application {
+	if r.Caching == nil && r.Auth == nil && r.RateLimiting == nil && r.RateLimit == nil {
+		return app
+	}
+
+	routeApp := *app
+
+	if r.Caching != nil {
+		routeApp.Caching = *r.Caching
+	}
+
+	if r.Auth != nil {
+		routeApp.Auth = *r.Auth
+	}
+
+	if r.RateLimiting != nil {
+		routeApp.RateLimiting = *r.RateLimiting
+	}
+
+	// A route with its own rate limit counts requests in its own bucket,
+	// unless configured otherwise.
+	if r.RateLimit != nil && (r.RateLimiting == nil || *r.RateLimiting) {
+		limit := *r.RateLimit
+		if limit.Bucket == "" {
+			limit.Bucket = name + ":" + r.Pattern
+		}
+		routeApp.RateLimit = &limit
+	} else if !routeApp.RateLimiting {
+		routeApp.RateLimit = nil
+	}
+
+	return &routeApp
+}
+
+// registerRoutes applies the dispatcher's behaviours to the routes of an
+// application and registers them with the router.
+func (d *abstractPathBasedDispatcher) registerRoutes(disp Dispatcher, name string, routes []route, rewriter proxy.HostRewriter, cfg *config.Configuration) error {
+	for _, r := range routes {
+		handler := rewriter.Decorate(r.handler)
+
+		safeHandler := handler
+		unsafeHandler := handler
+
+		for _, behavior := range d.behaviors {
+			var err error
+			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, disp, name, r.app, cfg)
+			if err != nil {
+				return err
 			}
+		}
+
+		safeHandler = withRequestInfo(safeHandler, name, r.pattern)
+		unsafeHandler = withRequestInfo(unsafeHandler, name, r.pattern)
 
-			if recorder.Header().Get("Access-Control-Max-Age") == "" {
-				recorder.Header().Set("Access-Control-Max-Age", "86400")
+		for _, method := range r.methods {
+			if safeMethods[method] {
+				d.mux.Handle(method, r.pattern, safeHandler)
+			} else {
+				d.mux.Handle(method, r.pattern, unsafeHandler)
 			}
 		}
 
+		// Register a dedicated OPTIONS handler if it was enabled.
+		// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
+		if d.cfg.Proxy.OptionsConfiguration.Enabled {
+			d.mux.OPTIONS(r.pattern, d.buildOptionsHandler(safeHandler))
+		} else {
+			d.mux.OPTIONS(r.pattern, safeHandler)
+		}
+	}
+
+	return nil
+}
+
+// methodNotAllowed answers requests with methods that a route does not
+// accept. The router has already set the Allow header.
+func methodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+	_, _ = rw.Write([]byte(fmt.Sprintf(`{"msg":"method not allowed","request_id":"%s"}`, requestid.FromRequest(req))))
+}
+
+// withRequestInfo records the application and route that served a request.
+func withRequestInfo(handler httprouter.Handle, appName string, route string) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		info := requestinfo.Get(req)
+		info.Application = appName
+		info.Route = route
+
+		handler(rw, req, params)
+	}
+}
+
+func (d *abstractPathBasedDispatcher) buildOptionsHandler(inner httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		recorder := httptest.NewRecorder()
+
+		inner(recorder, req, params)
+
+		allow := recorder.Header().Get("Allow")
+		if allow == "" {
+			allow = "GET, POST, PUT, DELETE, PATCH, OPTIONS"
+		}
+
 		for key, values := range recorder.Header() {
 			for _, value := range values {
 				rw.Header().Add(key, value)
@@ -116,7 +332,7 @@ func (d *abstractPathBasedDispatcher) buildOptionsHandler(inner httprouter.Handl
 
 		_, err := io.Copy(rw, recorder.Body)
 		if err != nil {
-			d.log.Errorf("error while reading response body: %s", err)
+			requestid.NewLogger(req.Context(), d.log).Errorf("error while reading response body: %s", err)
 			rw.WriteHeader(500)
 			contentLength, _ := rw.Write([]byte(`{"msg":"internal server error"}`))
 			rw.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
@@ -0,0 +1,251 @@
+package dispatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestMetrics() *monitoring.PromMetrics {
+	return &monitoring.PromMetrics{
+		TotalResponseTimes:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "total"}, []string{"application"}),
+		UpstreamResponseTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "upstream"}, []string{"application"}),
+		BackendResponseTimes:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "backend"}, []string{"application", "backend"}),
+		BackendResponses:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "responses"}, []string{"application", "backend", "status_class"}),
+		Errors:                prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"application", "reason"}),
+	}
+}
+
+// newTestDispatcher registers an application with pattern routes without
+// any behaviours. The backend answers with the method and URL it received.
+func newTestDispatcher(t *testing.T, routing config.Routing) http.Handler {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Upstream", req.Method+" "+req.URL.RequestURI())
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := config.Configuration{}
+	logger := logging.MustGetLogger("test")
+
+	disp, err := buildNoIntegrationPathDispatcher(&cfg, logger, proxy.NewProxyHandler(logger, &cfg, newTestMetrics()), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	app := config.Application{Routing: routing, Backend: config.Backend{Url: backend.URL}}
+	if err := disp.RegisterApplication("users", app, &cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return requestinfo.NewHandler(disp)
+}
+
+func TestPatternRoutes(t *testing.T) {
+	disp := newTestDispatcher(t, config.Routing{
+		Type: "pattern",
+		Routes: []config.Route{
+			{Pattern: "/users/:id", Methods: []string{"get"}, Rewrite: config.Rewrite{Target: "/v2/users/:id"}},
+			{Pattern: "/users", Methods: []string{"POST"}},
+		},
+		Patterns: map[string]string{"/groups/:id": "/v1/groups/:id"},
+	})
+
+	cases := []struct {
+		method   string
+		path     string
+		status   int
+		upstream string
+		allow    string
+	}{
+		{"GET", "/users/42?x=1", 200, "GET /v2/users/42?x=1", ""},
+		{"HEAD", "/users/42", 200, "HEAD /v2/users/42", ""},
+		{"DELETE", "/users/42", 405, "", "GET, HEAD, OPTIONS"},
+		{"POST", "/users", 200, "POST /users", ""},
+		{"GET", "/users", 405, "", "OPTIONS, POST"},
+		{"DELETE", "/groups/1", 200, "DELETE /v1/groups/1", ""},
+		{"GET", "/unknown", 404, "", ""},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		disp.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, rec.Code)
+		}
+		if upstream := rec.Header().Get("X-Upstream"); upstream != c.upstream {
+			t.Errorf("%s %s: expected upstream request %q, got %q", c.method, c.path, c.upstream, upstream)
+		}
+		if allow := rec.Header().Get("Allow"); allow != c.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", c.method, c.path, c.allow, allow)
+		}
+	}
+}
+
+func TestPatternRoutesRejectDuplicates(t *testing.T) {
+	cfg := config.Configuration{}
+	logger := logging.MustGetLogger("test")
+
+	disp, _ := buildNoIntegrationPathDispatcher(&cfg, logger, proxy.NewProxyHandler(logger, &cfg, nil), nil)
+
+	app := config.Application{
+		Routing: config.Routing{Type: "pattern", Routes: []config.Route{{Pattern: "/users"}, {Pattern: "/users"}}},
+		Backend: config.Backend{Url: "http://backend"},
+	}
+
+	if err := disp.RegisterApplication("users", app, &cfg); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRegisterApplicationRejectsInvalidBackendTLS(t *testing.T) {
+	cfg := config.Configuration{}
+	logger := logging.MustGetLogger("test")
+
+	disp, _ := buildNoIntegrationPathDispatcher(&cfg, logger, proxy.NewProxyHandler(logger, &cfg, nil), nil)
+
+	app := config.Application{
+		Routing: config.Routing{Type: "path", Path: "/users"},
+		Backend: config.Backend{Url: "https://backend", TLS: config.BackendTLS{CA: "/nonexistent/ca.pem"}},
+	}
+
+	if err := disp.RegisterApplication("users", app, &cfg); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCachingWithSeveralBackends(t *testing.T) {
+	newBackend := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Upstream", name)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	cfg := config.Configuration{}
+	logger := logging.MustGetLogger("test")
+
+	disp, _ := buildNoIntegrationPathDispatcher(&cfg, logger, proxy.NewProxyHandler(logger, &cfg, newTestMetrics()), nil)
+	disp.AddBehaviour(NewCachingBehaviour(cache.NewCache(16, nil)))
+	disp.AddBehaviour(NewBackendBehaviour())
+
+	app := config.Application{
+		Routing: config.Routing{Type: "path", Path: "/users"},
+		Backend: config.Backend{
+			Targets: []config.BackendTarget{
+				{Name: "stable", Url: newBackend("stable"), Weight: 1},
+				{Name: "canary", Url: newBackend("canary")},
+			},
+			Rules:  []config.BackendRule{{Header: "X-Canary", Target: "canary"}},
+			Sticky: &config.BackendSticky{},
+		},
+		Caching: config.Caching{Enabled: true, Ttl: 60},
+	}
+	if err := disp.RegisterApplication("users", app, &cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	handler := requestinfo.NewHandler(disp)
+
+	cases := []struct {
+		canary   bool
+		upstream string
+		cache    string
+	}{
+		{false, "stable", "MISS"},
+		{false, "stable", "HIT"},
+		{true, "canary", "MISS"},
+		{true, "canary", "HIT"},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/users", nil)
+		if c.canary {
+			req.Header.Set("X-Canary", "1")
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if upstream := rec.Header().Get("X-Upstream"); upstream != c.upstream || rec.Header().Get("X-Cache") != c.cache {
+			t.Errorf("request %d: expected %s response from %s, got %s from %s", i, c.cache, c.upstream, rec.Header().Get("X-Cache"), upstream)
+		}
+
+		// Only clients assigned by weight get the sticky cookie, and never
+		// one that was replayed from the cache.
+		cookies := rec.Result().Cookies()
+		if expected := map[bool]int{false: 1, true: 0}[c.canary]; len(cookies) != expected {
+			t.Errorf("request %d: expected %d cookies, got %v", i, expected, cookies)
+		}
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	cases := []struct {
+		methods  []string
+		expected []string
+	}{
+		{nil, defaultMethods},
+		{[]string{"get", "GET", "options"}, []string{"GET", "HEAD"}},
+		{[]string{"HEAD", "get"}, []string{"HEAD", "GET"}},
+		{[]string{"post", "Delete"}, []string{"POST", "DELETE"}},
+	}
+
+	for _, c := range cases {
+		if methods, err := routeMethods(c.methods); err != nil || !reflect.DeepEqual(methods, c.expected) {
+			t.Errorf("%v: expected %v, got %v (%v)", c.methods, c.expected, methods, err)
+		}
+	}
+
+	for _, method := range []string{"", "GET POST", "a/b"} {
+		if _, err := routeMethods([]string{method}); err == nil {
+			t.Errorf("%q: expected an error", method)
+		}
+	}
+}
+
+func TestRouteApplication(t *testing.T) {
+	app := &config.Application{
+		Caching:      config.Caching{Enabled: true, Ttl: 60},
+		RateLimiting: true,
+		RateLimit:    &config.RateLimiting{Burst: 100, Window: "1m"},
+	}
+
+	if routeApplication("users", app, &config.Route{Pattern: "/users"}) != app {
+		t.Error("expected route without overrides to use the application configuration")
+	}
+
+	routeApp := routeApplication("users", app, &config.Route{
+		Pattern:   "/users/:id",
+		Caching:   &config.Caching{},
+		Auth:      &config.ApplicationAuth{Disable: true},
+		RateLimit: &config.RateLimiting{Burst: 5, Window: "1m"},
+	})
+
+	if routeApp.Caching.Enabled || !routeApp.Auth.Disable {
+		t.Errorf("expected caching and authentication to be overridden, got %+v", routeApp)
+	}
+	if routeApp.RateLimit.Burst != 5 || routeApp.RateLimit.Bucket != "users:/users/:id" {
+		t.Errorf("expected route to have its own rate limit bucket, got %+v", routeApp.RateLimit)
+	}
+	if !app.Caching.Enabled || app.RateLimit.Burst != 100 {
+		t.Errorf("expected application configuration to be unchanged, got %+v", app)
+	}
+
+	disabled := false
+	if routeApp := routeApplication("users", app, &config.Route{RateLimiting: &disabled}); routeApp.RateLimiting {
+		t.Error("expected rate limiting to be disabled for the route")
+	}
+}
@@ -0,0 +1,344 @@
+// Package headers implements per-application header policies. A policy strips
+// headers from client requests, and renames, copies, removes, sets and adds
+// headers of the requests forwarded to an application and of its responses.
+package headers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+)
+
+type contextKey struct{}
+
+var placeholder = regexp.MustCompile(`\{([a-z_]+)(?::([^{}]+))?\}`)
+
+type Policy struct {
+	strip    []string
+	request  rules
+	response rules
+	verifier *auth.JwtVerifier
+}
+
+type rules struct {
+	rename [][2]string
+	copy   [][2]string
+	remove []string
+	set    []header
+	add    []header
+}
+
+type header struct {
+	name  string
+	value template
+}
+
+// template is a header value, split into literal text and placeholders.
+type template []segment
+
+type segment struct {
+	literal string
+	name    string
+	arg     string
+}
+
+// requestState is the policy that applies to a request, together with the
+// route parameters of the request.
+type requestState struct {
+	policy *Policy
+	params httprouter.Params
+	claims map[string]interface{}
+}
+
+// NewPolicy compiles a header policy. The verifier is used to decode the
+// claims of the authenticated user for {claim:...} placeholders.
+func NewPolicy(cfg *config.HeaderPolicy, verifier *auth.JwtVerifier) (*Policy, error) {
+	p := Policy{verifier: verifier}
+
+	for _, name := range cfg.StripRequest {
+		p.strip = append(p.strip, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+
+	if p.request, err = compileRules(&cfg.Request); err != nil {
+		return nil, fmt.Errorf("invalid request header rules: %s", err)
+	}
+
+	if p.response, err = compileRules(&cfg.Response); err != nil {
+		return nil, fmt.Errorf("invalid response header rules: %s", err)
+	}
+
+	return &p, nil
+}
+
+// ApplicationPolicy returns the header policy of an application, or nil if it
+// has none.
+func ApplicationPolicy(app *config.Application, verifier *auth.JwtVerifier) (*Policy, error) {
+	if app.Headers == nil {
+		return nil, nil
+	}
+
+	return NewPolicy(app.Headers, verifier)
+}
+
+func compileRules(cfg *config.HeaderRules) (rules, error) {
+	r := rules{
+		rename: sortedPairs(cfg.Rename),
+		copy:   sortedPairs(cfg.Copy),
+	}
+
+	for _, name := range cfg.Remove {
+		r.remove = append(r.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+
+	if r.set, err = compileHeaders(cfg.Set); err != nil {
+		return r, err
+	}
+
+	if r.add, err = compileHeaders(cfg.Add); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// sortedPairs returns the entries of a map ordered by key, so that rules are
+// applied in the same order on every request.
+func sortedPairs(m map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(m))
+	for from, to := range m {
+		pairs = append(pairs, [2]string{http.CanonicalHeaderKey(from), http.CanonicalHeaderKey(to)})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	return pairs
+}
+
+func compileHeaders(m map[string]string) ([]header, error) {
+	headers := make([]header, 0, len(m))
+	for name, value := range m {
+		t, err := compileTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %s", name, err)
+		}
+		headers = append(headers, header{name: http.CanonicalHeaderKey(name), value: t})
+	}
+
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	return headers, nil
+}
+
+func compileTemplate(value string) (template, error) {
+	var t template
+	last := 0
+
+	for _, m := range placeholder.FindAllStringSubmatchIndex(value, -1) {
+		if m[0] > last {
+			t = append(t, segment{literal: value[last:m[0]]})
+		}
+
+		s := segment{name: value[m[2]:m[3]]}
+		if m[4] >= 0 {
+			s.arg = value[m[4]:m[5]]
+		}
+
+		switch s.name {
+		case "client_ip", "request_id":
+			if s.arg != "" {
+				return nil, fmt.Errorf("placeholder {%s} takes no argument", s.name)
+			}
+		case "claim", "param":
+			if s.arg == "" {
+				return nil, fmt.Errorf("placeholder {%s} needs an argument, like {%s:name}", s.name, s.name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s}", s.name)
+		}
+
+		t = append(t, s)
+		last = m[1]
+	}
+
+	if last < len(value) {
+		t = append(t, segment{literal: value[last:]})
+	}
+
+	return t, nil
+}
+
+// DecorateHandler strips the configured headers from client requests and
+// attaches the policy to the request, so that the proxy can apply the request
+// rules. The response rules are applied here, outside of the response cache,
+// since their values may differ between requests.
+func (p *Policy) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		for _, name := range p.strip {
+			req.Header.Del(name)
+		}
+
+		state := &requestState{policy: p, params: params}
+		req = req.WithContext(context.WithValue(req.Context(), contextKey{}, state))
+
+		w := &responseWriter{ResponseWriter: rw, state: state, req: req}
+		handler(w, req, params)
+
+		// Handlers that do not write anything respond with an implicit 200.
+		if !w.wroteHeader && !w.hijacked {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// ApplyRequest applies the request rules of the policy attached to req (if
+// any) to the headers of the upstream request.
+func ApplyRequest(req *http.Request, upstream http.Header) {
+	if state, ok := req.Context().Value(contextKey{}).(*requestState); ok {
+		state.apply(&state.policy.request, req, upstream)
+	}
+}
+
+func (s *requestState) apply(r *rules, req *http.Request, h http.Header) {
+	for _, pair := range r.rename {
+		if values := h.Values(pair[0]); len(values) > 0 {
+			values = append([]string(nil), values...)
+			h.Del(pair[0])
+			h[pair[1]] = values
+		}
+	}
+
+	for _, pair := range r.copy {
+		if values := h.Values(pair[0]); len(values) > 0 {
+			h[pair[1]] = append([]string(nil), values...)
+		}
+	}
+
+	for _, name := range r.remove {
+		h.Del(name)
+	}
+
+	// Headers whose value renders empty (like a claim the user does not
+	// have) are left out instead of being sent without a value.
+	for _, hdr := range r.set {
+		if value := s.render(hdr.value, req); value != "" {
+			h.Set(hdr.name, value)
+		} else {
+			h.Del(hdr.name)
+		}
+	}
+
+	for _, hdr := range r.add {
+		if value := s.render(hdr.value, req); value != "" {
+			h.Add(hdr.name, value)
+		}
+	}
+}
+
+func (s *requestState) render(t template, req *http.Request) string {
+	var b strings.Builder
+
+	for _, seg := range t {
+		switch seg.name {
+		case "":
+			b.WriteString(seg.literal)
+		case "client_ip":
+			if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				b.WriteString(ip)
+			} else {
+				b.WriteString(req.RemoteAddr)
+			}
+		case "request_id":
+			b.WriteString(requestid.FromRequest(req))
+		case "param":
+			b.WriteString(s.params.ByName(seg.arg))
+		case "claim":
+			b.WriteString(s.claim(req, seg.arg))
+		}
+	}
+
+	return b.String()
+}
+
+// claim returns a claim of the authenticated user. Non-string claims are
+// rendered as JSON.
+func (s *requestState) claim(req *http.Request, name string) string {
+	if s.claims == nil {
+		s.claims = map[string]interface{}{}
+
+		if jwt := requestinfo.Get(req).JWT; jwt != "" && s.policy.verifier != nil {
+			if claims, err := s.policy.verifier.DecodeClaims(jwt); err == nil {
+				s.claims = claims
+			}
+		}
+	}
+
+	switch value := s.claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// responseWriter applies the response rules just before the response headers
+// are written.
+type responseWriter struct {
+	http.ResponseWriter
+	state       *requestState
+	req         *http.Request
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.state.apply(&w.state.policy.response, w.req, w.Header())
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	w.hijacked = true
+	return h.Hijack()
+}
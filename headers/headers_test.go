@@ -0,0 +1,176 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestinfo"
+)
+
+// serve runs a request through the policy like the dispatcher does: the
+// request info is attached outside of all behaviours, authentication stores
+// the token in it, and the proxy applies the rules to the upstream request.
+func serve(t *testing.T, cfg *config.HeaderPolicy, token string, req *http.Request) http.Header {
+	t.Helper()
+
+	verifier, err := auth.NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	policy, err := NewPolicy(cfg, verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	upstream := http.Header{}
+	proxy := policy.DecorateHandler(func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		for name, values := range req.Header {
+			upstream[name] = values
+		}
+		ApplyRequest(req, upstream)
+	})
+
+	authenticate := func(rw http.ResponseWriter, req *http.Request) {
+		requestinfo.Get(req).JWT = token
+		proxy(rw, req, httprouter.Params{{Key: "id", Value: "42"}})
+	}
+
+	requestinfo.NewHandler(http.HandlerFunc(authenticate)).ServeHTTP(httptest.NewRecorder(), req)
+	return upstream
+}
+
+func TestClaimPlaceholdersWithoutLogger(t *testing.T) {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":    "user-1",
+		"groups": []string{"admins"},
+	}).SignedString([]byte("secret"))
+
+	cfg := config.HeaderPolicy{Request: config.HeaderRules{Set: map[string]string{
+		"X-User-Id":     "{claim:sub}",
+		"X-User-Groups": "{claim:groups}",
+		"X-User-Email":  "{claim:email}",
+	}}}
+
+	upstream := serve(t, &cfg, token, httptest.NewRequest("GET", "/", nil))
+
+	if v := upstream.Get("X-User-Id"); v != "user-1" {
+		t.Errorf("expected X-User-Id user-1, got %q", v)
+	}
+	if v := upstream.Get("X-User-Groups"); v != `["admins"]` {
+		t.Errorf(`expected X-User-Groups ["admins"], got %q`, v)
+	}
+	if _, ok := upstream["X-User-Email"]; ok {
+		t.Errorf("expected X-User-Email to be left out for a missing claim")
+	}
+}
+
+func TestRequestRules(t *testing.T) {
+	cfg := config.HeaderPolicy{
+		StripRequest: []string{"x-user-id"},
+		Request: config.HeaderRules{
+			Rename: map[string]string{"X-Old": "X-New"},
+			Copy:   map[string]string{"X-Trace": "X-Trace-Copy"},
+			Remove: []string{"X-Debug"},
+			Set:    map[string]string{"X-Item": "item-{param:id}", "X-Client": "{client_ip}"},
+			Add:    map[string]string{"X-Via": "gateway"},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-User-Id", "spoofed")
+	req.Header.Set("X-Old", "a")
+	req.Header.Set("X-Trace", "b")
+	req.Header.Set("X-Debug", "c")
+	req.Header.Set("X-Via", "proxy")
+
+	upstream := serve(t, &cfg, "", req)
+
+	expected := map[string][]string{
+		"X-User-Id":    nil,
+		"X-Old":        nil,
+		"X-New":        {"a"},
+		"X-Trace":      {"b"},
+		"X-Trace-Copy": {"b"},
+		"X-Debug":      nil,
+		"X-Item":       {"item-42"},
+		"X-Client":     {"192.0.2.1"},
+		"X-Via":        {"proxy", "gateway"},
+	}
+
+	for name, values := range expected {
+		actual := upstream.Values(name)
+		if len(actual) != len(values) {
+			t.Errorf("%s: expected %v, got %v", name, values, actual)
+			continue
+		}
+		for i := range values {
+			if actual[i] != values[i] {
+				t.Errorf("%s: expected %v, got %v", name, values, actual)
+			}
+		}
+	}
+}
+
+func TestResponseRulesOutsideCache(t *testing.T) {
+	verifier, _ := auth.NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+
+	policy, err := NewPolicy(&config.HeaderPolicy{Response: config.HeaderRules{
+		Remove: []string{"X-Internal"},
+		Set:    map[string]string{"X-User-Id": "{claim:sub}"},
+	}}, verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	backend := func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		rw.Header().Set("X-Internal", "1")
+		_, _ = rw.Write([]byte("ok"))
+	}
+	handler := policy.DecorateHandler(cache.NewCache(16, nil).DecorateHandler(backend, "app"))
+
+	for _, user := range []string{"user-1", "user-2"} {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": user}).SignedString([]byte("secret"))
+
+		req, info := requestinfo.New(httptest.NewRequest("GET", "/", nil))
+		info.JWT = token
+
+		rec := httptest.NewRecorder()
+		handler(rec, req, nil)
+
+		if v := rec.Header().Get("X-User-Id"); v != user {
+			t.Errorf("expected X-User-Id %s, got %q (X-Cache %s)", user, v, rec.Header().Get("X-Cache"))
+		}
+		if _, ok := rec.Header()["X-Internal"]; ok {
+			t.Errorf("expected X-Internal to be removed")
+		}
+	}
+}
+
+func TestResponseRulesImplicitStatus(t *testing.T) {
+	policy, _ := NewPolicy(&config.HeaderPolicy{Response: config.HeaderRules{Add: map[string]string{"X-Via": "gateway"}}}, nil)
+
+	rec := httptest.NewRecorder()
+	policy.DecorateHandler(func(http.ResponseWriter, *http.Request, httprouter.Params) {})(rec, httptest.NewRequest("GET", "/", nil), nil)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Via") != "gateway" {
+		t.Errorf("expected 200 with X-Via header, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestInvalidPlaceholders(t *testing.T) {
+	for _, value := range []string{"{unknown}", "{claim}", "{client_ip:x}"} {
+		cfg := config.HeaderPolicy{Response: config.HeaderRules{Set: map[string]string{"X": value}}}
+
+		if _, err := NewPolicy(&cfg, nil); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
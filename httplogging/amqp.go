@@ -1,162 +1,212 @@
 package httplogging
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/mittwald/servicegateway/auth"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/op/go-logging"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type AmqpLoggingBehaviour struct {
-	Config     *config.LoggingConfiguration
-	OnlyUnsafe bool
-
-	logger     *logging.Logger
-	connection *amqp.Connection
-	channel    *amqp.Channel
-	verifier   *auth.JwtVerifier
+	*auditLogger
 }
 
-func NewAmqpLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier) (*AmqpLoggingBehaviour, error) {
-	c := &AmqpLoggingBehaviour{
-		Config:     cfg,
-		OnlyUnsafe: cfg.UnsafeOnly,
-		logger:     logger,
-		verifier:   tokenVerifier,
-	}
-
-	err := c.connect()
+func NewAmqpLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier, metrics *monitoring.PromMetrics) (*AmqpLoggingBehaviour, error) {
+	confirmTimeout, err := cfg.ConfirmTimeoutDuration()
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
-}
-
-func (c *AmqpLoggingBehaviour) connect() error {
-	c.logger.Infof("opening connection to AMQP server: %s", c.Config.Uri)
+	sink := &amqpSink{
+		config:         &cfg.AmqpLoggingConfiguration,
+		logger:         logger,
+		confirmTimeout: confirmTimeout,
+	}
 
-	conn, err := amqp.Dial(c.Config.Uri)
+	l, err := newAuditLogger("amqp", "AMQP server "+cfg.Uri, cfg, sink, logger, tokenVerifier, metrics)
 	if err != nil {
-		return fmt.Errorf("error while dialing RabbitMQ: %s", err)
+		return nil, err
 	}
 
-	c.logger.Infof("opened connection to AMQP server: %s", c.Config.Uri)
-
-	closed := make(chan *amqp.Error)
-	go func() {
-		err := <-closed
+	return &AmqpLoggingBehaviour{auditLogger: l}, nil
+}
 
-		c.logger.Errorf("connection to AMQP server was closed: %s", err)
-		c.logger.Noticef("reconnecting after 5 seconds")
+// amqpSink publishes audit events to an AMQP exchange, using publisher
+// confirms. Events are published as mandatory, so that events that no queue
+// is bound for are returned by the server and count as failed.
+type amqpSink struct {
+	config         *config.AmqpLoggingConfiguration
+	logger         *logging.Logger
+	confirmTimeout time.Duration
 
-		timer := time.NewTimer(5 * time.Second)
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	returns    chan amqp.Return
 
-		go func() {
-			<-timer.C
+	// sequence numbers the published messages, so that returned messages
+	// can be told apart
+	sequence uint64
+}
 
-			c.logger.Errorf("reconnecting after connection error")
-			err := c.connect()
-			if err != nil {
-				c.logger.Errorf("reconnecting after connection error failed: %s", err.Error())
-			}
-		}()
-	}()
+func (s *amqpSink) Connect() (<-chan error, error) {
+	s.logger.Infof("opening connection to AMQP server: %s", s.config.Uri)
 
-	conn.NotifyClose(closed)
+	conn, err := amqp.Dial(s.config.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("error while dialing RabbitMQ: %s", err)
+	}
 
 	channel, err := conn.Channel()
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
-	c.connection = conn
-	c.channel = channel
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error while enabling publisher confirms: %s", err)
+	}
 
-	err = channel.ExchangeDeclare(c.Config.Exchange, "topic", true, false, false, false, amqp.Table{})
+	err = channel.ExchangeDeclare(s.config.Exchange, "topic", true, false, false, false, amqp.Table{})
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
-	return nil
-}
+	s.logger.Infof("opened connection to AMQP server: %s", s.config.Uri)
 
-type AuditLogAuth struct {
-	Sub  string `json:"sub"`
-	Sudo string `json:"sudo,omitempty"`
-	Ip   string `json:"ip"`
-}
+	s.connection = conn
+	s.channel = channel
+	s.returns = channel.NotifyReturn(make(chan amqp.Return, 16))
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	lost := make(chan error, 1)
+
+	go func() {
+		err, ok := <-closed
+		if !ok || err == nil {
+			// the connection was closed deliberately
+			return
+		}
+		lost <- err
+	}()
 
-type AuditLogMessage struct {
-	Auth      AuditLogAuth      `json:"auth"`
-	Action    string            `json:"action"`
-	Timestamp time.Time         `json:"timestamp"`
-	Data      map[string]string `json:"data"`
+	return lost, nil
 }
 
-func (c *AmqpLoggingBehaviour) match(req *http.Request) bool {
-	if c.OnlyUnsafe {
-		return req.Method == "POST" || req.Method == "PATCH" || req.Method == "PUT" || req.Method == "DELETE"
-	} else {
-		return true
+func (s *amqpSink) Publish(events []auditEvent) ([]auditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.confirmTimeout)
+	defer cancel()
+
+	confirmations := make([]*amqp.DeferredConfirmation, 0, len(events))
+	ids := make([]string, 0, len(events))
+
+	var err error
+	for _, event := range events {
+		s.sequence++
+
+		msg := amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    event.Timestamp,
+			ContentType:  "application/json",
+			MessageId:    strconv.FormatUint(s.sequence, 10),
+			Body:         event.Body,
+		}
+
+		var confirmation *amqp.DeferredConfirmation
+		confirmation, err = s.channel.PublishWithDeferredConfirmWithContext(ctx, s.config.Exchange, event.Key, true, false, msg)
+		if err != nil {
+			break
+		}
+		confirmations = append(confirmations, confirmation)
+		ids = append(ids, msg.MessageId)
 	}
-}
 
-func (c *AmqpLoggingBehaviour) OnAuthenticatedRequest(req *http.Request, jwt string) {
-	if c.match(req) {
-		go func(req *http.Request, jwt string) {
-			_, _, mapClaims, err := c.verifier.VerifyToken(jwt)
-			if err != nil {
-				c.logger.Errorf("unable to verify token! Message: '%+v'", err)
-			}
-			var sub string
-			var sudo string
+	returned := make(map[string]bool)
+	results := make([]error, len(confirmations))
 
-			if v, ok := mapClaims["sub"].(string); ok {
-				sub = v
-			}
+	for i, confirmation := range confirmations {
+		results[i] = s.waitForConfirmation(ctx, confirmation, returned)
+	}
 
-			if v, ok := mapClaims["sudo"].(string); ok {
-				sudo = v
-			}
+	// the server returns a message before it confirms it, so all returns of
+	// the confirmed messages have arrived by now
+	s.collectReturns(returned)
 
-			entry := AuditLogMessage{
-				Auth: AuditLogAuth{
-					Sub:  sub,
-					Sudo: sudo,
-					Ip:   req.RemoteAddr,
-				},
-				Action:    "api.request." + strings.ToLower(req.Method),
-				Timestamp: time.Now(),
-				Data: map[string]string{
-					"url": req.URL.String(),
-				},
-			}
+	var failed []auditEvent
+	for i := range confirmations {
+		if results[i] == nil && returned[ids[i]] {
+			results[i] = fmt.Errorf("message was returned by the server; no queue is bound for key %s", events[i].Key)
+		}
 
-			jsonbytes, _ := json.Marshal(&entry)
+		if results[i] != nil {
+			err = results[i]
+			failed = append(failed, events[i])
+		}
+	}
+
+	failed = append(failed, events[len(confirmations):]...)
+
+	return failed, err
+}
 
-			key := "api.request." + strings.ToLower(req.Method)
-			msg := amqp.Publishing{
-				DeliveryMode: amqp.Persistent,
-				Timestamp:    time.Now(),
-				ContentType:  "application/json",
-				Body:         jsonbytes,
+// waitForConfirmation waits for the confirmation of a message, recording the
+// IDs of returned messages in the meantime.
+func (s *amqpSink) waitForConfirmation(ctx context.Context, confirmation *amqp.DeferredConfirmation, returned map[string]bool) error {
+	for {
+		select {
+		case ret, ok := <-s.returns:
+			if !ok {
+				// the channel was closed; the confirmation will not arrive
+				s.returns = nil
+				continue
+			}
+			returned[ret.MessageId] = true
+		case <-confirmation.Done():
+			if !confirmation.Acked() {
+				return fmt.Errorf("message was rejected by the server")
 			}
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("message was not confirmed: %s", ctx.Err())
+		}
+	}
+}
 
-			err = c.channel.Publish(c.Config.Exchange, key, true, false, msg)
-			if err != nil {
-				c.logger.Errorf("publishing message failed! Message: '%+v'", err)
+// collectReturns records the IDs of the returned messages that have not been
+// received yet.
+func (s *amqpSink) collectReturns(returned map[string]bool) {
+	for {
+		select {
+		case ret, ok := <-s.returns:
+			if !ok {
+				s.returns = nil
+				return
 			}
-		}(req, jwt)
+			returned[ret.MessageId] = true
+		default:
+			return
+		}
 	}
 }
 
-func (c *AmqpLoggingBehaviour) Wrap(wrapped http.Handler) (http.Handler, error) {
-	return wrapped, nil
+func (s *amqpSink) Close() error {
+	if s.connection == nil {
+		return nil
+	}
+
+	_ = s.channel.Close()
+	err := s.connection.Close()
+
+	s.connection = nil
+	s.channel = nil
+	s.returns = nil
+
+	return err
 }
@@ -0,0 +1,406 @@
+package httplogging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
+)
+
+// AuditLogSchemaVersion is the version of the AuditLogMessage schema. It is
+// increased on incompatible changes. Messages without a version were created
+// by gateways that emitted audit events before the upstream responded.
+const AuditLogSchemaVersion = 2
+
+const defaultAuditBodyMaxSize = 4096
+
+var defaultAuditClaims = map[string]string{
+	"sub":  "sub",
+	"sudo": "sudo",
+}
+
+var defaultRedactFields = []string{"password"}
+
+type AuditLogAuth struct {
+	Sub    string                 `json:"sub"`
+	Sudo   string                 `json:"sudo,omitempty"`
+	Ip     string                 `json:"ip"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+type AuditLogRequest struct {
+	Method        string          `json:"method"`
+	URL           string          `json:"url"`
+	Application   string          `json:"application,omitempty"`
+	Route         string          `json:"route,omitempty"`
+	UserAgent     string          `json:"user_agent,omitempty"`
+	Body          json.RawMessage `json:"body,omitempty"`
+	BodyTruncated bool            `json:"body_truncated,omitempty"`
+}
+
+type AuditLogResponse struct {
+	Status   int     `json:"status"`
+	Duration float64 `json:"duration_ms"`
+}
+
+type AuditLogMessage struct {
+	Version   int               `json:"version"`
+	Auth      AuditLogAuth      `json:"auth"`
+	Action    string            `json:"action"`
+	Timestamp time.Time         `json:"timestamp"`
+	Data      map[string]string `json:"data"`
+	RequestID string            `json:"request_id,omitempty"`
+	Request   *AuditLogRequest  `json:"request,omitempty"`
+	Response  *AuditLogResponse `json:"response,omitempty"`
+}
+
+// auditor creates audit messages for authenticated requests after they have
+// been answered.
+type auditor struct {
+	verifier *auth.JwtVerifier
+	logger   *logging.Logger
+
+	claims      map[string]string
+	includeBody bool
+	bodyMaxSize int
+	redact      map[string]bool
+}
+
+func newAuditor(cfg *config.AuditConfiguration, verifier *auth.JwtVerifier, logger *logging.Logger) *auditor {
+	a := &auditor{
+		verifier:    verifier,
+		logger:      logger,
+		claims:      make(map[string]string),
+		includeBody: cfg.IncludeBody,
+		bodyMaxSize: cfg.BodyMaxSize,
+		redact:      make(map[string]bool),
+	}
+
+	for field, claim := range defaultAuditClaims {
+		a.claims[field] = claim
+	}
+
+	for field, claim := range cfg.Claims {
+		if claim == "" {
+			delete(a.claims, field)
+		} else {
+			a.claims[field] = claim
+		}
+	}
+
+	if a.bodyMaxSize <= 0 {
+		a.bodyMaxSize = defaultAuditBodyMaxSize
+	}
+
+	redactFields := cfg.RedactFields
+	if redactFields == nil {
+		redactFields = defaultRedactFields
+	}
+
+	for _, field := range redactFields {
+		a.redact[strings.ToLower(field)] = true
+	}
+
+	return a
+}
+
+// auditState is stored in the context of audited requests, so that the
+// authentication decorator can report the token of the request.
+type auditState struct {
+	jwt string
+}
+
+// Wrap calls emit with an audit message for each authenticated request that
+// matches, once the request has been answered.
+func (a *auditor) Wrap(wrapped http.Handler, match func(*http.Request) bool, emit func(*AuditLogMessage)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !match(req) {
+			wrapped.ServeHTTP(rw, req)
+			return
+		}
+
+		started := time.Now()
+		state := &auditState{}
+
+		info := requestinfo.Get(req)
+		req = req.WithContext(context.WithValue(req.Context(), a, state))
+
+		var body *capturingBody
+		if a.includeBody && req.Body != nil && req.Body != http.NoBody {
+			body = &capturingBody{ReadCloser: req.Body, max: a.bodyMaxSize}
+			req.Body = body
+		}
+
+		writer := &loggingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+		wrapped.ServeHTTP(writer, req)
+
+		if state.jwt == "" {
+			return
+		}
+
+		emit(a.message(req, info, state.jwt, body, writer.status, started))
+	})
+}
+
+// Authenticated records the token of an audited request.
+func (a *auditor) Authenticated(req *http.Request, jwt string) {
+	if state, ok := req.Context().Value(a).(*auditState); ok {
+		state.jwt = jwt
+	}
+}
+
+func (a *auditor) message(req *http.Request, info *requestinfo.Info, jwt string, body *capturingBody, status int, started time.Time) *AuditLogMessage {
+	msg := AuditLogMessage{
+		Version:   AuditLogSchemaVersion,
+		Auth:      a.auth(req, jwt),
+		Action:    "api.request." + strings.ToLower(req.Method),
+		Timestamp: started,
+		Data: map[string]string{
+			"url": req.URL.String(),
+		},
+		RequestID: requestid.FromRequest(req),
+		Request: &AuditLogRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			Application: info.Application,
+			Route:       info.Route,
+			UserAgent:   req.UserAgent(),
+		},
+		Response: &AuditLogResponse{
+			Status:   status,
+			Duration: milliseconds(time.Since(started)),
+		},
+	}
+
+	if body != nil {
+		if body.truncated {
+			msg.Request.BodyTruncated = true
+		} else {
+			msg.Request.Body = a.redactBody(body.data)
+		}
+	}
+
+	return &msg
+}
+
+func (a *auditor) auth(req *http.Request, jwt string) AuditLogAuth {
+	result := AuditLogAuth{Ip: req.RemoteAddr}
+
+	claims, err := a.verifier.DecodeClaims(jwt)
+	if err != nil {
+		requestid.NewLogger(req.Context(), a.logger).Errorf("unable to decode token for audit log: %s", err)
+		return result
+	}
+
+	for field, claim := range a.claims {
+		value, ok := claims[claim]
+		if !ok {
+			continue
+		}
+
+		switch field {
+		case "sub":
+			result.Sub, _ = value.(string)
+		case "sudo":
+			result.Sudo, _ = value.(string)
+		default:
+			if result.Claims == nil {
+				result.Claims = make(map[string]interface{})
+			}
+			result.Claims[field] = value
+		}
+	}
+
+	return result
+}
+
+// redactBody replaces the values of redacted fields in a JSON body. Bodies
+// that are not JSON documents are left out of the audit message.
+func (a *auditor) redactBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil
+	}
+
+	redacted, err := json.Marshal(a.redactValue(document))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func (a *auditor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if a.redact[strings.ToLower(key)] {
+				v[key] = "*REDACTED*"
+			} else {
+				v[key] = a.redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = a.redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// capturingBody keeps a copy of the first bytes of a request body while it is
+// read.
+type capturingBody struct {
+	io.ReadCloser
+	max       int
+	data      []byte
+	truncated bool
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if remaining := b.max - len(b.data); n > remaining {
+		b.data = append(b.data, p[:remaining]...)
+		b.truncated = true
+	} else {
+		b.data = append(b.data, p[:n]...)
+	}
+
+	return n, err
+}
+
+// auditLogger publishes audit events (or, optionally, access log entries) to a
+// message broker. It is shared by the loggers of the different brokers.
+type auditLogger struct {
+	Config     *config.LoggingConfiguration
+	OnlyUnsafe bool
+
+	target   string
+	access   bool
+	logger   *logging.Logger
+	verifier *auth.JwtVerifier
+	auditor  *auditor
+	queue    *auditQueue
+}
+
+// newAuditLogger creates an audit logger publishing to sink. name is used in
+// metrics and logs, and target describes the broker in health checks.
+func newAuditLogger(name string, target string, cfg *config.LoggingConfiguration, sink auditSink, logger *logging.Logger, verifier *auth.JwtVerifier, metrics *monitoring.PromMetrics) (*auditLogger, error) {
+	l := &auditLogger{
+		Config:     cfg,
+		OnlyUnsafe: cfg.UnsafeOnly,
+		target:     target,
+		logger:     logger,
+		verifier:   verifier,
+		auditor:    newAuditor(&cfg.AuditConfiguration, verifier, logger),
+	}
+
+	switch cfg.Events {
+	case "", "audit":
+	case "access":
+		l.access = true
+	default:
+		return nil, fmt.Errorf("unsupported event type: '%s'", cfg.Events)
+	}
+
+	queue, err := newAuditQueue(name, &cfg.AuditQueueConfiguration, sink, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	l.queue = queue
+
+	return l, nil
+}
+
+// Close publishes the queued events and closes the connection to the broker.
+// Events that are published after Close are discarded.
+func (l *auditLogger) Close() error {
+	l.logger.Infof("closing connection to %s", l.target)
+	return l.queue.Close()
+}
+
+// CheckHealth tests whether the connection to the broker is open.
+func (l *auditLogger) CheckHealth() error {
+	if !l.queue.Connected() {
+		return fmt.Errorf("connection to %s is closed", l.target)
+	}
+	return nil
+}
+
+func (l *auditLogger) match(req *http.Request) bool {
+	if l.OnlyUnsafe {
+		return req.Method == "POST" || req.Method == "PATCH" || req.Method == "PUT" || req.Method == "DELETE"
+	} else {
+		return true
+	}
+}
+
+func (l *auditLogger) Wrap(wrapped http.Handler) (http.Handler, error) {
+	if l.access {
+		return accessLogHandler(wrapped, l.verifier, l.publishAccess), nil
+	}
+	return l.auditor.Wrap(wrapped, l.match, l.publish), nil
+}
+
+func (l *auditLogger) OnAuthenticatedRequest(req *http.Request, jwt string) {
+	l.auditor.Authenticated(req, jwt)
+}
+
+func (l *auditLogger) OnLockout(event auth.LockoutEvent) {
+	if l.access {
+		return
+	}
+
+	entry := AuditLogMessage{
+		Version: AuditLogSchemaVersion,
+		Auth: AuditLogAuth{
+			Sub: event.Username,
+			Ip:  event.IP,
+		},
+		Action:    "auth.lockout",
+		Timestamp: time.Now(),
+		Data: map[string]string{
+			"kind":     event.Kind,
+			"key":      event.Key,
+			"failures": strconv.Itoa(event.Failures),
+			"until":    event.Until.Format(time.RFC3339),
+		},
+	}
+
+	l.publish(&entry)
+}
+
+func (l *auditLogger) publish(entry *AuditLogMessage) {
+	jsonbytes, _ := json.Marshal(entry)
+
+	l.queue.Enqueue(auditEvent{
+		Key:       entry.Action,
+		Body:      jsonbytes,
+		Timestamp: entry.Timestamp,
+	})
+}
+
+func (l *auditLogger) publishAccess(entry *jsonLogEntry) {
+	jsonbytes, _ := json.Marshal(entry)
+
+	l.queue.Enqueue(auditEvent{
+		Key:       "access",
+		Body:      jsonbytes,
+		Timestamp: entry.Timestamp,
+	})
+}
@@ -0,0 +1,294 @@
+package httplogging
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultAuditQueueSize = 1000
+	defaultAuditBatchSize = 100
+)
+
+var auditReconnectDelay = 5 * time.Second
+
+// auditSink publishes audit events to a message broker. Sinks are only used
+// by the goroutine of their audit queue, and need not be safe for concurrent
+// use.
+type auditSink interface {
+	// Connect opens the connection to the broker. The returned channel
+	// receives an error when the connection is lost; it may be nil.
+	Connect() (<-chan error, error)
+
+	// Publish publishes events and waits until the broker confirmed them.
+	// It returns the events that were not confirmed, in their original order.
+	Publish(events []auditEvent) ([]auditEvent, error)
+
+	Close() error
+}
+
+// auditQueue buffers audit events in memory and publishes them to a sink
+// from a single goroutine. Events that cannot be published are written to a
+// spool file, which is replayed after the connection to the broker has been
+// re-established.
+type auditQueue struct {
+	name    string
+	sink    auditSink
+	logger  *logging.Logger
+	metrics *monitoring.PromMetrics
+
+	queue     chan auditEvent
+	batchSize int
+	spool     *spool
+	lost      <-chan error
+
+	connected atomic.Bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+func newAuditQueue(name string, cfg *config.AuditQueueConfiguration, sink auditSink, logger *logging.Logger, metrics *monitoring.PromMetrics) (*auditQueue, error) {
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultAuditQueueSize
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAuditBatchSize
+	}
+
+	q := &auditQueue{
+		name:      name,
+		sink:      sink,
+		logger:    logger,
+		metrics:   metrics,
+		queue:     make(chan auditEvent, size),
+		batchSize: batchSize,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if cfg.SpoolFile != "" {
+		s, err := openSpool(cfg.SpoolFile)
+		if err != nil {
+			return nil, err
+		}
+		q.spool = s
+		q.setSpooled()
+	}
+
+	lost, err := sink.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	q.lost = lost
+	q.connected.Store(true)
+
+	go q.run()
+
+	return q, nil
+}
+
+// Enqueue adds an event to the queue. It does not block; when the queue is
+// full, the event is dropped.
+func (q *auditQueue) Enqueue(event auditEvent) {
+	select {
+	case q.queue <- event:
+		q.count("queued", 1)
+		if q.metrics != nil {
+			q.metrics.AuditQueueLength.With(prometheus.Labels{"sink": q.name}).Inc()
+		}
+	default:
+		q.count("dropped", 1)
+		q.logger.Errorf("audit queue is full; dropping %s event", event.Key)
+	}
+}
+
+// Connected tells whether the connection to the broker is currently open.
+func (q *auditQueue) Connected() bool {
+	return q.connected.Load()
+}
+
+// Close publishes or spools all queued events and closes the sink. It may be
+// called more than once.
+func (q *auditQueue) Close() error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	<-q.done
+
+	if !q.connected.Load() {
+		return nil
+	}
+	return q.sink.Close()
+}
+
+func (q *auditQueue) run() {
+	defer close(q.done)
+
+	var retry <-chan time.Time
+
+	q.replay()
+
+	for {
+		select {
+		case event := <-q.queue:
+			if !q.deliver(q.batch(event)) {
+				retry = time.After(auditReconnectDelay)
+			}
+		case err := <-q.lost:
+			q.logger.Errorf("connection to %s server was closed: %s", q.name, err)
+			q.disconnect()
+			retry = time.After(auditReconnectDelay)
+		case <-retry:
+			retry = nil
+			if !q.reconnect() {
+				retry = time.After(auditReconnectDelay)
+			}
+		case <-q.stop:
+			for {
+				select {
+				case event := <-q.queue:
+					q.deliver(q.batch(event))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// batch collects the queued events following first, up to the batch size.
+func (q *auditQueue) batch(first auditEvent) []auditEvent {
+	events := []auditEvent{first}
+
+	for len(events) < q.batchSize {
+		select {
+		case event := <-q.queue:
+			events = append(events, event)
+			continue
+		default:
+		}
+		break
+	}
+
+	if q.metrics != nil {
+		q.metrics.AuditQueueLength.With(prometheus.Labels{"sink": q.name}).Sub(float64(len(events)))
+	}
+	return events
+}
+
+// deliver publishes events, or spools them if the broker is unavailable. It
+// returns false if the connection was lost.
+func (q *auditQueue) deliver(events []auditEvent) bool {
+	if !q.connected.Load() {
+		q.spoolEvents(events)
+		return true
+	}
+
+	failed, err := q.sink.Publish(events)
+	q.count("confirmed", len(events)-len(failed))
+
+	if err != nil {
+		q.logger.Errorf("publishing %d audit events to %s server failed: %s", len(failed), q.name, err)
+		q.spoolEvents(failed)
+		q.disconnect()
+		return false
+	}
+
+	return true
+}
+
+func (q *auditQueue) disconnect() {
+	q.connected.Store(false)
+	q.lost = nil
+	_ = q.sink.Close()
+
+	q.logger.Noticef("reconnecting to %s server after %s", q.name, auditReconnectDelay)
+}
+
+func (q *auditQueue) reconnect() bool {
+	lost, err := q.sink.Connect()
+	if err != nil {
+		q.logger.Errorf("reconnecting to %s server failed: %s", q.name, err)
+		return false
+	}
+
+	q.lost = lost
+	q.connected.Store(true)
+
+	return q.replay()
+}
+
+// replay publishes the spooled events. It returns false if the connection was
+// lost.
+func (q *auditQueue) replay() bool {
+	if q.spool == nil || q.spool.Len() == 0 {
+		return true
+	}
+
+	q.logger.Infof("replaying %d spooled audit events", q.spool.Len())
+
+	err := q.spool.Replay(func(event auditEvent) error {
+		failed, err := q.sink.Publish([]auditEvent{event})
+		if err == nil && len(failed) > 0 {
+			err = fmt.Errorf("event was not confirmed")
+		}
+		if err == nil {
+			q.count("confirmed", 1)
+		}
+		return err
+	})
+	q.setSpooled()
+
+	if err != nil {
+		q.logger.Errorf("replaying spooled audit events failed: %s", err)
+		q.disconnect()
+		return false
+	}
+
+	return true
+}
+
+func (q *auditQueue) spoolEvents(events []auditEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	if q.spool == nil {
+		q.count("dropped", len(events))
+		q.logger.Errorf("dropping %d audit events; no spool file is configured", len(events))
+		return
+	}
+
+	if err := q.spool.Append(events...); err != nil {
+		q.count("dropped", len(events))
+		q.logger.Errorf("dropping %d audit events: %s", len(events), err)
+		return
+	}
+
+	q.count("spooled", len(events))
+	q.setSpooled()
+}
+
+func (q *auditQueue) count(result string, n int) {
+	if q.metrics != nil && n > 0 {
+		q.metrics.AuditEvents.With(prometheus.Labels{"sink": q.name, "result": result}).Add(float64(n))
+	}
+}
+
+func (q *auditQueue) setSpooled() {
+	if q.metrics != nil {
+		q.metrics.AuditSpooled.With(prometheus.Labels{"sink": q.name}).Set(float64(q.spool.Len()))
+	}
+}
@@ -0,0 +1,223 @@
+package httplogging
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+// fakeSink records the keys of published events. Events with rejected keys
+// are not confirmed, and no events are confirmed while the sink is down.
+type fakeSink struct {
+	lock      sync.Mutex
+	published []string
+	rejected  map[string]bool
+	down      bool
+	connects  int
+	lost      chan error
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{rejected: make(map[string]bool)}
+}
+
+func (s *fakeSink) Connect() (<-chan error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return nil, fmt.Errorf("broker is down")
+	}
+
+	s.connects++
+	s.lost = make(chan error, 1)
+	return s.lost, nil
+}
+
+func (s *fakeSink) Publish(events []auditEvent) ([]auditEvent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return events, fmt.Errorf("broker is down")
+	}
+
+	var failed []auditEvent
+	for _, event := range events {
+		if s.rejected[event.Key] {
+			failed = append(failed, event)
+			continue
+		}
+		s.published = append(s.published, event.Key)
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("%d events were rejected", len(failed))
+	}
+	return nil, nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.down = down
+}
+
+func (s *fakeSink) keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.published...)
+}
+
+func newTestAuditQueue(t *testing.T, sink auditSink, spoolFile string) *auditQueue {
+	t.Helper()
+
+	q, err := newAuditQueue("test", &config.AuditQueueConfiguration{SpoolFile: spoolFile}, sink, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return q
+}
+
+func spooledKeys(t *testing.T, filename string) []string {
+	t.Helper()
+
+	s, err := openSpool(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var keys []string
+	_ = s.Replay(func(event auditEvent) error {
+		keys = append(keys, event.Key)
+		return fmt.Errorf("keep the event")
+	})
+	return keys
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAuditQueuePublishesInOrder(t *testing.T) {
+	sink := newFakeSink()
+	q := newTestAuditQueue(t, sink, "")
+
+	for _, key := range []string{"a", "b", "c"} {
+		q.Enqueue(auditEvent{Key: key})
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if keys := sink.keys(); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("expected events a, b and c, got %v", keys)
+	}
+
+	// closing again must not panic
+	if err := q.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestAuditQueueSpoolsRejectedEvents(t *testing.T) {
+	spoolFile := filepath.Join(t.TempDir(), "spool")
+
+	sink := newFakeSink()
+	sink.rejected["b"] = true
+
+	q := newTestAuditQueue(t, sink, spoolFile)
+	for _, key := range []string{"a", "b", "c"} {
+		q.Enqueue(auditEvent{Key: key})
+	}
+	_ = q.Close()
+
+	if keys := sink.keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("expected events a and c to be published, got %v", keys)
+	}
+	if keys := spooledKeys(t, spoolFile); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("expected event b to be spooled, got %v", keys)
+	}
+}
+
+func TestAuditQueueReplaysSpoolOnStart(t *testing.T) {
+	spoolFile := filepath.Join(t.TempDir(), "spool")
+
+	s, _ := openSpool(spoolFile)
+	if err := s.Append(auditEvent{Key: "x"}, auditEvent{Key: "y"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	sink := newFakeSink()
+	q := newTestAuditQueue(t, sink, spoolFile)
+	q.Enqueue(auditEvent{Key: "z"})
+	_ = q.Close()
+
+	if keys := sink.keys(); !reflect.DeepEqual(keys, []string{"x", "y", "z"}) {
+		t.Errorf("expected spooled events before new ones, got %v", keys)
+	}
+	if keys := spooledKeys(t, spoolFile); len(keys) != 0 {
+		t.Errorf("expected spool to be empty, got %v", keys)
+	}
+}
+
+func TestAuditQueueReconnects(t *testing.T) {
+	delay := auditReconnectDelay
+	auditReconnectDelay = 10 * time.Millisecond
+	defer func() { auditReconnectDelay = delay }()
+
+	spoolFile := filepath.Join(t.TempDir(), "spool")
+
+	sink := newFakeSink()
+	q := newTestAuditQueue(t, sink, spoolFile)
+	defer q.Close()
+
+	// events that fail while the broker is down are spooled ...
+	sink.setDown(true)
+	q.Enqueue(auditEvent{Key: "a"})
+	waitFor(t, func() bool { return !q.Connected() })
+
+	// ... and published once the connection is re-established
+	sink.setDown(false)
+	waitFor(t, q.Connected)
+	waitFor(t, func() bool { return len(sink.keys()) == 1 })
+
+	// a lost connection is re-established, too
+	sink.lock.Lock()
+	sink.lost <- fmt.Errorf("connection reset")
+	sink.lock.Unlock()
+
+	waitFor(t, func() bool {
+		sink.lock.Lock()
+		defer sink.lock.Unlock()
+		return sink.connects == 3
+	})
+
+	q.Enqueue(auditEvent{Key: "b"})
+	waitFor(t, func() bool { return len(sink.keys()) == 2 })
+
+	if keys := sink.keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected events a and b, got %v", keys)
+	}
+}
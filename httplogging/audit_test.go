@@ -0,0 +1,118 @@
+package httplogging
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
+)
+
+func newTestAuditor(t *testing.T, cfg config.AuditConfiguration) *auditor {
+	t.Helper()
+
+	verifier, _ := auth.NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+	return newAuditor(&cfg, verifier, logging.MustGetLogger("test"))
+}
+
+func newTestToken(claims jwt.MapClaims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	return token
+}
+
+// audit sends a request through an auditor and returns the emitted message.
+// The request is authenticated with token unless it is empty.
+func audit(a *auditor, req *http.Request, token string) *AuditLogMessage {
+	var msg *AuditLogMessage
+
+	handler := a.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body)
+
+		if token != "" {
+			a.Authenticated(req, token)
+		}
+
+		info := requestinfo.Get(req)
+		info.Application = "users"
+		info.Route = "/users/:id"
+
+		rw.WriteHeader(http.StatusAccepted)
+	}), func(*http.Request) bool { return true }, func(m *AuditLogMessage) { msg = m })
+
+	requestinfo.NewHandler(handler).ServeHTTP(httptest.NewRecorder(), req)
+	return msg
+}
+
+func TestAuditMessages(t *testing.T) {
+	a := newTestAuditor(t, config.AuditConfiguration{
+		Claims:      map[string]string{"tenant": "tid", "sudo": ""},
+		IncludeBody: true,
+	})
+
+	token := newTestToken(jwt.MapClaims{"sub": "user-1", "sudo": "admin", "tid": "t-1"})
+
+	req := httptest.NewRequest("PUT", "/users/1?x=1", strings.NewReader(`{"name":"a","Password":"secret","nested":[{"password":"secret"}]}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	msg := audit(a, req, token)
+	if msg == nil {
+		t.Fatal("expected audit message for authenticated request")
+	}
+
+	if msg.Version != AuditLogSchemaVersion || msg.Action != "api.request.put" || msg.Data["url"] != "/users/1?x=1" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if msg.Auth.Sub != "user-1" || msg.Auth.Sudo != "" || msg.Auth.Ip != "192.0.2.1:1234" || msg.Auth.Claims["tenant"] != "t-1" {
+		t.Errorf("unexpected auth %+v", msg.Auth)
+	}
+	if msg.Request.Application != "users" || msg.Request.Route != "/users/:id" || msg.Response.Status != http.StatusAccepted {
+		t.Errorf("unexpected request %+v and response %+v", msg.Request, msg.Response)
+	}
+
+	var body map[string]interface{}
+	_ = json.Unmarshal(msg.Request.Body, &body)
+	if body["name"] != "a" || body["Password"] != "*REDACTED*" || strings.Contains(string(msg.Request.Body), "secret") {
+		t.Errorf("expected passwords to be redacted, got %s", msg.Request.Body)
+	}
+}
+
+func TestAuditMessagesSkipUnauthenticatedRequests(t *testing.T) {
+	a := newTestAuditor(t, config.AuditConfiguration{})
+
+	if msg := audit(a, httptest.NewRequest("GET", "/", nil), ""); msg != nil {
+		t.Errorf("expected no audit message, got %+v", msg)
+	}
+}
+
+func TestAuditMessagesTruncateBodies(t *testing.T) {
+	a := newTestAuditor(t, config.AuditConfiguration{IncludeBody: true, BodyMaxSize: 8})
+
+	msg := audit(a, httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"too long"}`)), newTestToken(jwt.MapClaims{"sub": "user-1"}))
+	if msg == nil || !msg.Request.BodyTruncated || msg.Request.Body != nil {
+		t.Errorf("expected truncated body to be left out, got %+v", msg)
+	}
+}
+
+func TestAuditLoggerPublishesLockouts(t *testing.T) {
+	sink := newFakeSink()
+
+	l, err := newAuditLogger("test", "test broker", &config.LoggingConfiguration{}, sink, logging.MustGetLogger("test"), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	l.OnLockout(auth.LockoutEvent{Kind: "user", Username: "user-1", Failures: 5, Until: time.Now()})
+	_ = l.Close()
+
+	if keys := sink.keys(); len(keys) != 1 || keys[0] != "auth.lockout" {
+		t.Errorf("expected lockout event, got %v", keys)
+	}
+}
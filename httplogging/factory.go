@@ -6,6 +6,7 @@ import (
 
 	"github.com/mittwald/servicegateway/auth"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/op/go-logging"
 )
 
@@ -13,10 +14,22 @@ type HttpLogger interface {
 	Wrap(http.Handler) (http.Handler, error)
 }
 
-func LoggerFromConfig(config *config.LoggingConfiguration, logger *logging.Logger, verifier *auth.JwtVerifier) (HttpLogger, error) {
+// Reopener is implemented by loggers writing to files, which need to reopen
+// them after log rotation.
+type Reopener interface {
+	Reopen() error
+}
+
+func LoggerFromConfig(config *config.LoggingConfiguration, logger *logging.Logger, verifier *auth.JwtVerifier, metrics *monitoring.PromMetrics) (HttpLogger, error) {
 	switch config.Type {
 	case "amqp":
-		return NewAmqpLoggingBehaviour(config, logger, verifier)
+		return NewAmqpLoggingBehaviour(config, logger, verifier, metrics)
+	case "kafka":
+		return NewKafkaLoggingBehaviour(config, logger, verifier, metrics)
+	case "nats":
+		return NewNatsLoggingBehaviour(config, logger, verifier, metrics)
+	case "json":
+		return NewJsonLoggingBehaviour(config, logger, verifier)
 	case "apache":
 		return &ApacheLoggingBehaviour{
 			Filename: config.Filename,
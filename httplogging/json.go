@@ -0,0 +1,245 @@
+package httplogging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
+)
+
+// JsonLoggingBehaviour writes one JSON document per request to a file or to
+// stdout.
+type JsonLoggingBehaviour struct {
+	Filename string
+
+	logger   *logging.Logger
+	verifier *auth.JwtVerifier
+
+	lock   sync.Mutex
+	writer io.Writer
+	file   *os.File
+}
+
+type jsonLogEntry struct {
+	Timestamp          time.Time `json:"timestamp"`
+	RequestID          string    `json:"request_id,omitempty"`
+	RemoteAddr         string    `json:"remote_addr"`
+	Method             string    `json:"method"`
+	Host               string    `json:"host"`
+	Path               string    `json:"path"`
+	Application        string    `json:"application,omitempty"`
+	Route              string    `json:"route,omitempty"`
+	Backend            string    `json:"backend,omitempty"`
+	UpstreamURL        string    `json:"upstream_url,omitempty"`
+	Status             int       `json:"status"`
+	RequestSize        int64     `json:"request_size"`
+	ResponseSize       int64     `json:"response_size"`
+	Duration           float64   `json:"duration_ms"`
+	UpstreamDuration   float64   `json:"upstream_duration_ms,omitempty"`
+	Cache              string    `json:"cache,omitempty"`
+	RateLimitRemaining *int      `json:"ratelimit_remaining,omitempty"`
+	Subject            string    `json:"subject,omitempty"`
+	UserAgent          string    `json:"user_agent,omitempty"`
+}
+
+func NewJsonLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, verifier *auth.JwtVerifier) (*JsonLoggingBehaviour, error) {
+	c := &JsonLoggingBehaviour{
+		Filename: cfg.Filename,
+		logger:   logger,
+		verifier: verifier,
+	}
+
+	if err := c.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *JsonLoggingBehaviour) toStdout() bool {
+	return c.Filename == "" || c.Filename == "-"
+}
+
+// Reopen closes and reopens the log file, so that it can be rotated.
+func (c *JsonLoggingBehaviour) Reopen() error {
+	if c.toStdout() {
+		c.lock.Lock()
+		c.writer = os.Stdout
+		c.lock.Unlock()
+		return nil
+	}
+
+	file, err := os.OpenFile(c.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open access log %s: %s", c.Filename, err)
+	}
+
+	c.lock.Lock()
+	previous := c.file
+	c.file = file
+	c.writer = file
+	c.lock.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (c *JsonLoggingBehaviour) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	c.writer = io.Discard
+	return err
+}
+
+func (c *JsonLoggingBehaviour) Wrap(wrapped http.Handler) (http.Handler, error) {
+	return accessLogHandler(wrapped, c.verifier, c.write), nil
+}
+
+// accessLogHandler calls emit with an access log entry for each request, once
+// the request has been answered.
+func accessLogHandler(wrapped http.Handler, verifier *auth.JwtVerifier, emit func(*jsonLogEntry)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+
+		info := requestinfo.Get(req)
+
+		body := &countingBody{ReadCloser: req.Body}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = body
+		}
+
+		writer := &loggingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+		wrapped.ServeHTTP(writer, req)
+
+		entry := jsonLogEntry{
+			Timestamp:    started,
+			RequestID:    requestid.FromRequest(req),
+			RemoteAddr:   req.RemoteAddr,
+			Method:       req.Method,
+			Host:         req.Host,
+			Path:         req.URL.Path,
+			Application:  info.Application,
+			Route:        info.Route,
+			Backend:      info.Backend,
+			UpstreamURL:  info.UpstreamURL,
+			Status:       writer.status,
+			RequestSize:  body.bytes,
+			ResponseSize: writer.bytes,
+			Duration:     milliseconds(time.Since(started)),
+			Cache:        writer.Header().Get("X-Cache"),
+			UserAgent:    req.UserAgent(),
+		}
+
+		// Bodies that were not read completely are logged with their
+		// declared length.
+		if req.ContentLength > entry.RequestSize {
+			entry.RequestSize = req.ContentLength
+		}
+
+		if info.UpstreamDuration > 0 {
+			entry.UpstreamDuration = milliseconds(info.UpstreamDuration)
+		}
+
+		if remaining, err := strconv.Atoi(writer.Header().Get("X-RateLimit-Remaining")); err == nil {
+			entry.RateLimitRemaining = &remaining
+		}
+
+		if info.JWT != "" {
+			if claims, err := verifier.DecodeClaims(info.JWT); err == nil {
+				entry.Subject, _ = claims["sub"].(string)
+			}
+		}
+
+		emit(&entry)
+	})
+}
+
+func (c *JsonLoggingBehaviour) write(entry *jsonLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		c.logger.Errorf("[%s] could not encode access log entry: %s", entry.RequestID, err)
+		return
+	}
+	line = append(line, '\n')
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, err := c.writer.Write(line); err != nil {
+		c.logger.Errorf("[%s] could not write access log entry: %s", entry.RequestID, err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
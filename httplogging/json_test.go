@@ -0,0 +1,129 @@
+package httplogging
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/op/go-logging"
+)
+
+func readLogEntries(t *testing.T, filename string) []map[string]interface{} {
+	t.Helper()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer file.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid log entry %s: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJsonLogging(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "access.log")
+
+	verifier, _ := auth.NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1"}).SignedString([]byte("secret"))
+
+	cfg := config.LoggingConfiguration{Type: "json"}
+	cfg.Filename = filename
+
+	l, err := NewJsonLoggingBehaviour(&cfg, logging.MustGetLogger("test"), verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+
+	handler, _ := l.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info := requestinfo.Get(req)
+		info.Application = "users"
+		info.Route = "/users/:id"
+		info.JWT = token
+
+		rw.Header().Set("X-Cache", "MISS")
+		rw.Header().Set("X-RateLimit-Remaining", "5")
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	handler = requestinfo.NewHandler(handler)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users/1", strings.NewReader("abc")))
+
+	// the log file can be rotated by moving it and reopening it
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+
+	rotated := readLogEntries(t, filename+".1")
+	if len(rotated) != 1 {
+		t.Fatalf("expected one entry in rotated log, got %v", rotated)
+	}
+
+	expected := map[string]interface{}{
+		"method":              "POST",
+		"path":                "/users/1",
+		"application":         "users",
+		"route":               "/users/:id",
+		"status":              float64(201),
+		"request_size":        float64(3),
+		"response_size":       float64(5),
+		"cache":               "MISS",
+		"ratelimit_remaining": float64(5),
+		"subject":             "user-1",
+	}
+	for key, value := range expected {
+		if rotated[0][key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, rotated[0][key])
+		}
+	}
+
+	if current := readLogEntries(t, filename); len(current) != 1 || current[0]["path"] != "/users/2" {
+		t.Errorf("expected second request in reopened log, got %v", current)
+	}
+}
+
+func TestJsonLoggingRequestID(t *testing.T) {
+	cfg := config.LoggingConfiguration{Type: "json"}
+	cfg.Filename = filepath.Join(t.TempDir(), "access.log")
+
+	l, err := NewJsonLoggingBehaviour(&cfg, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+
+	handler, _ := l.Wrap(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	requestid.NewHandler(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	id := rec.Header().Get(requestid.Header)
+	if entries := readLogEntries(t, cfg.Filename); len(entries) != 1 || id == "" || entries[0]["request_id"] != id {
+		t.Errorf("expected entry with request ID %q, got %v", id, entries)
+	}
+}
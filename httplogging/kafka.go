@@ -0,0 +1,170 @@
+package httplogging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
+	"github.com/segmentio/kafka-go"
+)
+
+type KafkaLoggingBehaviour struct {
+	*auditLogger
+}
+
+func NewKafkaLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier, metrics *monitoring.PromMetrics) (*KafkaLoggingBehaviour, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka logger requires at least one broker")
+	}
+
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka logger requires a topic")
+	}
+
+	acks, err := kafkaRequiredAcks(cfg.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := cfg.ConfirmTimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &kafkaSink{
+		config:    &cfg.KafkaLoggingConfiguration,
+		logger:    logger,
+		acks:      acks,
+		timeout:   timeout,
+		batchSize: cfg.BatchSize,
+	}
+
+	l, err := newAuditLogger("kafka", "Kafka brokers "+strings.Join(cfg.Brokers, ","), cfg, sink, logger, tokenVerifier, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaLoggingBehaviour{auditLogger: l}, nil
+}
+
+func kafkaRequiredAcks(acks string) (kafka.RequiredAcks, error) {
+	switch acks {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "leader":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("unsupported required acks: '%s'", acks)
+	}
+}
+
+// routingKey replaces the "{action}" placeholder of a topic or subject with
+// the action of an event.
+func routingKey(template string, event *auditEvent) string {
+	return strings.ReplaceAll(template, "{action}", event.Key)
+}
+
+// kafkaSink writes audit events to a Kafka topic. The action of an event is
+// used as message key.
+type kafkaSink struct {
+	config    *config.KafkaLoggingConfiguration
+	logger    *logging.Logger
+	acks      kafka.RequiredAcks
+	timeout   time.Duration
+	batchSize int
+
+	writer *kafka.Writer
+}
+
+func (s *kafkaSink) Connect() (<-chan error, error) {
+	s.logger.Infof("opening connection to Kafka brokers: %s", strings.Join(s.config.Brokers, ","))
+
+	// the writer connects lazily, so check that a broker is reachable
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var dialErr error
+	for _, broker := range s.config.Brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			dialErr = err
+			continue
+		}
+
+		_ = conn.Close()
+		dialErr = nil
+		break
+	}
+
+	if dialErr != nil {
+		return nil, fmt.Errorf("error while dialing Kafka: %s", dialErr)
+	}
+
+	s.writer = &kafka.Writer{
+		Addr:         kafka.TCP(s.config.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: s.acks,
+		BatchSize:    s.batchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: s.timeout,
+		ReadTimeout:  s.timeout,
+		MaxAttempts:  1,
+	}
+
+	// the writer reconnects by itself, so connection losses are only
+	// noticed when publishing fails
+	return nil, nil
+}
+
+func (s *kafkaSink) Publish(events []auditEvent) ([]auditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	messages := make([]kafka.Message, len(events))
+	for i := range events {
+		messages[i] = kafka.Message{
+			Topic: routingKey(s.config.Topic, &events[i]),
+			Key:   []byte(events[i].Key),
+			Value: events[i].Body,
+			Time:  events[i].Timestamp,
+		}
+	}
+
+	err := s.writer.WriteMessages(ctx, messages...)
+	if err == nil {
+		return nil, nil
+	}
+
+	writeErrors, ok := err.(kafka.WriteErrors)
+	if !ok {
+		return events, err
+	}
+
+	var failed []auditEvent
+	for i := range events {
+		if writeErrors[i] != nil {
+			failed = append(failed, events[i])
+			err = writeErrors[i]
+		}
+	}
+
+	return failed, err
+}
+
+func (s *kafkaSink) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	err := s.writer.Close()
+	s.writer = nil
+
+	return err
+}
@@ -0,0 +1,61 @@
+package httplogging
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaConfiguration(t *testing.T) {
+	cases := map[string]config.KafkaLoggingConfiguration{
+		"without brokers":      {Topic: "audit"},
+		"without topic":        {Brokers: []string{"127.0.0.1:9092"}},
+		"invalid acks setting": {Brokers: []string{"127.0.0.1:9092"}, Topic: "audit", RequiredAcks: "some"},
+	}
+
+	for name, kafkaCfg := range cases {
+		cfg := config.LoggingConfiguration{KafkaLoggingConfiguration: kafkaCfg}
+		if _, err := NewKafkaLoggingBehaviour(&cfg, logging.MustGetLogger("test"), nil, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	acks := map[string]kafka.RequiredAcks{"": kafka.RequireAll, "all": kafka.RequireAll, "leader": kafka.RequireOne, "none": kafka.RequireNone}
+	for setting, expected := range acks {
+		if actual, err := kafkaRequiredAcks(setting); err != nil || actual != expected {
+			t.Errorf("%q: expected %v, got %v (%v)", setting, expected, actual, err)
+		}
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+	event := auditEvent{Key: "api.request.post"}
+
+	if key := routingKey("audit.{action}", &event); key != "audit.api.request.post" {
+		t.Errorf("expected action to be inserted, got %s", key)
+	}
+	if key := routingKey("audit", &event); key != "audit" {
+		t.Errorf("expected fixed topic to be kept, got %s", key)
+	}
+}
+
+func TestKafkaSinkConnectFailsWithoutBroker(t *testing.T) {
+	// reserve a port that nothing listens on
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	sink := &kafkaSink{
+		config:  &config.KafkaLoggingConfiguration{Brokers: []string{address}, Topic: "audit"},
+		logger:  logging.MustGetLogger("test"),
+		timeout: time.Second,
+	}
+
+	if _, err := sink.Connect(); err == nil {
+		t.Error("expected an error")
+	}
+}
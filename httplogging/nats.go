@@ -0,0 +1,175 @@
+package httplogging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/op/go-logging"
+)
+
+const defaultNatsSubject = "servicegateway.audit.{action}"
+
+type NatsLoggingBehaviour struct {
+	*auditLogger
+}
+
+func NewNatsLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier, metrics *monitoring.PromMetrics) (*NatsLoggingBehaviour, error) {
+	timeout, err := cfg.ConfirmTimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &natsSink{
+		config:  &cfg.NatsLoggingConfiguration,
+		logger:  logger,
+		subject: cfg.Subject,
+		timeout: timeout,
+	}
+
+	if sink.subject == "" {
+		sink.subject = defaultNatsSubject
+	}
+
+	url := cfg.Url
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	sink.url = url
+
+	l, err := newAuditLogger("nats", "NATS server "+url, cfg, sink, logger, tokenVerifier, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NatsLoggingBehaviour{auditLogger: l}, nil
+}
+
+// natsSink publishes audit events to NATS subjects. With JetStream, each event
+// is acknowledged by the stream that stores it; otherwise, events are only
+// confirmed to have reached the server.
+type natsSink struct {
+	config  *config.NatsLoggingConfiguration
+	logger  *logging.Logger
+	url     string
+	subject string
+	timeout time.Duration
+
+	conn      *nats.Conn
+	jetStream jetstream.JetStream
+}
+
+func (s *natsSink) Connect() (<-chan error, error) {
+	s.logger.Infof("opening connection to NATS server: %s", s.url)
+
+	lost := make(chan error, 1)
+
+	// the audit queue reconnects and spools events itself, so the client
+	// must not buffer events while it is disconnected
+	conn, err := nats.Connect(
+		s.url,
+		nats.Name("servicegateway"),
+		nats.Timeout(s.timeout),
+		nats.NoReconnect(),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err == nil {
+				err = fmt.Errorf("disconnected")
+			}
+
+			select {
+			case lost <- err:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error while connecting to NATS: %s", err)
+	}
+
+	if s.config.JetStream {
+		js, err := jetstream.New(conn)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error while enabling JetStream: %s", err)
+		}
+		s.jetStream = js
+	}
+
+	s.logger.Infof("opened connection to NATS server: %s", s.url)
+
+	s.conn = conn
+
+	return lost, nil
+}
+
+func (s *natsSink) Publish(events []auditEvent) ([]auditEvent, error) {
+	if s.jetStream != nil {
+		return s.publishJetStream(events)
+	}
+
+	for i := range events {
+		if err := s.conn.Publish(routingKey(s.subject, &events[i]), events[i].Body); err != nil {
+			return events[i:], err
+		}
+	}
+
+	// a flush waits until the server processed all published events
+	if err := s.conn.FlushTimeout(s.timeout); err != nil {
+		return events, err
+	}
+
+	return nil, nil
+}
+
+func (s *natsSink) publishJetStream(events []auditEvent) ([]auditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	futures := make([]jetstream.PubAckFuture, 0, len(events))
+
+	var err error
+	for i := range events {
+		var future jetstream.PubAckFuture
+		future, err = s.jetStream.PublishAsync(routingKey(s.subject, &events[i]), events[i].Body)
+		if err != nil {
+			break
+		}
+		futures = append(futures, future)
+	}
+
+	var failed []auditEvent
+	for i, future := range futures {
+		select {
+		case <-future.Ok():
+		case ackErr := <-future.Err():
+			err = fmt.Errorf("message was not acknowledged: %s", ackErr)
+			failed = append(failed, events[i])
+		case <-ctx.Done():
+			err = fmt.Errorf("message was not acknowledged: %s", ctx.Err())
+			failed = append(failed, events[i])
+		}
+	}
+
+	failed = append(failed, events[len(futures):]...)
+
+	return failed, err
+}
+
+func (s *natsSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	// all events were flushed or acknowledged when they were published
+	s.conn.Close()
+
+	s.conn = nil
+	s.jetStream = nil
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package httplogging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/op/go-logging"
+)
+
+func newTestNatsServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoSigs: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+func newTestNatsSink(t *testing.T, s *server.Server, jetStream bool) *natsSink {
+	t.Helper()
+
+	return &natsSink{
+		config:  &config.NatsLoggingConfiguration{JetStream: jetStream},
+		logger:  logging.MustGetLogger("test"),
+		url:     s.ClientURL(),
+		subject: defaultNatsSubject,
+		timeout: time.Second,
+	}
+}
+
+func TestNatsSinkPublishes(t *testing.T) {
+	s := newTestNatsServer(t)
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	messages := make(chan *nats.Msg, 2)
+	if _, err := conn.ChanSubscribe("servicegateway.audit.>", messages); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_ = conn.Flush()
+
+	sink := newTestNatsSink(t, s, false)
+	lost, err := sink.Connect()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if failed, err := sink.Publish([]auditEvent{{Key: "auth.lockout", Body: []byte("{}")}}); err != nil || len(failed) != 0 {
+		t.Fatalf("expected event to be published, got %v (%v)", failed, err)
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Subject != "servicegateway.audit.auth.lockout" || string(msg.Data) != "{}" {
+			t.Errorf("unexpected message %s: %s", msg.Subject, msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected message to be received")
+	}
+
+	// the audit queue is notified when the connection is lost
+	s.Shutdown()
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lost connection to be reported")
+	}
+
+	_ = sink.Close()
+}
+
+func TestNatsSinkJetStreamAcknowledgements(t *testing.T) {
+	s := newTestNatsServer(t)
+
+	sink := newTestNatsSink(t, s, true)
+	if _, err := sink.Connect(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := sink.jetStream.CreateStream(ctx, jetstream.StreamConfig{Name: "audit", Subjects: []string{"servicegateway.audit.api.>"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// events without a stream for their subject are not acknowledged
+	events := []auditEvent{
+		{Key: "api.request.post", Body: []byte("{}")},
+		{Key: "auth.lockout", Body: []byte("{}")},
+		{Key: "api.request.put", Body: []byte("{}")},
+	}
+
+	failed, err := sink.Publish(events)
+	if err == nil || len(failed) != 1 || failed[0].Key != "auth.lockout" {
+		t.Errorf("expected event without stream to fail, got %v (%v)", failed, err)
+	}
+
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if info.State.Msgs != 2 {
+		t.Errorf("expected two events to be stored, got %d", info.State.Msgs)
+	}
+}
@@ -0,0 +1,172 @@
+package httplogging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// auditEvent is a serialized audit message together with its routing key.
+type auditEvent struct {
+	Key       string    `json:"key"`
+	Body      []byte    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// spool stores audit events on disk while they cannot be delivered. It is not
+// safe for concurrent use.
+type spool struct {
+	filename string
+	length   int
+}
+
+func openSpool(filename string) (*spool, error) {
+	s := &spool{filename: filename}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open spool file %s: %s", filename, err)
+	}
+	defer file.Close()
+
+	scanner := newSpoolScanner(file)
+	for scanner.Scan() {
+		s.length++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read spool file %s: %s", filename, err)
+	}
+
+	return s, nil
+}
+
+func newSpoolScanner(file *os.File) *bufio.Scanner {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return scanner
+}
+
+// Len returns the number of spooled events.
+func (s *spool) Len() int {
+	return s.length
+}
+
+// Append adds events to the end of the spool.
+func (s *spool) Append(events ...auditEvent) error {
+	file, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open spool file %s: %s", s.filename, err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for i := range events {
+		if err := encoder.Encode(&events[i]); err != nil {
+			file.Close()
+			return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+		}
+		s.length++
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+	}
+
+	return file.Close()
+}
+
+// Replay passes the spooled events to deliver in the order in which they were
+// spooled. When deliver fails, the failed event and all events after it are
+// kept in the spool.
+func (s *spool) Replay(deliver func(auditEvent) error) error {
+	if s.length == 0 {
+		return nil
+	}
+
+	file, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		s.length = 0
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open spool file %s: %s", s.filename, err)
+	}
+	defer file.Close()
+
+	scanner := newSpoolScanner(file)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a corrupt line cannot be delivered later either
+			s.length--
+			continue
+		}
+
+		if err := deliver(event); err != nil {
+			if keepErr := s.keep(scanner); keepErr != nil {
+				return keepErr
+			}
+			return err
+		}
+
+		s.length--
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read spool file %s: %s", s.filename, err)
+	}
+
+	s.length = 0
+	return os.Remove(s.filename)
+}
+
+// keep replaces the spool file with the current and all remaining lines of
+// scanner.
+func (s *spool) keep(scanner *bufio.Scanner) error {
+	tmp, err := os.OpenFile(s.filename+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	length := 0
+
+	for ok := true; ok; ok = scanner.Scan() {
+		_, _ = writer.Write(scanner.Bytes())
+		_ = writer.WriteByte('\n')
+		length++
+	}
+
+	if err := scanner.Err(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not read spool file %s: %s", s.filename, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write spool file %s: %s", s.filename, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	s.length = length
+	return os.Rename(s.filename+".tmp", s.filename)
+}
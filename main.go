@@ -21,27 +21,38 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/braintree/manners"
 	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
 	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/certificates"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/dispatcher"
 	"github.com/mittwald/servicegateway/httplogging"
 	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/tracing"
 	"github.com/op/go-logging"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
@@ -50,6 +61,7 @@ func main() {
 	flag.StringVar(&startup.ConfigFile, "config", "/etc/servicegateway.json", "configuration file")
 	flag.StringVar(&startup.DispatchingMode, "dispatch", "path", "dispatching mode ('path' or 'host')")
 	flag.IntVar(&startup.Port, "port", 8080, "HTTP port to listen on")
+	flag.IntVar(&startup.TLSPort, "tls-port", 8443, "HTTPS port to listen on (if TLS certificates are configured)")
 	flag.StringVar(&startup.AdminAddress, "admin-addr", "127.0.0.1", "Address to listen on (administration port)")
 	flag.IntVar(&startup.AdminPort, "admin-port", 8081, "HTTP port to listen on (administration port)")
 	flag.StringVar(&startup.MonitorAddress, "monitor-addr", "0.0.0.0", "Address to listen on (monitoring port)")
@@ -75,15 +87,6 @@ func main() {
 			logger.Fatal(err)
 		}
 		defer pprof.StopCPUProfile()
-
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			for range c {
-				pprof.StopCPUProfile()
-				os.Exit(0)
-			}
-		}()
 	}
 
 	logging.SetBackend(logging.NewBackendFormatter(backend, format))
@@ -149,6 +152,7 @@ func main() {
 		monitoringController, err = monitoring.NewConsulIntegrationMonitoringController(
 			startup.MonitorAddress,
 			startup.MonitorPort,
+			&cfg.Metrics,
 			consulClient,
 			monitoringLogger,
 		)
@@ -156,6 +160,7 @@ func main() {
 		monitoringController, err = monitoring.NewNoIntegrationMonitoringController(
 			startup.MonitorAddress,
 			startup.MonitorPort,
+			&cfg.Metrics,
 			monitoringLogger,
 		)
 	}
@@ -191,139 +196,277 @@ func main() {
 		logger.Panic(err)
 	}
 
-	tokenStore, err := auth.NewTokenStore(redisPool, tokenVerifier, auth.TokenStoreOptions{})
+	tokenStoreOptions := auth.TokenStoreOptions{
+		LocalCacheBucketSize: cfg.TokenStore.LocalCacheSize,
+		Metrics:              metrics,
+	}
+	if cfg.Authentication.ProviderConfig.Refresh.SlidingTtl != "" {
+		tokenStoreOptions.RefreshTtl, err = time.ParseDuration(cfg.Authentication.ProviderConfig.Refresh.SlidingTtl)
+		if err != nil {
+			logger.Fatalf("invalid sliding_ttl duration: %s", err)
+		}
+	}
+
+	tokenStore, err := auth.NewTokenStore(&cfg.TokenStore, redisPool, tokenVerifier, logging.MustGetLogger("tokenstore"), tokenStoreOptions)
 	if err != nil {
 		logger.Panic(err)
 	}
 
-	httpLoggers, err := buildLoggers(&cfg, tokenVerifier)
+	httpLoggers, err := buildLoggers(&cfg, tokenVerifier, metrics)
 	if err != nil {
 		logger.Panic(err)
 	}
 
+	var dispatcherLoaded atomic.Bool
+
+	monitoringController.AddHealthCheck(monitoring.HealthCheck{
+		Name:     "redis",
+		Critical: true,
+		Check: func() error {
+			conn := redisPool.Get()
+			defer conn.Close()
+
+			_, err := conn.Do("PING")
+			return err
+		},
+	})
+	monitoringController.AddHealthCheck(monitoring.HealthCheck{
+		Name:     "verification_key",
+		Critical: true,
+		Check:    tokenVerifier.CheckHealth,
+	})
+	monitoringController.AddHealthCheck(monitoring.HealthCheck{
+		Name:     "dispatcher",
+		Critical: true,
+		Check: func() error {
+			if !dispatcherLoaded.Load() {
+				return fmt.Errorf("application configuration has not been loaded yet")
+			}
+			return nil
+		},
+	})
+
+	for i, httpLogger := range httpLoggers {
+		if checker, ok := httpLogger.(monitoring.HealthChecker); ok {
+			monitoringController.AddHealthCheck(monitoring.HealthCheck{
+				Name:  fmt.Sprintf("logger-%s-%d", cfg.Logging[i].Type, i),
+				Check: checker.CheckHealth,
+			})
+		}
+	}
+
+	tracer, err := tracing.NewTracing(&cfg.Tracing, logging.MustGetLogger("tracing"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	handler := proxy.NewProxyHandler(logging.MustGetLogger("proxy"), &cfg, metrics)
 
 	listenAddress := fmt.Sprintf(":%d", startup.Port)
+	tlsListenAddress := fmt.Sprintf(":%d", startup.TLSPort)
 	adminListenAddress := fmt.Sprintf("%s:%d", startup.AdminAddress, startup.AdminPort)
 
-	done := make(chan bool)
-	serverShutdown := make(chan bool)
-	serverShutdownComplete := make(chan bool)
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			logger.Notice("received interrupt signal")
-			monitoringController.SendShutdown()
-			serverShutdown <- true
+	var certificateStore *certificates.Store
+	stopCertificateWatch := make(chan struct{})
+	if cfg.TLS.Enabled() {
+		certificateStore, err = certificates.NewStore(&cfg.TLS, logging.MustGetLogger("tls"))
+		if err != nil {
+			logger.Fatal(err)
 		}
-	}()
-
-	go func() {
-		monitoringController.WaitForShutdown()
-		<-serverShutdownComplete
-
-		logger.Notice("everything has shut down. exiting process.")
 
-		done <- true
-	}()
+		go certificateStore.Watch(stopCertificateWatch)
+	}
 
-	go func() {
-		var err error
-		var proxyServer, adminServer *manners.GracefulServer
+	drainDelay, shutdownTimeout, err := cfg.Shutdown.Durations()
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-		shutdownServers := func() {
-			if proxyServer != nil {
-				logger.Debug("Closing proxy server")
-				proxyServer.Close()
-			}
+	var disp http.Handler
+	var adminHandler http.Handler
 
-			if adminServer != nil {
-				logger.Debug("Closing admin server")
-				adminServer.Close()
-			}
+	if startup.IsConsulConfig() {
+		var consulClient *api.Client
+		consulClient, err = cfg.Consul.BuildConsulClient()
+		if err != nil {
+			logger.Fatal(err)
 		}
 
-		go func() {
-			<-serverShutdown
+		disp, adminHandler, err = dispatcher.BuildConsulDispatcher(
+			&startup,
+			&cfg,
+			consulClient,
+			handler,
+			redisPool,
+			logger,
+			tokenStore,
+			tokenVerifier,
+			httpLoggers,
+			metrics,
+			tracer,
+		)
+	} else {
+		disp, adminHandler, err = dispatcher.BuildNoIntegrationDispatcher(
+			&startup,
+			&cfg,
+			handler,
+			redisPool,
+			logger,
+			tokenStore,
+			tokenVerifier,
+			httpLoggers,
+			metrics,
+			tracer,
+		)
+	}
 
-			logger.Noticef("received server shutdown request. stopping creating new servers")
-			shutdownServers()
-			serverShutdownComplete <- true
-		}()
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-		var disp http.Handler
-		var adminHandler http.Handler
+	dispatcherLoaded.Store(true)
 
-		if startup.IsConsulConfig() {
-			var consulClient *api.Client
-			consulClient, err = cfg.Consul.BuildConsulClient()
-			if err != nil {
-				logger.Error(err.Error())
-				return
-			}
+	httpHandler := disp
+	if certificateStore != nil && cfg.TLS.RedirectHTTP {
+		httpHandler = certificates.RedirectHandler(startup.TLSPort)
+	}
 
-			disp, adminHandler, err = dispatcher.BuildConsulDispatcher(
-				&startup,
-				&cfg,
-				consulClient,
-				handler,
-				redisPool,
-				logger,
-				tokenStore,
-				tokenVerifier,
-				httpLoggers,
-			)
-		} else {
-			disp, adminHandler, err = dispatcher.BuildNoIntegrationDispatcher(
-				&startup,
-				&cfg,
-				handler,
-				redisPool,
-				logger,
-				tokenStore,
-				tokenVerifier,
-				httpLoggers,
-			)
-		}
+	proxyServer := &http.Server{Addr: listenAddress, Handler: httpHandler}
+	adminServer := &http.Server{Addr: adminListenAddress, Handler: adminHandler}
+	servers := []*http.Server{proxyServer, adminServer}
 
+	// Bind all listeners before reporting as ready, so that the gateway does
+	// not receive traffic that it cannot accept.
+	listeners := []net.Listener{}
+	for _, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
 		if err != nil {
-			logger.Error(err.Error())
-			return
+			logger.Fatalf("could not listen on %s: %s", server.Addr, err)
 		}
+		listeners = append(listeners, listener)
+	}
 
-		shutdownServers()
+	if certificateStore != nil {
+		tlsServer := &http.Server{Addr: tlsListenAddress, Handler: disp, TLSConfig: certificateStore.TLSConfig()}
 
-		proxyServer = manners.NewWithServer(&http.Server{Addr: listenAddress, Handler: disp})
-		adminServer = manners.NewWithServer(&http.Server{Addr: adminListenAddress, Handler: adminHandler})
+		tlsListener, err := net.Listen("tcp", tlsListenAddress)
+		if err != nil {
+			logger.Fatalf("could not listen on %s: %s", tlsListenAddress, err)
+		}
 
-		logger.Debug("Starting new servers")
+		servers = append(servers, tlsServer)
 
 		go func() {
-			logger.Infof("starting dispatcher on address %s", listenAddress)
-			_ = proxyServer.ListenAndServe()
+			logger.Infof("starting TLS dispatcher on address %s", tlsListenAddress)
+			if err := tlsServer.ServeTLS(tlsListener, "", ""); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("could not serve on %s: %s", tlsListenAddress, err)
+			}
 		}()
+	}
 
-		go func() {
-			logger.Infof("starting admin server on address %s", adminListenAddress)
-			_ = adminServer.ListenAndServe()
-		}()
+	go func() {
+		logger.Infof("starting dispatcher on address %s", listenAddress)
+		if err := proxyServer.Serve(listeners[0]); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("could not serve on %s: %s", listenAddress, err)
+		}
+	}()
+
+	go func() {
+		logger.Infof("starting admin server on address %s", adminListenAddress)
+		if err := adminServer.Serve(listeners[1]); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("could not serve on %s: %s", adminListenAddress, err)
+		}
+	}()
+
+	monitoringController.SetReady(true)
+
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	go func() {
+		for range reopen {
+			logger.Notice("received hangup signal. reopening log files")
+			for _, httpLogger := range httpLoggers {
+				if reopener, ok := httpLogger.(httplogging.Reopener); ok {
+					if err := reopener.Reopen(); err != nil {
+						logger.Errorf("could not reopen log file: %s", err)
+					}
+				}
+			}
+		}
 	}()
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
 	logger.Info("waiting to die")
-	<-done
+	sig := <-signals
+
+	// a second signal terminates the process immediately
+	signal.Stop(signals)
+
+	logger.Noticef("received %s signal. reporting as not ready and draining connections for %s", sig, drainDelay)
+	monitoringController.SetReady(false)
+	if err := monitoringController.Deregister(); err != nil {
+		logger.Errorf("error while deregistering from service discovery: %s", err)
+	}
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			logger.Debugf("shutting down server on %s", server.Addr)
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Errorf("could not shut down server on %s in time, closing remaining connections: %s", server.Addr, err)
+				_ = server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	if err := monitoringController.Shutdown(ctx); err != nil {
+		logger.Errorf("error while shutting down monitoring: %s", err)
+	}
+
+	if err := tracer.Shutdown(ctx); err != nil {
+		logger.Errorf("error while exporting remaining traces: %s", err)
+	}
+
+	for _, httpLogger := range httpLoggers {
+		if closer, ok := httpLogger.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Errorf("error while closing logger: %s", err)
+			}
+		}
+	}
+
+	if err := redisPool.Close(); err != nil {
+		logger.Errorf("error while closing Redis pool: %s", err)
+	}
+
+	close(stopCertificateWatch)
+
+	logger.Notice("everything has shut down. exiting process.")
 }
 
-func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier) ([]httplogging.HttpLogger, error) {
+func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier, metrics *monitoring.PromMetrics) ([]httplogging.HttpLogger, error) {
 	loggers := make([]httplogging.HttpLogger, len(cfg.Logging))
-	for i, loggingConfig := range cfg.Logging {
+	for i := range cfg.Logging {
+		// loggers keep the configuration to reconnect, so pass the element
+		// instead of a pointer to the loop variable
+		loggingConfig := &cfg.Logging[i]
+
 		loggingLogger, err := logging.GetLogger("logger-" + loggingConfig.Type)
 		if err != nil {
 			return nil, err
 		}
 
-		httpLogger, err := httplogging.LoggerFromConfig(&loggingConfig, loggingLogger, tok)
+		httpLogger, err := httplogging.LoggerFromConfig(loggingConfig, loggingLogger, tok, metrics)
 		if err != nil {
 			return nil, err
 		}
@@ -23,9 +23,9 @@ import (
 	"fmt"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/mittwald/servicegateway/config"
 	"github.com/op/go-logging"
 
-	"net/http"
 	"os"
 )
 
@@ -36,7 +36,7 @@ type consulIntegrationController struct {
 	consulServiceID string
 }
 
-func NewConsulIntegrationMonitoringController(address string, port int, consul *api.Client, logger *logging.Logger) (Controller, error) {
+func NewConsulIntegrationMonitoringController(address string, port int, cfg *config.MetricsConfiguration, consul *api.Client, logger *logging.Logger) (Controller, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
@@ -47,20 +47,18 @@ func NewConsulIntegrationMonitoringController(address string, port int, consul *
 		return nil, err
 	}
 
-	metrics, err := newMetrics()
+	metrics, err := newMetrics(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	return &consulIntegrationController{
 		noIntegrationController: noIntegrationController{
-			Shutdown:         make(chan bool),
-			ShutdownComplete: make(chan bool),
-			httpAddress:      address,
-			httpPort:         port,
-			httpServer:       server,
-			logger:           logger,
-			promMetrics:      metrics,
+			httpAddress: address,
+			httpPort:    port,
+			httpServer:  server,
+			logger:      logger,
+			promMetrics: metrics,
 		},
 		consulClient:    consul,
 		consulServiceID: fmt.Sprintf("servicegateway-%s", hostname),
@@ -79,7 +77,7 @@ func (m *consulIntegrationController) Start() error {
 		Name: "servicegateway",
 		Port: m.httpPort,
 		Check: &api.AgentServiceCheck{
-			HTTP:     fmt.Sprintf("http://localhost:%d/status", m.httpPort),
+			HTTP:     fmt.Sprintf("http://localhost:%d/readyz", m.httpPort),
 			Interval: "30s",
 		},
 	}
@@ -92,40 +90,18 @@ func (m *consulIntegrationController) Start() error {
 	}
 
 	m.promMetrics.Init()
-
-	go func() {
-		err := http.ListenAndServe(fmt.Sprintf("%s:%d", m.httpAddress, m.httpPort), m.httpServer)
-		if err != nil {
-			m.logger.Error(err)
-		}
-	}()
-
-	go func() {
-		<-m.Shutdown
-		err := m.shutdown()
-		m.logger.Error(err)
-	}()
+	m.listen()
 
 	return nil
 }
 
-func (m *consulIntegrationController) shutdown() error {
+// Deregister removes the node from Consul.
+func (m *consulIntegrationController) Deregister() error {
 	if err := m.consulClient.Agent().ServiceDeregister(m.consulServiceID); err != nil {
 		m.logger.Errorf("Error while deregistering service in Consul: %s", err)
 		return err
-	} else {
-		m.logger.Info("Successfully deregistered service in Consul")
 	}
 
-	m.ShutdownComplete <- true
-
+	m.logger.Info("Successfully deregistered service in Consul")
 	return nil
 }
-
-func (m *consulIntegrationController) SendShutdown() {
-	m.Shutdown <- true
-}
-
-func (m *consulIntegrationController) WaitForShutdown() {
-	<-m.ShutdownComplete
-}
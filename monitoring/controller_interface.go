@@ -19,11 +19,23 @@ package monitoring
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
 
+import "context"
+
 type Controller interface {
 	Metrics() *PromMetrics
 	Start() error
-	shutdown() error
 
-	SendShutdown()
-	WaitForShutdown()
+	// SetReady controls whether the status endpoint reports the gateway as
+	// ready to receive traffic.
+	SetReady(ready bool)
+
+	// AddHealthCheck registers a dependency check for the readiness endpoint.
+	AddHealthCheck(check HealthCheck)
+
+	// Deregister removes the gateway from service discovery, so that no new
+	// traffic is routed to it while it drains its connections.
+	Deregister() error
+
+	// Shutdown stops the monitoring server.
+	Shutdown(ctx context.Context) error
 }
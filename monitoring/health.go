@@ -0,0 +1,120 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// HealthCheck tests whether a dependency of the gateway is available. When a
+// critical check fails, the gateway reports itself as not ready.
+type HealthCheck struct {
+	Name     string
+	Critical bool
+	Check    func() error
+}
+
+// HealthChecker is implemented by components that can test their own
+// connections, like the AMQP logger.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+type healthCheckResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status string                       `json:"status"`
+	Ready  bool                         `json:"ready"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+// AddHealthCheck registers a check that is run on each readiness request.
+func (s *MonitoringServer) AddHealthCheck(check HealthCheck) {
+	s.checksLock.Lock()
+	defer s.checksLock.Unlock()
+
+	s.checks = append(s.checks, check)
+}
+
+func (s *MonitoringServer) runHealthChecks() map[string]healthCheckResult {
+	s.checksLock.RLock()
+	checks := s.checks
+	s.checksLock.RUnlock()
+
+	results := make(map[string]healthCheckResult, len(checks))
+	resultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+
+			result := healthCheckResult{Status: "ok", Critical: check.Critical}
+			if err := runWithTimeout(check.Check, healthCheckTimeout); err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+
+			resultsLock.Lock()
+			results[check.Name] = result
+			resultsLock.Unlock()
+		}(check)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func runWithTimeout(check func() error, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("check timed out after %s", timeout)
+	}
+}
+
+func (s *MonitoringServer) serveReadiness(res http.ResponseWriter, req *http.Request) {
+	report := readinessReport{
+		Status: "ok",
+		Ready:  s.ready.Load(),
+		Checks: s.runHealthChecks(),
+	}
+
+	for _, result := range report.Checks {
+		if result.Status == "ok" {
+			continue
+		}
+
+		if result.Critical {
+			report.Status = "unavailable"
+		} else if report.Status == "ok" {
+			report.Status = "degraded"
+		}
+	}
+
+	if !report.Ready {
+		report.Status = "unavailable"
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if report.Status == "unavailable" {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(res).Encode(&report)
+}
@@ -0,0 +1,79 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readiness(t *testing.T, s *MonitoringServer) (int, readinessReport) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report readinessReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	var cacheErr, redisErr error
+
+	s, _ := NewMonitoringServer()
+	s.SetReady(true)
+	s.AddHealthCheck(HealthCheck{Name: "redis", Critical: true, Check: func() error { return redisErr }})
+	s.AddHealthCheck(HealthCheck{Name: "cache", Check: func() error { return cacheErr }})
+
+	cases := []struct {
+		cacheErr error
+		redisErr error
+		ready    bool
+		code     int
+		status   string
+	}{
+		{nil, nil, true, http.StatusOK, "ok"},
+		{fmt.Errorf("down"), nil, true, http.StatusOK, "degraded"},
+		{fmt.Errorf("down"), fmt.Errorf("down"), true, http.StatusServiceUnavailable, "unavailable"},
+		{nil, nil, false, http.StatusServiceUnavailable, "unavailable"},
+	}
+
+	for i, c := range cases {
+		cacheErr, redisErr = c.cacheErr, c.redisErr
+		s.SetReady(c.ready)
+
+		code, report := readiness(t, s)
+		if code != c.code || report.Status != c.status || report.Ready != c.ready {
+			t.Errorf("case %d: expected %d %s, got %d %+v", i, c.code, c.status, code, report)
+		}
+		if c.cacheErr != nil && report.Checks["cache"].Error != "down" {
+			t.Errorf("case %d: expected error of failed check to be reported, got %+v", i, report.Checks)
+		}
+	}
+
+	// liveness does not depend on readiness or dependencies
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected gateway to be live, got %d", rec.Code)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	err := runWithTimeout(func() error {
+		<-release
+		return nil
+	}, 10*time.Millisecond)
+
+	if err == nil {
+		t.Error("expected hanging check to time out")
+	}
+}
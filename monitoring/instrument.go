@@ -0,0 +1,105 @@
+package monitoring
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatusClass groups a status code into its class, like "2xx".
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// InstrumentHandler records request counts, durations, sizes and in-flight
+// requests of an application.
+func (m *PromMetrics) InstrumentHandler(appName string, handler httprouter.Handle) httprouter.Handle {
+	inFlight := m.InFlight.With(prometheus.Labels{"application": appName})
+	requestSizes := m.RequestSizes.With(prometheus.Labels{"application": appName})
+	responseSizes := m.ResponseSizes.With(prometheus.Labels{"application": appName})
+
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		started := time.Now()
+
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = body
+		}
+
+		writer := &countingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+
+		handler(writer, req, params)
+
+		labels := prometheus.Labels{"application": appName, "method": req.Method, "status_class": StatusClass(writer.status)}
+		m.Requests.With(labels).Inc()
+		m.RequestDurations.With(labels).Observe(time.Since(started).Seconds())
+
+		requestSize := body.bytes
+		if req.ContentLength > requestSize {
+			requestSize = req.ContentLength
+		}
+		requestSizes.Observe(float64(requestSize))
+		responseSizes.Observe(float64(writer.bytes))
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
@@ -19,31 +19,90 @@ package monitoring
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// DefaultLatencyBuckets range from 5ms to 10s.
+	DefaultLatencyBuckets = prometheus.DefBuckets
+
+	// DefaultSizeBuckets range from 100 bytes to 10 megabytes.
+	DefaultSizeBuckets = prometheus.ExponentialBuckets(100, 10, 6)
+)
 
 type PromMetrics struct {
-	TotalResponseTimes    *prometheus.SummaryVec
-	UpstreamResponseTimes *prometheus.SummaryVec
+	TotalResponseTimes    *prometheus.HistogramVec
+	UpstreamResponseTimes *prometheus.HistogramVec
+	BackendResponseTimes  *prometheus.HistogramVec
+	BackendResponses      *prometheus.CounterVec
 	Errors                *prometheus.CounterVec
+	ScriptDurations       *prometheus.HistogramVec
+	ScriptFailures        *prometheus.CounterVec
+
+	Requests         *prometheus.CounterVec
+	RequestDurations *prometheus.HistogramVec
+	RequestSizes     *prometheus.HistogramVec
+	ResponseSizes    *prometheus.HistogramVec
+	InFlight         *prometheus.GaugeVec
+
+	CacheResults        *prometheus.CounterVec
+	CachePurges         *prometheus.CounterVec
+	RateLimitRejections *prometheus.CounterVec
+	AuthResults         *prometheus.CounterVec
+	Logins              *prometheus.CounterVec
+	TokenStoreDurations *prometheus.HistogramVec
+
+	AuditEvents      *prometheus.CounterVec
+	AuditQueueLength *prometheus.GaugeVec
+	AuditSpooled     *prometheus.GaugeVec
 }
 
-func newMetrics() (*PromMetrics, error) {
+func newMetrics(cfg *config.MetricsConfiguration) (*PromMetrics, error) {
 	p := new(PromMetrics)
 
-	p.TotalResponseTimes = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	latencyBuckets := DefaultLatencyBuckets
+	if len(cfg.LatencyBuckets) > 0 {
+		latencyBuckets = cfg.LatencyBuckets
+	}
+
+	sizeBuckets := DefaultSizeBuckets
+	if len(cfg.SizeBuckets) > 0 {
+		sizeBuckets = cfg.SizeBuckets
+	}
+
+	p.TotalResponseTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "servicegateway",
 		Subsystem: "proxy",
 		Name:      "total_times_seconds",
 		Help:      "HTTP total response times",
+		Buckets:   latencyBuckets,
 	}, []string{"application"})
 
-	p.UpstreamResponseTimes = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	p.UpstreamResponseTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "servicegateway",
 		Subsystem: "proxy",
 		Name:      "upstream_times_seconds",
 		Help:      "HTTP upstream response times",
+		Buckets:   latencyBuckets,
 	}, []string{"application"})
 
+	p.BackendResponseTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "backend_times_seconds",
+		Help:      "HTTP upstream response times by backend",
+		Buckets:   latencyBuckets,
+	}, []string{"application", "backend"})
+
+	p.BackendResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "backend_responses_total",
+		Help:      "HTTP upstream responses by backend and status class (2xx, 3xx, ..., or error if the backend was unavailable)",
+	}, []string{"application", "backend", "status_class"})
+
 	p.Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "servicegateway",
 		Subsystem: "proxy",
@@ -51,11 +110,146 @@ func newMetrics() (*PromMetrics, error) {
 		Help:      "HTTP proxy errors",
 	}, []string{"application", "reason"})
 
+	p.ScriptDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "scripting",
+		Name:      "call_times_seconds",
+		Help:      "Execution times of script calls",
+		Buckets:   latencyBuckets,
+	}, []string{"script"})
+
+	p.ScriptFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "scripting",
+		Name:      "failures",
+		Help:      "Failed script calls by reason (exception, timeout, canceled, stack_overflow, pool_exhausted, invalid_result)",
+	}, []string{"script", "reason"})
+
+	p.Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by application, method and status class (2xx, 3xx, ...)",
+	}, []string{"application", "method", "status_class"})
+
+	p.RequestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request durations, including authentication, caching and scripts",
+		Buckets:   latencyBuckets,
+	}, []string{"application", "method", "status_class"})
+
+	p.RequestSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "request_size_bytes",
+		Help:      "HTTP request body sizes",
+		Buckets:   sizeBuckets,
+	}, []string{"application"})
+
+	p.ResponseSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "response_size_bytes",
+		Help:      "HTTP response body sizes",
+		Buckets:   sizeBuckets,
+	}, []string{"application"})
+
+	p.InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "HTTP requests currently being served",
+	}, []string{"application"})
+
+	p.CacheResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Cacheable requests by result (hit, miss, pass)",
+	}, []string{"application", "result"})
+
+	p.CachePurges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "cache",
+		Name:      "purges_total",
+		Help:      "Cache entries purged by unsafe requests",
+	}, []string{"application"})
+
+	p.RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "ratelimit",
+		Name:      "rejections_total",
+		Help:      "Requests rejected because the rate limit was exceeded",
+	}, []string{"application"})
+
+	p.AuthResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "requests_total",
+		Help:      "Authentication checks of proxied requests by outcome (authenticated, unauthenticated, forbidden_application, insufficient_scope, provider, error)",
+	}, []string{"application", "outcome"})
+
+	p.Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "logins_total",
+		Help:      "Login attempts by endpoint (authenticate, challenge) and outcome (success, incomplete, invalid_credentials, invalid_challenge, locked_out, error)",
+	}, []string{"endpoint", "outcome"})
+
+	p.TokenStoreDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "tokenstore",
+		Name:      "operation_duration_seconds",
+		Help:      "Token store operation durations by operation and result (ok, miss, error)",
+		Buckets:   latencyBuckets,
+	}, []string{"operation", "result"})
+
+	p.AuditEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "audit",
+		Name:      "events_total",
+		Help:      "Audit events by sink and result (queued, confirmed, spooled, dropped)",
+	}, []string{"sink", "result"})
+
+	p.AuditQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "audit",
+		Name:      "queue_length",
+		Help:      "Audit events waiting in memory to be published",
+	}, []string{"sink"})
+
+	p.AuditSpooled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "audit",
+		Name:      "spooled_events",
+		Help:      "Audit events waiting on disk to be published",
+	}, []string{"sink"})
+
 	return p, nil
 }
 
 func (m *PromMetrics) Init() {
 	prometheus.MustRegister(m.TotalResponseTimes)
 	prometheus.MustRegister(m.UpstreamResponseTimes)
+	prometheus.MustRegister(m.BackendResponseTimes)
+	prometheus.MustRegister(m.BackendResponses)
 	prometheus.MustRegister(m.Errors)
+	prometheus.MustRegister(m.ScriptDurations)
+	prometheus.MustRegister(m.ScriptFailures)
+	prometheus.MustRegister(m.Requests)
+	prometheus.MustRegister(m.RequestDurations)
+	prometheus.MustRegister(m.RequestSizes)
+	prometheus.MustRegister(m.ResponseSizes)
+	prometheus.MustRegister(m.InFlight)
+	prometheus.MustRegister(m.CacheResults)
+	prometheus.MustRegister(m.CachePurges)
+	prometheus.MustRegister(m.RateLimitRejections)
+	prometheus.MustRegister(m.AuthResults)
+	prometheus.MustRegister(m.Logins)
+	prometheus.MustRegister(m.TokenStoreDurations)
+	prometheus.MustRegister(m.AuditEvents)
+	prometheus.MustRegister(m.AuditQueueLength)
+	prometheus.MustRegister(m.AuditSpooled)
 }
@@ -20,45 +20,43 @@ package monitoring
  */
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/mittwald/servicegateway/config"
 	"github.com/op/go-logging"
 
 	"net/http"
 )
 
 type noIntegrationController struct {
-	Shutdown         chan bool
-	ShutdownComplete chan bool
-
 	httpAddress string
 	httpPort    int
 	httpServer  *MonitoringServer
+	server      *http.Server
 
 	logger *logging.Logger
 
 	promMetrics *PromMetrics
 }
 
-func NewNoIntegrationMonitoringController(address string, port int, logger *logging.Logger) (Controller, error) {
+func NewNoIntegrationMonitoringController(address string, port int, cfg *config.MetricsConfiguration, logger *logging.Logger) (Controller, error) {
 	server, err := NewMonitoringServer()
 	if err != nil {
 		return nil, err
 	}
 
-	metrics, err := newMetrics()
+	metrics, err := newMetrics(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	return &noIntegrationController{
-		Shutdown:         make(chan bool),
-		ShutdownComplete: make(chan bool),
-		httpAddress:      address,
-		httpPort:         port,
-		httpServer:       server,
-		logger:           logger,
-		promMetrics:      metrics,
+		httpAddress: address,
+		httpPort:    port,
+		httpServer:  server,
+		logger:      logger,
+		promMetrics: metrics,
 	}, nil
 }
 
@@ -68,33 +66,34 @@ func (m *noIntegrationController) Metrics() *PromMetrics {
 
 func (m *noIntegrationController) Start() error {
 	m.promMetrics.Init()
+	m.listen()
+
+	return nil
+}
+
+func (m *noIntegrationController) listen() {
+	m.server = &http.Server{Addr: fmt.Sprintf("%s:%d", m.httpAddress, m.httpPort), Handler: m.httpServer}
 
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf("%s:%d", m.httpAddress, m.httpPort), m.httpServer)
-		if err != nil {
+		err := m.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			m.logger.Error(err)
 		}
 	}()
-
-	go func() {
-		<-m.Shutdown
-		err := m.shutdown()
-		m.logger.Error(err)
-	}()
-
-	return nil
 }
 
-func (m *noIntegrationController) shutdown() error {
-	m.ShutdownComplete <- true
+func (m *noIntegrationController) SetReady(ready bool) {
+	m.httpServer.SetReady(ready)
+}
 
-	return nil
+func (m *noIntegrationController) AddHealthCheck(check HealthCheck) {
+	m.httpServer.AddHealthCheck(check)
 }
 
-func (m *noIntegrationController) SendShutdown() {
-	m.Shutdown <- true
+func (m *noIntegrationController) Deregister() error {
+	return nil
 }
 
-func (m *noIntegrationController) WaitForShutdown() {
-	<-m.ShutdownComplete
+func (m *noIntegrationController) Shutdown(ctx context.Context) error {
+	return m.server.Shutdown(ctx)
 }
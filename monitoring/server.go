@@ -21,28 +21,53 @@ package monitoring
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type MonitoringServer struct {
-}
+	ready atomic.Bool
+	mux   *httprouter.Router
 
-func NewMonitoringServer() (*MonitoringServer, error) {
-	return &MonitoringServer{}, nil
+	checksLock sync.RWMutex
+	checks     []HealthCheck
 }
 
-func (s *MonitoringServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+func NewMonitoringServer() (*MonitoringServer, error) {
+	s := &MonitoringServer{}
 	promHandler := promhttp.Handler()
 
-	mux := httprouter.New()
-	mux.GET("/status", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mux = httprouter.New()
+	s.mux.GET("/status", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		if !s.ready.Load() {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = res.Write([]byte("Not ready"))
+			return
+		}
 		_, _ = res.Write([]byte("Hallo Welt!"))
 	})
-	mux.GET("/metrics", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mux.GET("/healthz", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		_, _ = res.Write([]byte("OK"))
+	})
+	s.mux.GET("/readyz", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.serveReadiness(res, req)
+	})
+	s.mux.GET("/metrics", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		promHandler.ServeHTTP(res, req)
 	})
 
-	mux.ServeHTTP(res, req)
+	return s, nil
+}
+
+// SetReady controls whether the /status and /readyz endpoints report success.
+// The server starts out as not ready.
+func (s *MonitoringServer) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+func (s *MonitoringServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(res, req)
 }
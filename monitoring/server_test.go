@@ -0,0 +1,32 @@
+package monitoring
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func status(s *MonitoringServer, path string) int {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestStatusReportsReadiness(t *testing.T) {
+	s, _ := NewMonitoringServer()
+
+	if code := status(s, "/status"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected server not to be ready before startup, got %d", code)
+	}
+
+	s.SetReady(true)
+	if code := status(s, "/status"); code != http.StatusOK {
+		t.Errorf("expected server to be ready, got %d", code)
+	}
+
+	// on shutdown, the server reports itself as not ready while draining
+	s.SetReady(false)
+	if code := status(s, "/status"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected server not to be ready during shutdown, got %d", code)
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestinfo"
+)
+
+// DefaultBackend is the name of the backend of applications that have a
+// single backend.
+const DefaultBackend = "default"
+
+var (
+	validTargetName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	invalidCookie   = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// BackendSelector chooses the backend that a request to an application is
+// sent to.
+type BackendSelector struct {
+	targets []backendTarget
+	byName  map[string]*backendTarget
+	total   int
+	rules   []backendRule
+
+	stickyCookie string
+	stickyMaxAge int
+
+	verifier *auth.JwtVerifier
+}
+
+type backendTarget struct {
+	name   string
+	url    string
+	weight int
+}
+
+type backendRule struct {
+	header string
+	cookie string
+	claim  string
+	value  string
+	target *backendTarget
+}
+
+// BackendURL returns the URL of a backend that is given either by URL or by
+// Consul service name and tag.
+func BackendURL(url string, service string, tag string) string {
+	if url == "" && service != "" {
+		if tag != "" {
+			return fmt.Sprintf("http://%s.%s.service.consul", tag, service)
+		}
+		return fmt.Sprintf("http://%s.service.consul", service)
+	}
+	return url
+}
+
+// NewBackendSelector compiles the backend configuration of an application.
+// The verifier is used to decode the claims that rules match against.
+func NewBackendSelector(appName string, cfg *config.Backend, verifier *auth.JwtVerifier) (*BackendSelector, error) {
+	b := BackendSelector{byName: make(map[string]*backendTarget), verifier: verifier}
+
+	if len(cfg.Targets) == 0 {
+		if len(cfg.Rules) > 0 || cfg.Sticky != nil {
+			return nil, fmt.Errorf("rules and sticky require targets")
+		}
+
+		b.targets = []backendTarget{{name: DefaultBackend, url: BackendURL(cfg.Url, cfg.Service, cfg.Tag), weight: 1}}
+		b.byName[DefaultBackend] = &b.targets[0]
+		b.total = 1
+
+		if err := b.validateURLs(); err != nil {
+			return nil, err
+		}
+		return &b, nil
+	}
+
+	if cfg.Url != "" || cfg.Service != "" {
+		return nil, fmt.Errorf("url and service cannot be combined with targets")
+	}
+
+	b.targets = make([]backendTarget, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		if !validTargetName.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid target name '%s'", t.Name)
+		}
+
+		if _, ok := b.byName[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate target '%s'", t.Name)
+		}
+
+		if (t.Url == "") == (t.Service == "") {
+			return nil, fmt.Errorf("target '%s' needs either a url or a service", t.Name)
+		}
+
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("weight of target '%s' must not be negative", t.Name)
+		}
+
+		b.targets[i] = backendTarget{name: t.Name, url: BackendURL(t.Url, t.Service, t.Tag), weight: t.Weight}
+		b.byName[t.Name] = &b.targets[i]
+		b.total += t.Weight
+	}
+
+	if b.total == 0 {
+		return nil, fmt.Errorf("at least one target needs a positive weight")
+	}
+
+	if err := b.validateURLs(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range cfg.Rules {
+		target, ok := b.byName[r.Target]
+		if !ok {
+			return nil, fmt.Errorf("rule refers to unknown target '%s'", r.Target)
+		}
+
+		set := 0
+		for _, s := range []string{r.Header, r.Cookie, r.Claim} {
+			if s != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("rule for target '%s' needs exactly one of header, cookie or claim", r.Target)
+		}
+
+		b.rules = append(b.rules, backendRule{header: r.Header, cookie: r.Cookie, claim: r.Claim, value: r.Value, target: target})
+	}
+
+	if cfg.Sticky != nil {
+		b.stickyCookie = cfg.Sticky.Cookie
+		if b.stickyCookie == "" {
+			b.stickyCookie = "sg_backend_" + invalidCookie.ReplaceAllString(appName, "_")
+		}
+
+		b.stickyMaxAge = cfg.Sticky.MaxAge
+		if b.stickyMaxAge < 0 {
+			return nil, fmt.Errorf("max_age must not be negative")
+		}
+	}
+
+	return &b, nil
+}
+
+func (b *BackendSelector) validateURLs() error {
+	for i := range b.targets {
+		if _, err := url.Parse(b.targets[i].url); err != nil {
+			return fmt.Errorf("invalid URL of backend '%s': %s", b.targets[i].name, err)
+		}
+	}
+	return nil
+}
+
+// URLs returns the URLs of all backends.
+func (b *BackendSelector) URLs() []string {
+	urls := make([]string, len(b.targets))
+	for i := range b.targets {
+		urls[i] = b.targets[i].url
+	}
+	return urls
+}
+
+// DecorateHandler selects the backend of each request before the request is
+// passed on, so that the wrapped handlers (like the response cache) can tell
+// the backends apart.
+func (b *BackendSelector) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		name, _ := b.Select(rw, req)
+		requestinfo.Get(req).Backend = name
+
+		handler(rw, req, params)
+	}
+}
+
+// Select returns the name and URL of the backend for a request. A backend
+// that was already selected for the request is kept. Rules take precedence
+// over sticky assignments, which take precedence over the weights. Clients
+// that are assigned by weight get a cookie if sticky assignment is enabled.
+func (b *BackendSelector) Select(rw http.ResponseWriter, req *http.Request) (string, string) {
+	if len(b.targets) == 1 {
+		return b.targets[0].name, b.targets[0].url
+	}
+
+	if t, ok := b.byName[requestinfo.Get(req).Backend]; ok {
+		return t.name, t.url
+	}
+
+	var claims jwt.MapClaims
+
+	for i := range b.rules {
+		r := &b.rules[i]
+
+		if r.claim != "" && claims == nil {
+			claims = b.requestClaims(req)
+		}
+
+		if r.matches(req, claims) {
+			return r.target.name, r.target.url
+		}
+	}
+
+	if b.stickyCookie != "" {
+		if cookie, err := req.Cookie(b.stickyCookie); err == nil {
+			if t, ok := b.byName[cookie.Value]; ok && t.weight > 0 {
+				return t.name, t.url
+			}
+		}
+	}
+
+	n := rand.Intn(b.total)
+	target := &b.targets[len(b.targets)-1]
+
+	for i := range b.targets {
+		if n < b.targets[i].weight {
+			target = &b.targets[i]
+			break
+		}
+		n -= b.targets[i].weight
+	}
+
+	if b.stickyCookie != "" {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     b.stickyCookie,
+			Value:    target.name,
+			Path:     "/",
+			MaxAge:   b.stickyMaxAge,
+			Secure:   req.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return target.name, target.url
+}
+
+func (r *backendRule) matches(req *http.Request, claims jwt.MapClaims) bool {
+	switch {
+	case r.header != "":
+		values := req.Header.Values(r.header)
+		for _, v := range values {
+			if r.value == "" || v == r.value {
+				return true
+			}
+		}
+	case r.cookie != "":
+		if cookie, err := req.Cookie(r.cookie); err == nil {
+			return r.value == "" || cookie.Value == r.value
+		}
+	case r.claim != "":
+		claim, ok := claims[r.claim]
+		if !ok || claim == nil {
+			return false
+		}
+
+		if r.value == "" {
+			return true
+		}
+
+		// Claims like "groups" match if any of their elements matches.
+		if list, ok := claim.([]interface{}); ok {
+			for _, element := range list {
+				if claimString(element) == r.value {
+					return true
+				}
+			}
+			return false
+		}
+
+		return claimString(claim) == r.value
+	}
+
+	return false
+}
+
+// requestClaims returns the claims of the authenticated user of a request.
+// The token was verified by the authentication handler.
+func (b *BackendSelector) requestClaims(req *http.Request) jwt.MapClaims {
+	if token := requestinfo.Get(req).JWT; token != "" && b.verifier != nil {
+		if claims, err := b.verifier.DecodeClaims(token); err == nil {
+			return claims
+		}
+	}
+
+	return jwt.MapClaims{}
+}
+
+func claimString(claim interface{}) string {
+	if s, ok := claim.(string); ok {
+		return s
+	}
+
+	encoded, _ := json.Marshal(claim)
+	return string(encoded)
+}
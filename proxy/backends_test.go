@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestinfo"
+)
+
+func newTestSelector(t *testing.T, cfg config.Backend) *BackendSelector {
+	t.Helper()
+
+	verifier, err := auth.NewJwtVerifier(&config.GlobalAuth{KeyCacheTtl: "1m"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	b, err := NewBackendSelector("app", &cfg, verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return b
+}
+
+func TestBackendSelectorSingleBackend(t *testing.T) {
+	b := newTestSelector(t, config.Backend{Service: "users", Tag: "v2"})
+
+	name, url := b.Select(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if name != DefaultBackend || url != "http://v2.users.service.consul" {
+		t.Fatalf("unexpected backend %s (%s)", name, url)
+	}
+}
+
+func TestBackendSelectorRejectsInvalidConfig(t *testing.T) {
+	cases := map[string]config.Backend{
+		"rules without targets": {Url: "http://a", Rules: []config.BackendRule{{Header: "X", Target: "a"}}},
+		"url with targets":      {Url: "http://a", Targets: []config.BackendTarget{{Name: "a", Url: "http://a", Weight: 1}}},
+		"duplicate target":      {Targets: []config.BackendTarget{{Name: "a", Url: "http://a", Weight: 1}, {Name: "a", Url: "http://b"}}},
+		"zero total weight":     {Targets: []config.BackendTarget{{Name: "a", Url: "http://a"}}},
+		"unknown rule target":   {Targets: []config.BackendTarget{{Name: "a", Url: "http://a", Weight: 1}}, Rules: []config.BackendRule{{Header: "X", Target: "b"}}},
+		"ambiguous rule":        {Targets: []config.BackendTarget{{Name: "a", Url: "http://a", Weight: 1}}, Rules: []config.BackendRule{{Header: "X", Cookie: "y", Target: "a"}}},
+	}
+
+	for name, cfg := range cases {
+		if _, err := NewBackendSelector("app", &cfg, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBackendSelectorRules(t *testing.T) {
+	b := newTestSelector(t, config.Backend{
+		Targets: []config.BackendTarget{
+			{Name: "stable", Url: "http://stable", Weight: 1},
+			{Name: "canary", Url: "http://canary"},
+		},
+		Rules: []config.BackendRule{
+			{Header: "X-Canary", Value: "1", Target: "canary"},
+			{Cookie: "beta", Target: "canary"},
+			{Claim: "groups", Value: "testers", Target: "canary"},
+		},
+	})
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"groups": []string{"admins", "testers"}}).SignedString([]byte("secret"))
+
+	cases := []struct {
+		name    string
+		prepare func(*http.Request) *http.Request
+		backend string
+	}{
+		{"no rule", func(r *http.Request) *http.Request { return r }, "stable"},
+		{"header", func(r *http.Request) *http.Request { r.Header.Set("X-Canary", "1"); return r }, "canary"},
+		{"header value", func(r *http.Request) *http.Request { r.Header.Set("X-Canary", "0"); return r }, "stable"},
+		{"cookie", func(r *http.Request) *http.Request { r.AddCookie(&http.Cookie{Name: "beta", Value: "x"}); return r }, "canary"},
+		{"claim", func(r *http.Request) *http.Request {
+			r, info := requestinfo.New(r)
+			info.JWT = token
+			return r
+		}, "canary"},
+	}
+
+	for _, c := range cases {
+		req := c.prepare(httptest.NewRequest("GET", "/", nil))
+
+		if name, _ := b.Select(httptest.NewRecorder(), req); name != c.backend {
+			t.Errorf("%s: expected backend %s, got %s", c.name, c.backend, name)
+		}
+	}
+}
+
+func TestBackendSelectorSticky(t *testing.T) {
+	b := newTestSelector(t, config.Backend{
+		Targets: []config.BackendTarget{
+			{Name: "a", Url: "http://a", Weight: 1},
+			{Name: "b", Url: "http://b", Weight: 1},
+		},
+		Sticky: &config.BackendSticky{MaxAge: 60},
+	})
+
+	rec := httptest.NewRecorder()
+	name, _ := b.Select(rec, httptest.NewRequest("GET", "/", nil))
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sg_backend_app" || cookies[0].Value != name {
+		t.Fatalf("expected sticky cookie for backend %s, got %v", name, cookies)
+	}
+
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+
+		if again, _ := b.Select(httptest.NewRecorder(), req); again != name {
+			t.Fatalf("sticky client moved from backend %s to %s", name, again)
+		}
+	}
+}
+
+func TestBackendSelectorDecorateHandler(t *testing.T) {
+	b := newTestSelector(t, config.Backend{
+		Targets: []config.BackendTarget{
+			{Name: "a", Url: "http://a", Weight: 1},
+			{Name: "b", Url: "http://b", Weight: 1},
+		},
+		Sticky: &config.BackendSticky{},
+	})
+
+	req, info := requestinfo.New(httptest.NewRequest("GET", "/", nil))
+	rec := httptest.NewRecorder()
+
+	var selected string
+	b.DecorateHandler(func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		selected = info.Backend
+
+		// Selecting again must neither change the backend nor set the
+		// cookie a second time.
+		if name, _ := b.Select(rw, req); name != selected {
+			t.Errorf("expected backend %s to be kept, got %s", selected, name)
+		}
+	})(rec, req, nil)
+
+	if selected == "" {
+		t.Fatal("expected backend to be selected before the handler was called")
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != selected {
+		t.Errorf("expected one sticky cookie for backend %s, got %v", selected, cookies)
+	}
+}
+
+func TestBackendSelectorURLs(t *testing.T) {
+	b := newTestSelector(t, config.Backend{
+		Targets: []config.BackendTarget{
+			{Name: "a", Url: "http://a", Weight: 1},
+			{Name: "b", Service: "b"},
+		},
+	})
+
+	urls := b.URLs()
+	if len(urls) != 2 || urls[0] != "http://a" || urls[1] != "http://b.service.consul" {
+		t.Fatalf("unexpected URLs %v", urls)
+	}
+}
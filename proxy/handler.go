@@ -22,15 +22,24 @@ package proxy
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/headers"
 	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/requestinfo"
+	"github.com/mittwald/servicegateway/tracing"
 	logging "github.com/op/go-logging"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var redirectRequest error = errors.New("redirect")
@@ -41,6 +50,9 @@ type ProxyHandler struct {
 	Config *config.Configuration
 
 	metrics *monitoring.PromMetrics
+
+	clientsLock sync.Mutex
+	clients     map[config.BackendTLS]*http.Client
 }
 
 func NewProxyHandler(logger *logging.Logger, config *config.Configuration, metrics *monitoring.PromMetrics) *ProxyHandler {
@@ -65,7 +77,7 @@ func (p *ProxyHandler) UnavailableError(rw http.ResponseWriter, req *http.Reques
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(503)
-	_, _ = rw.Write([]byte("{\"msg\": \"service unavailable\", \"reason\": \"no can do; sorry.\"}"))
+	_, _ = rw.Write([]byte(fmt.Sprintf("{\"msg\": \"service unavailable\", \"reason\": \"no can do; sorry.\", \"request_id\": \"%s\"}", requestid.FromRequest(req))))
 }
 
 func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Request, targetUrl string, appName string, appCfg *config.Application) {
@@ -96,34 +108,80 @@ func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Requ
 		proxyReq.Header.Set("X-Forwarded-For", ip)
 	}
 
+	if req.TLS != nil {
+		proxyReq.Header.Set("X-Forwarded-Proto", "https")
+	}
+
 	for header, value := range p.Config.Proxy.SetRequestHeaders {
 		proxyReq.Header.Set(header, value)
 	}
 
+	headers.ApplyRequest(req, proxyReq.Header)
+
 	if appCfg.Backend.Username != "" {
 		proxyReq.SetBasicAuth(appCfg.Backend.Username, appCfg.Backend.Password)
 	}
 
-	proxyReq.URL.RawQuery = req.URL.RawQuery
+	client, err := p.clientFor(&appCfg.Backend)
+	if err != nil {
+		requestid.NewLogger(req.Context(), p.Logger).Errorf("invalid TLS configuration for backend of %s: %s", appName, err)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
+	ctx, span := tracing.Start(
+		req.Context(),
+		"proxy.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", proxyReq.Method),
+			attribute.String("server.address", proxyReq.URL.Host),
+			attribute.String("url.path", proxyReq.URL.Path),
+		),
+	)
+	tracing.Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	info := requestinfo.Get(req)
+	backend := info.Backend
+	if backend == "" {
+		backend = DefaultBackend
+	}
 
 	upstreamStart = time.Now()
 
-	proxyRes, err := p.Client.Do(proxyReq)
+	proxyRes, err := client.Do(proxyReq)
 	if err != nil {
 		if uerr, ok := err.(*url.Error); !ok || uerr.Err != redirectRequest {
-			p.Logger.Errorf("could not proxy request to %s: %s", targetUrl, uerr)
+			p.metrics.BackendResponses.With(prometheus.Labels{"application": appName, "backend": backend, "status_class": "error"}).Inc()
+			tracing.End(span, err)
+			requestid.NewLogger(req.Context(), p.Logger).Errorf("could not proxy request to %s: %s", targetUrl, uerr)
 			p.UnavailableError(rw, req, appName)
 			return
 		}
 	}
 
-	p.metrics.UpstreamResponseTimes.With(prometheus.Labels{"application": appName}).Observe(time.Since(upstreamStart).Seconds())
+	span.SetAttributes(attribute.Int("http.response.status_code", proxyRes.StatusCode))
+	defer span.End()
+
+	upstreamDuration := time.Since(upstreamStart)
+	p.metrics.UpstreamResponseTimes.With(prometheus.Labels{"application": appName}).Observe(upstreamDuration.Seconds())
+	p.metrics.BackendResponseTimes.With(prometheus.Labels{"application": appName, "backend": backend}).Observe(upstreamDuration.Seconds())
+	p.metrics.BackendResponses.With(prometheus.Labels{"application": appName, "backend": backend, "status_class": monitoring.StatusClass(proxyRes.StatusCode)}).Inc()
+
+	info.UpstreamURL = targetUrl
+	info.UpstreamDuration = upstreamDuration
 
 	for header, values := range proxyRes.Header {
 		if _, ok := p.Config.Proxy.StripResponseHeaders[header]; ok {
 			continue
 		}
 
+		// The gateway's request ID takes precedence over the one of the
+		// upstream service.
+		if header == requestid.Header {
+			continue
+		}
+
 		for _, value := range values {
 			rw.Header().Add(header, value)
 		}
@@ -142,6 +200,6 @@ func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Requ
 	p.metrics.TotalResponseTimes.With(prometheus.Labels{"application": appName}).Observe(time.Since(totalStart).Seconds())
 
 	if err != nil {
-		p.Logger.Errorf("error while writing response body: %s", err)
+		requestid.NewLogger(req.Context(), p.Logger).Errorf("error while writing response body: %s", err)
 	}
 }
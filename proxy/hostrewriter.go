@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/requestid"
 	"github.com/op/go-logging"
 )
 
@@ -34,9 +35,11 @@ type mapping struct {
 }
 
 type JsonHostRewriter struct {
-	InternalHost string
-	Mappings     []mapping
-	Logger       *logging.Logger
+	InternalHosts []string
+	Mappings      []mapping
+	Logger        *logging.Logger
+
+	backends []*url.URL
 }
 
 func (m *mapping) repl(matches []string) string {
@@ -47,40 +50,56 @@ func (m *mapping) repl(matches []string) string {
 	return path
 }
 
-func NewHostRewriter(internalHost string, urlPatterns map[string]string, logger *logging.Logger) (HostRewriter, error) {
-	mappings := make([]mapping, len(urlPatterns))
-	i := 0
+// NewHostRewriter returns a rewriter that maps upstream URLs in responses to
+// public URLs. Mappings are tried in order; the first matching one is used.
+// The internal hosts are the URLs of all backends of the application; their
+// path is removed from URLs that point to them before the mappings are
+// applied.
+func NewHostRewriter(internalHosts []string, urlMappings []UrlMapping, logger *logging.Logger) (HostRewriter, error) {
+	mappings := make([]mapping, len(urlMappings))
+	backends := make([]*url.URL, 0, len(internalHosts))
+
+	for _, h := range internalHosts {
+		u, err := url.Parse(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend URL '%s': %s", h, err)
+		}
+		backends = append(backends, u)
+	}
+
+	for i, m := range urlMappings {
+		re, err := regexp.Compile(m.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL mapping '%s': %s", m.Upstream, err)
+		}
 
-	for sourcePattern, targetPattern := range urlPatterns {
-		re := regexp.MustCompile(sourcePattern)
 		replacements := make(map[int]*regexp.Regexp, len(re.SubexpNames()))
 
-		for i, name := range re.SubexpNames() {
+		for j, name := range re.SubexpNames() {
 			if name != "" {
-				replacements[i] = regexp.MustCompile(":" + name)
+				replacements[j] = regexp.MustCompile(":" + name)
 			}
 		}
 
 		mappings[i] = mapping{
 			regex:         re,
-			targetPattern: targetPattern,
+			targetPattern: m.Public,
 			replacements:  replacements,
 		}
-
-		i += 1
 	}
 
 	return &JsonHostRewriter{
-		InternalHost: internalHost,
-		Mappings:     mappings,
-		Logger:       logger,
+		InternalHosts: internalHosts,
+		Mappings:      mappings,
+		Logger:        logger,
+		backends:      backends,
 	}, nil
 }
 
 func (j *JsonHostRewriter) Decorate(handler httprouter.Handle) httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		if req.Header.Get("X-No-Rewrite") != "" {
-			j.Logger.Noticef("skipping json rewriting due to client request")
+			requestid.NewLogger(req.Context(), j.Logger).Noticef("skipping json rewriting due to client request")
 			handler(rw, req, params)
 			return
 		}
@@ -102,7 +121,7 @@ func (j *JsonHostRewriter) Decorate(handler httprouter.Handle) httprouter.Handle
 		if j.CanHandle(recorder) {
 			b, err := ioutil.ReadAll(recorder.Body)
 			if err != nil {
-				j.Logger.Errorf("error while reading response body: %s", err)
+				requestid.NewLogger(req.Context(), j.Logger).Errorf("error while reading response body: %s", err)
 				rw.WriteHeader(500)
 				_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
 			}
@@ -110,7 +129,7 @@ func (j *JsonHostRewriter) Decorate(handler httprouter.Handle) httprouter.Handle
 			if req.Method != "HEAD" {
 				b, err = j.Rewrite(b, &publicUrl)
 				if err != nil {
-					j.Logger.Errorf("error while rewriting response body: %s", err)
+					requestid.NewLogger(req.Context(), j.Logger).Errorf("error while rewriting response body: %s", err)
 					rw.WriteHeader(500)
 					_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
 					return
@@ -129,7 +148,7 @@ func (j *JsonHostRewriter) Decorate(handler httprouter.Handle) httprouter.Handle
 			_, err := reader.WriteTo(rw)
 
 			if err != nil {
-				j.Logger.Errorf("error while writing response body after rewriting: %s", err)
+				requestid.NewLogger(req.Context(), j.Logger).Errorf("error while writing response body after rewriting: %s", err)
 			}
 		}
 	}
@@ -184,8 +203,10 @@ func (j *JsonHostRewriter) RewriteUrl(urlString string, reqUrl *url.URL) (string
 		return urlString, fmt.Errorf("error while parsing url %s: %s", urlString, err)
 	}
 
+	path := j.backendPath(parsedUrl)
+
 	for _, mapping := range j.Mappings {
-		matches := mapping.regex.FindStringSubmatch(parsedUrl.Path)
+		matches := mapping.regex.FindStringSubmatch(path)
 		if matches != nil {
 			parsedUrl.Host = reqUrl.Host
 			parsedUrl.Scheme = reqUrl.Scheme
@@ -197,6 +218,23 @@ func (j *JsonHostRewriter) RewriteUrl(urlString string, reqUrl *url.URL) (string
 	return "", UnmappableUrl
 }
 
+// backendPath returns the path of a URL relative to the backend that it points
+// to, or the unmodified path if it does not point to any backend.
+func (j *JsonHostRewriter) backendPath(u *url.URL) string {
+	for _, b := range j.backends {
+		prefix := strings.TrimRight(b.Path, "/")
+		if prefix == "" || u.Host != b.Host {
+			continue
+		}
+
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return "/" + strings.TrimLeft(strings.TrimPrefix(u.Path, prefix), "/")
+		}
+	}
+
+	return u.Path
+}
+
 func (j *JsonHostRewriter) walkJson(jsonStruct interface{}, reqUrl *url.URL, inLinks bool) (interface{}, error) {
 	switch typed := jsonStruct.(type) {
 	case map[string]interface{}:
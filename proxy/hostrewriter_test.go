@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestHostRewriterMapsUrlsOfAllBackends(t *testing.T) {
+	r, err := NewHostRewriter(
+		[]string{"http://stable:8080/api", "http://canary:8080/api/v2"},
+		[]UrlMapping{{Upstream: `^/users/(?P<id>[^/]+)$`, Public: "/accounts/users/:id"}},
+		logging.MustGetLogger("test"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	public, _ := url.Parse("https://gateway.example/accounts/users")
+
+	cases := map[string]string{
+		"http://stable:8080/api/users/1":    "https://gateway.example/accounts/users/1",
+		"http://canary:8080/api/v2/users/2": "https://gateway.example/accounts/users/2",
+		"/users/3":                          "https://gateway.example/accounts/users/3",
+	}
+
+	for upstream, expected := range cases {
+		if mapped, err := r.RewriteUrl(upstream, public); err != nil || mapped != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", upstream, expected, mapped, err)
+		}
+	}
+
+	if _, err := r.RewriteUrl("http://canary:8080/api/users/1", public); err != UnmappableUrl {
+		t.Errorf("expected URL outside of the backend path to be unmappable, got %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+var (
+	targetPlaceholder  = regexp.MustCompile(`:([a-zA-Z0-9_]+)`)
+	patternPlaceholder = regexp.MustCompile(`(/?)([:*])([a-zA-Z0-9_]+)`)
+)
+
+// UrlMapping maps upstream paths that match the regular expression Upstream
+// to the public path template Public, in which ":name" placeholders are
+// replaced with the named captures of Upstream.
+type UrlMapping struct {
+	Upstream string
+	Public   string
+}
+
+// Rewriter maps the path and query of requests to a route to the upstream
+// URL of the route.
+type Rewriter struct {
+	stripPrefix string
+	match       *regexp.Regexp
+	params      *regexp.Regexp
+	target      []segment
+
+	renameQuery [][2]string
+	removeQuery []string
+	addQuery    []queryParam
+
+	mapping *UrlMapping
+}
+
+// segment is either literal text or a ":name" placeholder of a template.
+type segment struct {
+	literal string
+	name    string
+}
+
+type queryParam struct {
+	name  string
+	value []segment
+}
+
+// NewRewriter compiles the rewrite of a route. Pattern is the route's path
+// pattern, whose parameters may be used in the target. Without a target, the
+// (stripped) request path is used as upstream path.
+func NewRewriter(cfg *config.Rewrite, pattern string) (*Rewriter, error) {
+	r := Rewriter{stripPrefix: strings.TrimRight((&url.URL{Path: cfg.StripPrefix}).EscapedPath(), "/")}
+
+	if pattern != "" {
+		r.params = regexp.MustCompile("^" + patternRegexp(pattern) + "$")
+	}
+
+	// Regular expressions for all variables that may be used in templates.
+	vars := make(map[string]string)
+	for _, m := range patternPlaceholder.FindAllStringSubmatch(pattern, -1) {
+		if m[2] == "*" {
+			vars[m[3]] = ".*"
+		} else {
+			vars[m[3]] = "[^/]+"
+		}
+	}
+
+	var matchSyntax *syntax.Regexp
+
+	if cfg.Match != "" {
+		var err error
+		if r.match, err = regexp.Compile("^(?:" + cfg.Match + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid match expression '%s': %s", cfg.Match, err)
+		}
+
+		if matchSyntax, err = syntax.Parse(cfg.Match, syntax.Perl); err != nil {
+			return nil, fmt.Errorf("invalid match expression '%s': %s", cfg.Match, err)
+		}
+		collectCaptures(matchSyntax, vars)
+	}
+
+	if cfg.Target != "" {
+		var err error
+		if r.target, err = compileTemplate(cfg.Target, vars); err != nil {
+			return nil, fmt.Errorf("invalid target '%s': %s", cfg.Target, err)
+		}
+	}
+
+	r.renameQuery = make([][2]string, 0, len(cfg.Query.Rename))
+	for from, to := range cfg.Query.Rename {
+		r.renameQuery = append(r.renameQuery, [2]string{from, to})
+	}
+	sort.Slice(r.renameQuery, func(i, j int) bool { return r.renameQuery[i][0] < r.renameQuery[j][0] })
+
+	r.removeQuery = cfg.Query.Remove
+
+	for name, value := range cfg.Query.Add {
+		t, err := compileTemplate(value, vars)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of query parameter '%s': %s", name, err)
+		}
+		r.addQuery = append(r.addQuery, queryParam{name: name, value: t})
+	}
+	sort.Slice(r.addQuery, func(i, j int) bool { return r.addQuery[i].name < r.addQuery[j].name })
+
+	r.mapping = r.reverseMapping(cfg, pattern, matchSyntax, vars)
+
+	return &r, nil
+}
+
+// collectCaptures adds the named captures of a regular expression to vars.
+func collectCaptures(re *syntax.Regexp, vars map[string]string) {
+	if re.Op == syntax.OpCapture && re.Name != "" {
+		vars[re.Name] = re.Sub[0].String()
+	}
+
+	for _, sub := range re.Sub {
+		collectCaptures(sub, vars)
+	}
+}
+
+func compileTemplate(value string, vars map[string]string) ([]segment, error) {
+	var t []segment
+	last := 0
+
+	for _, m := range targetPlaceholder.FindAllStringSubmatchIndex(value, -1) {
+		name := value[m[2]:m[3]]
+		if _, ok := vars[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter ':%s'", name)
+		}
+
+		if m[0] > last {
+			t = append(t, segment{literal: value[last:m[0]]})
+		}
+		t = append(t, segment{name: name})
+		last = m[1]
+	}
+
+	if last < len(value) {
+		t = append(t, segment{literal: value[last:]})
+	}
+
+	return t, nil
+}
+
+// reverseMapping returns the mapping of upstream paths back to public paths,
+// or nil if the rewrite cannot be reversed.
+func (r *Rewriter) reverseMapping(cfg *config.Rewrite, pattern string, matchSyntax *syntax.Regexp, vars map[string]string) *UrlMapping {
+	var public, upstream string
+
+	if matchSyntax != nil {
+		inverted, ok := invertRegexp(matchSyntax)
+		if !ok {
+			return nil
+		}
+		public = cfg.StripPrefix + inverted
+	} else if pattern != "" {
+		public = patternTemplate(pattern)
+	} else {
+		return nil
+	}
+
+	switch {
+	case r.target != nil:
+		var b strings.Builder
+		for _, seg := range r.target {
+			if seg.name == "" {
+				b.WriteString(regexp.QuoteMeta(seg.literal))
+			} else {
+				b.WriteString("(?P<" + seg.name + ">" + vars[seg.name] + ")")
+			}
+		}
+		upstream = "^" + b.String() + "$"
+	case r.match != nil:
+		upstream = r.match.String()
+	case r.stripPrefix == "":
+		upstream = "^" + patternRegexp(pattern) + "$"
+	case pattern == r.stripPrefix || strings.HasPrefix(pattern, r.stripPrefix+"/"):
+		upstream = "^" + patternRegexp(strings.TrimPrefix(pattern, r.stripPrefix)) + "$"
+	default:
+		return nil
+	}
+
+	re, err := regexp.Compile(upstream)
+	if err != nil {
+		return nil
+	}
+
+	// Every placeholder of the public path must be recoverable from the
+	// upstream path.
+	captured := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		captured[name] = true
+	}
+	for _, m := range targetPlaceholder.FindAllStringSubmatch(public, -1) {
+		if !captured[m[1]] {
+			return nil
+		}
+	}
+
+	return &UrlMapping{Upstream: upstream, Public: public}
+}
+
+// patternTemplate converts a path pattern into a path template. The values of
+// catch-all parameters include the leading slash.
+func patternTemplate(pattern string) string {
+	return patternPlaceholder.ReplaceAllStringFunc(pattern, func(m string) string {
+		if strings.HasPrefix(m, "/*") {
+			return ":" + m[2:]
+		}
+		return strings.Replace(m, "*", ":", 1)
+	})
+}
+
+// patternRegexp converts a path pattern like "/users/:id" into a regular
+// expression with a named capture for each parameter.
+func patternRegexp(pattern string) string {
+	var b strings.Builder
+	last := 0
+
+	for _, m := range patternPlaceholder.FindAllStringSubmatchIndex(pattern, -1) {
+		b.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+
+		name := pattern[m[6]:m[7]]
+		if pattern[m[4]:m[5]] == "*" {
+			b.WriteString("(?P<" + name + ">" + pattern[m[2]:m[3]] + ".*)")
+		} else {
+			b.WriteString(pattern[m[2]:m[3]] + "(?P<" + name + ">[^/]+)")
+		}
+		last = m[1]
+	}
+
+	b.WriteString(regexp.QuoteMeta(pattern[last:]))
+	return b.String()
+}
+
+// invertRegexp converts a regular expression that consists of literal text
+// and named captures into a path template, replacing each capture with a
+// ":name" placeholder.
+func invertRegexp(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune), true
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine:
+		return "", true
+	case syntax.OpCapture:
+		if re.Name != "" {
+			return ":" + re.Name, true
+		}
+		return invertRegexp(re.Sub[0])
+	case syntax.OpConcat:
+		var b strings.Builder
+		for _, sub := range re.Sub {
+			s, ok := invertRegexp(sub)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(s)
+		}
+		return b.String(), true
+	}
+
+	return "", false
+}
+
+// Mapping returns the mapping of upstream paths of the route back to public
+// paths, or nil if the rewrite cannot be reversed.
+func (r *Rewriter) Mapping() *UrlMapping {
+	return r.mapping
+}
+
+// Rewrite returns the upstream path and query of a request. It returns false
+// if the request path does not match.
+//
+// The rewrite works on the escaped request path, so that escaped characters
+// like "%2F" or "%3F" are forwarded as they are instead of turning into path
+// separators or the start of the query. Route parameters and captures are
+// taken from the escaped path as well.
+func (r *Rewriter) Rewrite(req *http.Request, params httprouter.Params) (*url.URL, bool) {
+	path := req.URL.EscapedPath()
+
+	// The prefix is only stripped at segment boundaries, so that "/api" is
+	// not stripped from "/apiv2".
+	if r.stripPrefix != "" && (path == r.stripPrefix || strings.HasPrefix(path, r.stripPrefix+"/")) {
+		path = path[len(r.stripPrefix):]
+	}
+
+	var captures []string
+	if r.match != nil {
+		if captures = r.match.FindStringSubmatch(path); captures == nil {
+			return nil, false
+		}
+	}
+
+	var escapedParams []string
+	if r.params != nil {
+		escapedParams = r.params.FindStringSubmatch(req.URL.EscapedPath())
+	}
+
+	value := func(name string) string {
+		if r.match != nil {
+			if i := r.match.SubexpIndex(name); i >= 0 {
+				return captures[i]
+			}
+		}
+		if escapedParams != nil {
+			if i := r.params.SubexpIndex(name); i >= 0 {
+				return escapedParams[i]
+			}
+		}
+		return escapeSegments(params.ByName(name))
+	}
+
+	if r.target != nil {
+		path = render(r.target, value)
+	}
+
+	upstream := url.URL{RawQuery: req.URL.RawQuery}
+
+	var err error
+	if upstream.Path, err = url.PathUnescape(path); err != nil {
+		return nil, false
+	}
+	upstream.RawPath = path
+
+	if len(r.renameQuery) > 0 || len(r.removeQuery) > 0 || len(r.addQuery) > 0 {
+		values := req.URL.Query()
+
+		for _, pair := range r.renameQuery {
+			if v, ok := values[pair[0]]; ok {
+				delete(values, pair[0])
+				values[pair[1]] = v
+			}
+		}
+
+		for _, name := range r.removeQuery {
+			values.Del(name)
+		}
+
+		for _, param := range r.addQuery {
+			values.Add(param.name, render(param.value, func(name string) string {
+				v, _ := url.PathUnescape(value(name))
+				return v
+			}))
+		}
+
+		upstream.RawQuery = values.Encode()
+	}
+
+	return &upstream, true
+}
+
+// UpstreamURL returns the URL of a backend, extended by the path and query of
+// a rewritten request.
+func UpstreamURL(backend string, target *url.URL) (*url.URL, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL '%s': %s", backend, err)
+	}
+
+	escaped := u.EscapedPath() + target.EscapedPath()
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return nil, err
+	}
+	u.RawPath = escaped
+	u.RawQuery = target.RawQuery
+
+	return u, nil
+}
+
+// escapeSegments escapes each segment of a path.
+func escapeSegments(path string) string {
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func render(t []segment, value func(string) string) string {
+	var b strings.Builder
+	for _, seg := range t {
+		if seg.name == "" {
+			b.WriteString(seg.literal)
+		} else {
+			b.WriteString(value(seg.name))
+		}
+	}
+	return b.String()
+}
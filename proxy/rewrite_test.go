@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+func rewrite(t *testing.T, cfg config.Rewrite, pattern string, target string, params httprouter.Params) (string, bool) {
+	t.Helper()
+
+	r, err := NewRewriter(&cfg, pattern)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rewritten, ok := r.Rewrite(httptest.NewRequest("GET", target, nil), params)
+	if !ok {
+		return "", false
+	}
+
+	upstream, err := UpstreamURL("http://backend:8080/base", rewritten)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return upstream.String(), true
+}
+
+func TestRewriteStripPrefix(t *testing.T) {
+	cfg := config.Rewrite{StripPrefix: "/api"}
+
+	cases := []struct {
+		pattern  string
+		target   string
+		params   httprouter.Params
+		expected string
+	}{
+		{"/api/*path", "/api/users/1?x=1", httprouter.Params{{Key: "path", Value: "/users/1"}}, "http://backend:8080/base/users/1?x=1"},
+		{"/api", "/api", nil, "http://backend:8080/base"},
+		{"/apiv2/*path", "/apiv2/users", httprouter.Params{{Key: "path", Value: "/users"}}, "http://backend:8080/base/apiv2/users"},
+	}
+
+	for _, c := range cases {
+		if upstream, _ := rewrite(t, cfg, c.pattern, c.target, c.params); upstream != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.target, c.expected, upstream)
+		}
+	}
+}
+
+func TestRewriteKeepsEscapedCharacters(t *testing.T) {
+	cfg := config.Rewrite{StripPrefix: "/api"}
+
+	cases := map[string]string{
+		"/api/a%3Fadmin=1":     "http://backend:8080/base/a%3Fadmin=1",
+		"/api/a%23b":           "http://backend:8080/base/a%23b",
+		"/api/a%2F..%2Fadmin":  "http://backend:8080/base/a%2F..%2Fadmin",
+		"/api/a%20b?q=%3F%26x": "http://backend:8080/base/a%20b?q=%3F%26x",
+		"/api/%E2%9C%93?x=1":   "http://backend:8080/base/%E2%9C%93?x=1",
+	}
+
+	for target, expected := range cases {
+		req := httptest.NewRequest("GET", target, nil)
+		params := httprouter.Params{{Key: "path", Value: req.URL.Path[len("/api"):]}}
+
+		if upstream, _ := rewrite(t, cfg, "/api/*path", target, params); upstream != expected {
+			t.Errorf("%s: expected %s, got %s", target, expected, upstream)
+		}
+	}
+}
+
+func TestRewriteTargetEscapesParameters(t *testing.T) {
+	cfg := config.Rewrite{Target: "/v2/users/:id/items:rest"}
+
+	upstream, _ := rewrite(t, cfg, "/users/:id/*rest", "/users/a%3Fb/c%2Fd", httprouter.Params{
+		{Key: "id", Value: "a?b"},
+		{Key: "rest", Value: "/c/d"},
+	})
+
+	if expected := "http://backend:8080/base/v2/users/a%3Fb/items/c%2Fd"; upstream != expected {
+		t.Errorf("expected %s, got %s", expected, upstream)
+	}
+}
+
+func TestRewriteMatchAndQuery(t *testing.T) {
+	cfg := config.Rewrite{
+		StripPrefix: "/api",
+		Match:       "/v(?P<version>[0-9]+)/(?P<rest>.*)",
+		Target:      "/:rest",
+		Query: config.QueryRewrite{
+			Rename: map[string]string{"q": "query"},
+			Remove: []string{"debug"},
+			Add:    map[string]string{"api_version": ":version", "name": ":rest"},
+		},
+	}
+
+	upstream, ok := rewrite(t, cfg, "/api/*path", "/api/v2/x%20y?debug=1&q=1", nil)
+	if expected := "http://backend:8080/base/x%20y?api_version=2&name=x+y&query=1"; !ok || upstream != expected {
+		t.Errorf("expected %s, got %s", expected, upstream)
+	}
+
+	if _, ok := rewrite(t, cfg, "/api/*path", "/api/latest/x", nil); ok {
+		t.Error("expected path that does not match to be rejected")
+	}
+}
+
+func TestRewriteMapping(t *testing.T) {
+	r, err := NewRewriter(&config.Rewrite{StripPrefix: "/api"}, "/api/users/:id")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if m := r.Mapping(); m == nil || m.Upstream != `^/users/(?P<id>[^/]+)$` || m.Public != "/api/users/:id" {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+
+	r, err = NewRewriter(&config.Rewrite{StripPrefix: "/api"}, "/apiv2/users/:id")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if m := r.Mapping(); m != nil {
+		t.Errorf("expected no mapping for a prefix that does not apply, got %+v", m)
+	}
+}
+
+func TestNewRewriterRejectsUnknownParameters(t *testing.T) {
+	if _, err := NewRewriter(&config.Rewrite{Target: "/users/:name"}, "/users/:id"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/mittwald/servicegateway/certificates"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// clientFor returns the HTTP client for a backend. Backends without TLS
+// settings share the default client; all others get a client per distinct
+// TLS configuration.
+func (p *ProxyHandler) clientFor(backend *config.Backend) (*http.Client, error) {
+	if backend.TLS == (config.BackendTLS{}) {
+		return p.Client, nil
+	}
+
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	if client, ok := p.clients[backend.TLS]; ok {
+		return client, nil
+	}
+
+	tlsConfig, err := backendTLSConfig(&backend.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: p.Client.CheckRedirect,
+	}
+
+	if p.clients == nil {
+		p.clients = make(map[config.BackendTLS]*http.Client)
+	}
+	p.clients[backend.TLS] = client
+	return client, nil
+}
+
+// ValidateBackend loads the TLS settings of a backend, so that a missing or
+// invalid CA bundle or client certificate is reported when the application
+// is registered instead of on its first request.
+func (p *ProxyHandler) ValidateBackend(backend *config.Backend) error {
+	_, err := p.clientFor(backend)
+	return err
+}
+
+func backendTLSConfig(cfg *config.BackendTLS) (*tls.Config, error) {
+	minVersion, err := certificates.ParseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read backend CA bundle: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend CA bundle %s contains no certificates", cfg.CA)
+		}
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load backend client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
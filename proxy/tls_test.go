@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA.
+func (c *testCA) issue(t *testing.T, commonName string, ips ...net.IP) ([]byte, []byte) {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  ips,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return filename
+}
+
+func TestValidateBackend(t *testing.T) {
+	dir := t.TempDir()
+
+	emptyCA := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyCA, []byte("no certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]config.BackendTLS{
+		"missing CA bundle":       {CA: filepath.Join(dir, "missing.pem")},
+		"CA bundle without certs": {CA: emptyCA},
+		"missing client key":      {Cert: emptyCA},
+		"invalid minimum version": {MinVersion: "1.7"},
+	}
+
+	p := NewProxyHandler(logging.MustGetLogger("test"), &config.Configuration{}, nil)
+
+	for name, tlsCfg := range cases {
+		if err := p.ValidateBackend(&config.Backend{TLS: tlsCfg}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBackendClientKeepsDefaultTransportSettings(t *testing.T) {
+	p := NewProxyHandler(logging.MustGetLogger("test"), &config.Configuration{}, nil)
+
+	client, err := p.clientFor(&config.Backend{TLS: config.BackendTLS{ServerName: "backend.internal"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig.ServerName != "backend.internal" {
+		t.Errorf("expected TLS settings to be applied, got %+v", transport.TLSClientConfig)
+	}
+	if transport.Proxy == nil || transport.IdleConnTimeout == 0 {
+		t.Error("expected transport to keep the proxy and timeout settings of the default transport")
+	}
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.ServerName != "" {
+		t.Error("expected default transport to be unchanged")
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	serverCert, serverKey := ca.issue(t, "backend", net.ParseIP("127.0.0.1"))
+	serverPair, _ := tls.X509KeyPair(serverCert, serverKey)
+
+	clientCert, clientKey := ca.issue(t, "gateway")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Client", req.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{serverPair}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := writeTestFile(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	certFile := writeTestFile(t, dir, "cert.pem", clientCert)
+	keyFile := writeTestFile(t, dir, "key.pem", clientKey)
+
+	metrics := &monitoring.PromMetrics{
+		TotalResponseTimes:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "total"}, []string{"application"}),
+		UpstreamResponseTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "upstream"}, []string{"application"}),
+		BackendResponseTimes:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "backend"}, []string{"application", "backend"}),
+		BackendResponses:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "responses"}, []string{"application", "backend", "status_class"}),
+		Errors:                prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"application", "reason"}),
+	}
+	p := NewProxyHandler(logging.MustGetLogger("test"), &config.Configuration{}, metrics)
+
+	cases := map[string]struct {
+		tls    config.BackendTLS
+		status int
+	}{
+		"unknown CA":              {config.BackendTLS{}, http.StatusServiceUnavailable},
+		"no client certificate":   {config.BackendTLS{CA: caFile}, http.StatusServiceUnavailable},
+		"with client certificate": {config.BackendTLS{CA: caFile, Cert: certFile, Key: keyFile, MinVersion: "1.3"}, http.StatusOK},
+	}
+
+	for name, c := range cases {
+		app := &config.Application{Backend: config.Backend{Url: backend.URL, TLS: c.tls}}
+
+		rec := httptest.NewRecorder()
+		p.HandleProxyRequest(rec, httptest.NewRequest("GET", "/", nil), backend.URL+"/", "app", app)
+
+		if rec.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", name, c.status, rec.Code)
+		}
+		if c.status == http.StatusOK && rec.Header().Get("X-Client") != "gateway" {
+			t.Errorf("%s: expected backend to see client certificate, got %v", name, rec.Header())
+		}
+	}
+}
@@ -20,6 +20,7 @@ package ratelimit
  */
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strconv"
@@ -30,7 +31,12 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/tracing"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Bucket struct {
@@ -38,21 +44,29 @@ type Bucket struct {
 }
 
 type RateLimitingMiddleware interface {
-	DecorateHandler(handler httprouter.Handle) httprouter.Handle
+	DecorateHandler(handler httprouter.Handle, appName string) httprouter.Handle
+
+	// WithLimits returns a middleware with different limits that counts
+	// requests in its own bucket.
+	WithLimits(cfg *config.RateLimiting) (RateLimitingMiddleware, error)
 }
 
 type RedisSimpleRateThrottler struct {
 	burstSize int64
 	window    time.Duration
+	bucket    string
 	redisPool *redis.Pool
 	logger    *logging.Logger
+	metrics   *monitoring.PromMetrics
 }
 
-func NewRateLimiter(cfg config.RateLimiting, red *redis.Pool, logger *logging.Logger) (RateLimitingMiddleware, error) {
+func NewRateLimiter(cfg config.RateLimiting, red *redis.Pool, logger *logging.Logger, metrics *monitoring.PromMetrics) (RateLimitingMiddleware, error) {
 	t := new(RedisSimpleRateThrottler)
 	t.burstSize = int64(cfg.Burst)
+	t.bucket = cfg.Bucket
 	t.redisPool = red
 	t.logger = logger
+	t.metrics = metrics
 
 	if w, err := time.ParseDuration(cfg.Window); err != nil {
 		return nil, err
@@ -65,6 +79,24 @@ func NewRateLimiter(cfg config.RateLimiting, red *redis.Pool, logger *logging.Lo
 	return t, nil
 }
 
+func (t *RedisSimpleRateThrottler) WithLimits(cfg *config.RateLimiting) (RateLimitingMiddleware, error) {
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window '%s': %s", cfg.Window, err)
+	}
+
+	if cfg.Burst <= 0 {
+		return nil, fmt.Errorf("burst must be positive")
+	}
+
+	limited := *t
+	limited.burstSize = int64(cfg.Burst)
+	limited.window = window
+	limited.bucket = cfg.Bucket
+
+	return &limited, nil
+}
+
 func (t *RedisSimpleRateThrottler) identifyClient(req *http.Request) string {
 	auth := req.Header.Get("Authorization")
 	if auth != "" {
@@ -77,6 +109,10 @@ func (t *RedisSimpleRateThrottler) identifyClient(req *http.Request) string {
 
 func (t *RedisSimpleRateThrottler) takeToken(user string) (int, int, error) {
 	key := "RL_BUCKET_" + user
+	if t.bucket != "" {
+		key = "RL_BUCKET_" + t.bucket + "_" + user
+	}
+
 	conn := t.redisPool.Get()
 	defer func() {
 		_ = conn.Close()
@@ -138,16 +174,19 @@ func (t *RedisSimpleRateThrottler) takeToken(user string) (int, int, error) {
 //	}
 // }
 
-func (t *RedisSimpleRateThrottler) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+func (t *RedisSimpleRateThrottler) DecorateHandler(handler httprouter.Handle, appName string) httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		_, span := tracing.Start(req.Context(), "ratelimit.take_token")
 		user := t.identifyClient(req)
 		remaining, limit, err := t.takeToken(user)
+		span.SetAttributes(attribute.Int("ratelimit.remaining", remaining))
+		tracing.End(span, err)
 
 		if err != nil {
-			t.logger.Errorf("Error occurred while handling request from %s: %s", req.RemoteAddr, err)
+			requestid.NewLogger(req.Context(), t.logger).Errorf("Error occurred while handling request from %s: %s", req.RemoteAddr, err)
 			rw.Header().Set("Content-Type", "application/json")
 			rw.WriteHeader(503)
-			_, _ = rw.Write([]byte("{\"msg\":\"service unavailable\"}"))
+			_, _ = rw.Write([]byte(fmt.Sprintf("{\"msg\":\"service unavailable\",\"request_id\":\"%s\"}", requestid.FromRequest(req))))
 			return
 		}
 
@@ -159,9 +198,12 @@ func (t *RedisSimpleRateThrottler) DecorateHandler(handler httprouter.Handle) ht
 		rw.Header().Add("X-RateLimit-Remaining", strconv.Itoa(remaining))
 
 		if remaining <= 0 {
+			if t.metrics != nil {
+				t.metrics.RateLimitRejections.With(prometheus.Labels{"application": appName}).Inc()
+			}
 			rw.Header().Set("Content-Type", "application/json")
 			rw.WriteHeader(429)
-			_, _ = rw.Write([]byte("{\"msg\":\"rate limit exceeded\"}"))
+			_, _ = rw.Write([]byte(fmt.Sprintf("{\"msg\":\"rate limit exceeded\",\"request_id\":\"%s\"}", requestid.FromRequest(req))))
 		} else {
 			handler(rw, req, p)
 		}
@@ -0,0 +1,100 @@
+// Package requestid assigns each request a correlation ID, which is passed on
+// to the upstream services, returned to the client and included in logs.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/op/go-logging"
+)
+
+// Header is the header that carries the request ID.
+const Header = "X-Request-Id"
+
+type contextKey int
+
+const idKey contextKey = iota
+
+// Incoming IDs are only accepted if they are reasonably short and consist of
+// characters that are safe to embed in logs and JSON documents.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,128}$`)
+
+// NewHandler returns a handler that accepts the request ID sent by the client
+// or generates a new one, and stores it in the request headers, the request
+// context and the response headers.
+func NewHandler(wrapped http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(Header)
+		if !validID.MatchString(id) {
+			id = generate()
+		}
+
+		req.Header.Set(Header, id)
+		rw.Header().Set(Header, id)
+
+		wrapped.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), idKey, id)))
+	})
+}
+
+// FromContext returns the request ID stored in a context, or an empty string.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey).(string)
+	return id
+}
+
+// FromRequest returns the ID of a request, or an empty string.
+func FromRequest(req *http.Request) string {
+	return FromContext(req.Context())
+}
+
+func generate() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Logger prefixes all messages with the ID of a request.
+type Logger struct {
+	logger *logging.Logger
+	prefix string
+}
+
+// NewLogger returns a logger that prefixes messages with the request ID stored
+// in ctx. Without a request ID, messages are logged unchanged.
+func NewLogger(ctx context.Context, logger *logging.Logger) *Logger {
+	l := *logger
+	l.ExtraCalldepth++
+
+	var prefix string
+	if id := FromContext(ctx); id != "" {
+		prefix = "[" + id + "] "
+	}
+
+	return &Logger{logger: &l, prefix: prefix}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf(l.prefix+format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logger.Infof(l.prefix+format, args...)
+}
+
+func (l *Logger) Noticef(format string, args ...interface{}) {
+	l.logger.Noticef(l.prefix+format, args...)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.logger.Warningf(l.prefix+format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(l.prefix+format, args...)
+}
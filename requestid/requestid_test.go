@@ -0,0 +1,91 @@
+package requestid_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestMetrics() *monitoring.PromMetrics {
+	return &monitoring.PromMetrics{
+		TotalResponseTimes:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "total"}, []string{"application"}),
+		UpstreamResponseTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "upstream"}, []string{"application"}),
+		BackendResponseTimes:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "backend"}, []string{"application", "backend"}),
+		BackendResponses:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "responses"}, []string{"application", "backend", "status_class"}),
+		Errors:                prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"application", "reason"}),
+	}
+}
+
+func TestRequestIDsArePassedOn(t *testing.T) {
+	var upstream atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstream.Store(req.Header.Get(requestid.Header))
+		rw.Header().Set(requestid.Header, "set-by-upstream")
+	}))
+	defer backend.Close()
+
+	logger := logging.MustGetLogger("test")
+	prx := proxy.NewProxyHandler(logger, &config.Configuration{}, newTestMetrics())
+
+	target := backend.URL
+	handler := requestid.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		prx.HandleProxyRequest(rw, req, target, "app", &config.Application{})
+	}))
+
+	serve := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			req.Header.Set(requestid.Header, id)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// valid IDs of the client are kept, and not overridden by the upstream
+	rec := serve("abc-123")
+	if ids := rec.Header().Values(requestid.Header); len(ids) != 1 || ids[0] != "abc-123" || upstream.Load() != "abc-123" {
+		t.Errorf("expected request ID of client to be used, got %v (upstream %v)", ids, upstream.Load())
+	}
+
+	// invalid IDs are replaced with a generated one
+	rec = serve(`bad"id`)
+	if id := rec.Header().Get(requestid.Header); len(id) != 32 || upstream.Load() != id {
+		t.Errorf("expected generated request ID, got %q (upstream %v)", id, upstream.Load())
+	}
+
+	// errors of the gateway carry the request ID
+	target = "http://127.0.0.1:1"
+	rec = serve("")
+	if id := rec.Header().Get(requestid.Header); id == "" || !strings.Contains(rec.Body.String(), `"request_id": "`+id+`"`) {
+		t.Errorf("expected error to contain request ID %q, got %s", id, rec.Body.String())
+	}
+}
+
+func TestLoggerPrefixesRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.MustGetLogger("test")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewLogBackend(&buf, "", 0)))
+
+	requestid.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestid.NewLogger(req.Context(), logger).Warningf("hello %s", "world")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	requestid.NewLogger(httptest.NewRequest("GET", "/", nil).Context(), logger).Warningf("without ID")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "] hello world") || !strings.HasPrefix(lines[0], "[") || lines[1] != "without ID" {
+		t.Errorf("unexpected log output %q", lines)
+	}
+}
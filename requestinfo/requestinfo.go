@@ -0,0 +1,56 @@
+// Package requestinfo collects details about a request while it passes
+// through the dispatcher, so that access loggers wrapping the dispatcher can
+// report them.
+package requestinfo
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const infoKey contextKey = iota
+
+// Info holds the details recorded for a request. It is filled in by the
+// handlers serving the request and must only be read after they returned.
+type Info struct {
+	Application      string
+	Route            string
+	Backend          string
+	UpstreamURL      string
+	UpstreamDuration time.Duration
+
+	// JWT is the token of the authenticated user, if any.
+	JWT string
+}
+
+// New returns a copy of the request that carries a new, empty Info. Requests
+// that already carry an Info are returned unchanged.
+func New(req *http.Request) (*http.Request, *Info) {
+	if info, ok := req.Context().Value(infoKey).(*Info); ok {
+		return req, info
+	}
+
+	info := &Info{}
+	return req.WithContext(context.WithValue(req.Context(), infoKey, info)), info
+}
+
+// NewHandler attaches a new Info to every request. It must wrap the
+// dispatcher and all access loggers, so that they share the same Info.
+func NewHandler(wrapped http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, _ = New(req)
+		wrapped.ServeHTTP(rw, req)
+	})
+}
+
+// Get returns the Info of a request. For requests without Info, a detached
+// Info is returned, so that callers do not need to check for nil.
+func Get(req *http.Request) *Info {
+	if info, ok := req.Context().Value(infoKey).(*Info); ok {
+		return info
+	}
+	return &Info{}
+}
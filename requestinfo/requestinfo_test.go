@@ -0,0 +1,44 @@
+package requestinfo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHandlerSharesInfoWithInnerHandlers(t *testing.T) {
+	var outer *Info
+
+	inner := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		Get(req).JWT = "token"
+		Get(req).Backend = "canary"
+	})
+
+	handler := NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		outer = Get(req)
+		inner.ServeHTTP(rw, req)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if outer.JWT != "token" || outer.Backend != "canary" {
+		t.Fatalf("info written by inner handler was lost: %+v", outer)
+	}
+}
+
+func TestNewReusesExistingInfo(t *testing.T) {
+	req, info := New(httptest.NewRequest("GET", "/", nil))
+
+	if _, again := New(req); again != info {
+		t.Fatal("New replaced the existing info")
+	}
+}
+
+func TestGetWithoutInfoIsDetached(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	Get(req).JWT = "token"
+
+	if Get(req).JWT != "" {
+		t.Fatal("Get returned an attached info for a request without info")
+	}
+}
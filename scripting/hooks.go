@@ -0,0 +1,348 @@
+package scripting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/op/go-logging"
+)
+
+// maxHookBodySize is the largest body that is passed to request and response
+// hooks. Larger bodies are passed as null and cannot be modified.
+const maxHookBodySize = 1 << 20
+
+// ClaimsFunc returns the JWT claims of the user that sent a request, or nil.
+type ClaimsFunc func(req *http.Request) map[string]interface{}
+
+// ApplicationHooks runs the on_request and on_response scripts of an
+// application around its handlers.
+//
+// on_request is called with a request object {method, path, query, headers,
+// body, claims, application}. It may return a modified request object, or an
+// object {response: {status, headers, body}} to respond without calling the
+// backend. on_response is called with a response object {status, headers,
+// body} and the request object and may return a modified response object.
+// Returning nothing leaves the request or response unchanged.
+type ApplicationHooks struct {
+	application string
+	onRequest   *Runtime
+	onResponse  *Runtime
+	claims      ClaimsFunc
+	logger      *logging.Logger
+}
+
+func NewApplicationHooks(application string, onRequest *Runtime, onResponse *Runtime, claims ClaimsFunc, logger *logging.Logger) *ApplicationHooks {
+	return &ApplicationHooks{
+		application: application,
+		onRequest:   onRequest,
+		onResponse:  onResponse,
+		claims:      claims,
+		logger:      logger,
+	}
+}
+
+func (h *ApplicationHooks) DecorateHandler(orig httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		request, err := h.requestObject(req)
+		if err != nil {
+			h.handleError(rw, req, err)
+			return
+		}
+
+		if h.onRequest != nil {
+			result, err := h.onRequest.Call(&Call{Context: req.Context(), Header: req.Header}, request)
+			if err != nil {
+				h.handleError(rw, req, err)
+				return
+			}
+
+			if result, ok := result.(map[string]interface{}); ok {
+				if response, ok := result["response"].(map[string]interface{}); ok {
+					if err := writeResponseObject(rw, response); err != nil {
+						h.onRequest.CountFailure("invalid_result")
+						h.handleError(rw, req, err)
+					}
+					return
+				}
+
+				if err := applyRequestObject(req, result); err != nil {
+					h.onRequest.CountFailure("invalid_result")
+					h.handleError(rw, req, err)
+					return
+				}
+
+				request = result
+			} else if result != nil {
+				h.onRequest.CountFailure("invalid_result")
+				h.handleError(rw, req, fmt.Errorf("on_request must return an object, returned %T", result))
+				return
+			}
+		}
+
+		if h.onResponse == nil {
+			orig(rw, req, params)
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		orig(recorder, req, params)
+
+		response := map[string]interface{}{
+			"status":  recorder.Code,
+			"headers": headerObject(recorder.Header()),
+			"body":    bodyObject(recorder.Header().Get("Content-Type"), recorder.Body.Bytes()),
+		}
+
+		result, err := h.onResponse.Call(&Call{Context: req.Context(), Header: req.Header}, response, request)
+		if err != nil {
+			h.handleError(rw, req, err)
+			return
+		}
+
+		if result == nil {
+			copyResponse(rw, recorder)
+			return
+		}
+
+		response, ok := result.(map[string]interface{})
+		if !ok {
+			h.onResponse.CountFailure("invalid_result")
+			h.handleError(rw, req, fmt.Errorf("on_response must return an object, returned %T", result))
+			return
+		}
+
+		if response["body"] == nil && recorder.Body.Len() > maxHookBodySize {
+			// leave bodies that were too large for the script untouched
+			response["body"] = recorder.Body.String()
+		}
+
+		if err := writeResponseObject(rw, response); err != nil {
+			h.onResponse.CountFailure("invalid_result")
+			h.handleError(rw, req, err)
+		}
+	}
+}
+
+func (h *ApplicationHooks) handleError(rw http.ResponseWriter, req *http.Request, err error) {
+	requestid.NewLogger(req.Context(), h.logger).Errorf("error in script of application %s: %s", h.application, err)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusInternalServerError)
+	_, _ = rw.Write([]byte(fmt.Sprintf(`{"msg":"internal server error","request_id":"%s"}`, requestid.FromRequest(req))))
+}
+
+func (h *ApplicationHooks) requestObject(req *http.Request) (map[string]interface{}, error) {
+	var body interface{}
+
+	if req.Body != nil && req.ContentLength <= maxHookBodySize {
+		raw, err := io.ReadAll(io.LimitReader(req.Body, maxHookBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(raw) <= maxHookBodySize {
+			body = bodyObject(req.Header.Get("Content-Type"), raw)
+		}
+
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(raw), req.Body))
+	}
+
+	request := map[string]interface{}{
+		"application": h.application,
+		"method":      req.Method,
+		"path":        req.URL.Path,
+		"query":       valuesObject(req.URL.Query()),
+		"headers":     headerObject(req.Header),
+		"body":        body,
+		"claims":      nil,
+	}
+
+	if h.claims != nil {
+		if claims := h.claims(req); claims != nil {
+			request["claims"] = claims
+		}
+	}
+
+	return request, nil
+}
+
+// applyRequestObject applies the changes of a request object returned by
+// on_request to the request.
+func applyRequestObject(req *http.Request, request map[string]interface{}) error {
+	if path, ok := request["path"].(string); ok && path != req.URL.Path {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path must start with '/', is '%s'", path)
+		}
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+
+	if query, ok := request["query"].(map[string]interface{}); ok {
+		values, err := objectValues(query)
+		if err != nil {
+			return fmt.Errorf("invalid query: %s", err)
+		}
+		req.URL.RawQuery = url.Values(values).Encode()
+	}
+
+	if headers, ok := request["headers"].(map[string]interface{}); ok {
+		values, err := objectValues(headers)
+		if err != nil {
+			return fmt.Errorf("invalid headers: %s", err)
+		}
+
+		req.Header = make(http.Header, len(values))
+		for name, v := range values {
+			req.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+
+	if body, ok := request["body"]; ok && body != nil {
+		raw, err := bodyBytes(body)
+		if err != nil {
+			return err
+		}
+
+		if len(raw) > 0 || req.ContentLength > 0 {
+			req.Body = io.NopCloser(bytes.NewReader(raw))
+			req.ContentLength = int64(len(raw))
+			req.Header.Del("Content-Length")
+		}
+	}
+
+	return nil
+}
+
+func copyResponse(rw http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	for name, values := range recorder.Header() {
+		rw.Header()[name] = values
+	}
+
+	rw.WriteHeader(recorder.Code)
+	_, _ = io.Copy(rw, recorder.Body)
+}
+
+func writeResponseObject(rw http.ResponseWriter, response map[string]interface{}) error {
+	status := http.StatusOK
+	switch s := response["status"].(type) {
+	case int:
+		status = s
+	case int64:
+		status = int(s)
+	case float64:
+		status = int(s)
+	case nil:
+	default:
+		return fmt.Errorf("status must be a number, is %T", s)
+	}
+
+	if status < 100 || status > 999 {
+		return fmt.Errorf("invalid status code %d", status)
+	}
+
+	var raw []byte
+	if body, ok := response["body"]; ok && body != nil {
+		var err error
+		if raw, err = bodyBytes(body); err != nil {
+			return err
+		}
+	}
+
+	if headers, ok := response["headers"].(map[string]interface{}); ok {
+		values, err := objectValues(headers)
+		if err != nil {
+			return fmt.Errorf("invalid headers: %s", err)
+		}
+
+		for name, v := range values {
+			rw.Header()[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+
+	if _, ok := response["body"].(string); !ok && raw != nil && rw.Header().Get("Content-Type") == "" {
+		rw.Header().Set("Content-Type", "application/json")
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	rw.WriteHeader(status)
+	_, err := rw.Write(raw)
+	return err
+}
+
+// bodyObject decodes JSON bodies; other bodies are passed as string.
+func bodyObject(contentType string, raw []byte) interface{} {
+	if len(raw) > maxHookBodySize {
+		return nil
+	}
+
+	if strings.Contains(contentType, "json") {
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err == nil {
+			return decoded
+		}
+	}
+
+	return string(raw)
+}
+
+func bodyBytes(body interface{}) ([]byte, error) {
+	if s, ok := body.(string); ok {
+		return []byte(s), nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(body); err != nil {
+		return nil, fmt.Errorf("could not encode body: %s", err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// headerObject and valuesObject map single values to strings and multiple
+// values to arrays, which is more convenient to use in scripts.
+func headerObject(header http.Header) map[string]interface{} {
+	return valuesObject(header)
+}
+
+func valuesObject(values map[string][]string) map[string]interface{} {
+	object := make(map[string]interface{}, len(values))
+	for name, v := range values {
+		if len(v) == 1 {
+			object[name] = v[0]
+		} else {
+			object[name] = v
+		}
+	}
+	return object
+}
+
+func objectValues(object map[string]interface{}) (map[string][]string, error) {
+	values := make(map[string][]string, len(object))
+	for name, v := range object {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			values[name] = []string{v}
+		case int64, float64, bool:
+			values[name] = []string{fmt.Sprint(v)}
+		default:
+			l, err := Strings(v)
+			if err != nil {
+				return nil, fmt.Errorf("value of '%s': %s", name, err)
+			}
+			values[name] = l
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,116 @@
+package scripting
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/op/go-logging"
+)
+
+func newTestHooks(t *testing.T, onRequest string, onResponse string, claims ClaimsFunc) *ApplicationHooks {
+	t.Helper()
+
+	options := testOptions(1, time.Second)
+
+	var req, res *Runtime
+	if onRequest != "" {
+		req = newTestRuntime(t, onRequest, options)
+	}
+	if onResponse != "" {
+		res = newTestRuntime(t, onResponse, options)
+	}
+
+	return NewApplicationHooks("app", req, res, claims, logging.MustGetLogger("test"))
+}
+
+// echo responds with the parts of the request that hooks may change.
+func echo(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	body, _ := io.ReadAll(req.Body)
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+		"path":  req.URL.Path,
+		"query": req.URL.RawQuery,
+		"user":  req.Header.Get("X-User"),
+		"body":  json.RawMessage(body),
+	})
+}
+
+func TestHooksModifyRequestAndResponse(t *testing.T) {
+	claims := func(*http.Request) map[string]interface{} {
+		return map[string]interface{}{"sub": "user-1"}
+	}
+
+	hooks := newTestHooks(t, `exports = (req) => {
+		req.path = req.path.replace("/v1/", "/v2/");
+		req.headers["X-User"] = req.claims.sub;
+		req.query.page = "2";
+		req.body.added = true;
+		return req;
+	}`, `exports = (res, req) => {
+		res.body.seen = req.path;
+		res.headers["X-Status"] = String(res.status);
+		res.status = 201;
+		return res;
+	}`, claims)
+
+	req := httptest.NewRequest("POST", "/v1/items?a=1", strings.NewReader(`{"k":1}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	hooks.DecorateHandler(echo)(rec, req, nil)
+
+	if rec.Code != 201 || rec.Header().Get("X-Status") != "200" {
+		t.Errorf("expected modified status and headers, got %d %v", rec.Code, rec.Header())
+	}
+
+	body := rec.Body.String()
+	for _, expected := range []string{`"seen":"/v2/items"`, `"added":true`, `page=2`, `"user":"user-1"`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected body to contain %s, got %s", expected, body)
+		}
+	}
+}
+
+func TestHooksRespondWithoutBackend(t *testing.T) {
+	hooks := newTestHooks(t, `exports = () => ({response: {status: 418, headers: {"X-Hook": "1"}, body: {msg: "no"}}})`, "", nil)
+
+	called := false
+	rec := httptest.NewRecorder()
+	hooks.DecorateHandler(func(http.ResponseWriter, *http.Request, httprouter.Params) {
+		called = true
+	})(rec, httptest.NewRequest("GET", "/", nil), nil)
+
+	if called || rec.Code != 418 || rec.Header().Get("X-Hook") != "1" {
+		t.Errorf("expected response of the hook, got %d %v (backend called: %v)", rec.Code, rec.Header(), called)
+	}
+}
+
+func TestHookErrorsCarryRequestID(t *testing.T) {
+	hooks := newTestHooks(t, `exports = () => { throw new Error("boom"); }`, "", nil)
+	handler := hooks.DecorateHandler(echo)
+
+	rec := httptest.NewRecorder()
+	requestid.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler(rw, req, nil)
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var body struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if rec.Code != 500 || body.RequestID == "" || body.RequestID != rec.Header().Get(requestid.Header) {
+		t.Errorf("expected 500 with request ID %q, got %d %s", rec.Header().Get(requestid.Header), rec.Code, rec.Body.String())
+	}
+}
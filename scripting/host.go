@@ -0,0 +1,138 @@
+package scripting
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// maxFetchBodySize limits the size of response bodies that fetch reads into
+// the VM.
+const maxFetchBodySize = 1 << 20
+
+type fetchOptions struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+func (r *Runtime) registerHostFunctions(v *vm) error {
+	b64 := v.rt.NewObject()
+	if err := b64.Set("encode", func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}); err != nil {
+		return err
+	}
+
+	if err := b64.Set("decode", func(s string) string {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			panic(v.rt.NewGoError(err))
+		}
+		return string(decoded)
+	}); err != nil {
+		return err
+	}
+
+	functions := map[string]interface{}{
+		"base64": b64,
+		"log": func(call goja.FunctionCall) goja.Value {
+			format := call.Argument(0).String()
+			args := call.Arguments[1:]
+			values := make([]interface{}, len(args))
+
+			for i := range args {
+				values[i] = args[i].Export()
+			}
+
+			r.logger.Debugf(format, values...)
+			return goja.Undefined()
+		},
+		"header": func(name string) goja.Value {
+			if v.call == nil || v.call.Header == nil {
+				return goja.Null()
+			}
+
+			if value := v.call.Header.Get(name); value != "" {
+				return v.rt.ToValue(value)
+			}
+			return goja.Null()
+		},
+		"fetch": func(url string, options *fetchOptions) *goja.Object {
+			return r.fetch(v, url, options)
+		},
+	}
+
+	for name, fn := range functions {
+		if err := v.rt.Set(name, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetch performs an HTTP request synchronously. The request is cancelled when
+// the call's time limit is exceeded.
+func (r *Runtime) fetch(v *vm, url string, options *fetchOptions) *goja.Object {
+	if options == nil {
+		options = &fetchOptions{}
+	}
+
+	if options.Method == "" {
+		options.Method = http.MethodGet
+	}
+
+	if v.call == nil {
+		panic(v.rt.NewTypeError("fetch can only be used within a call"))
+	}
+
+	req, err := http.NewRequestWithContext(v.call.Context, strings.ToUpper(options.Method), url, strings.NewReader(options.Body))
+	if err != nil {
+		panic(v.rt.NewGoError(err))
+	}
+
+	for name, value := range options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		panic(v.rt.NewGoError(fmt.Errorf("fetch %s failed: %s", url, err)))
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxFetchBodySize+1))
+	if err != nil {
+		panic(v.rt.NewGoError(err))
+	}
+
+	if len(body) > maxFetchBodySize {
+		panic(v.rt.NewGoError(fmt.Errorf("response of %s exceeds %d bytes", url, maxFetchBodySize)))
+	}
+
+	headers := make(map[string]string, len(res.Header))
+	for name := range res.Header {
+		headers[strings.ToLower(name)] = res.Header.Get(name)
+	}
+
+	response := v.rt.NewObject()
+	_ = response.Set("status", res.StatusCode)
+	_ = response.Set("ok", res.StatusCode >= 200 && res.StatusCode < 300)
+	_ = response.Set("headers", headers)
+	_ = response.Set("body", string(body))
+	_ = response.Set("json", func() interface{} {
+		var decoded interface{}
+		if err := json.Unmarshal(body, &decoded); err != nil {
+			panic(v.rt.NewGoError(err))
+		}
+		return decoded
+	})
+
+	return response
+}
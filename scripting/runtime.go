@@ -0,0 +1,356 @@
+// Package scripting runs user-supplied JavaScript (ES2015+) hooks in a pool of
+// isolated VMs. Each call is limited in execution time and call stack depth;
+// scripts can use a small set of host functions:
+//
+//	log(format, ...args)           writes a debug message
+//	fetch(url, {method, headers, body})
+//	                               performs an HTTP request and returns
+//	                               {status, ok, headers, body, json()}
+//	base64.encode(s), base64.decode(s)
+//	header(name)                   returns a header of the current request
+//
+// A script defines its entry point by assigning a function to "exports".
+package scripting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
+)
+
+var (
+	ErrTimeout  = errors.New("script exceeded its execution time limit")
+	ErrCanceled = errors.New("script call was canceled")
+
+	ErrStackOverflow = errors.New("maximum call stack size exceeded")
+)
+
+// ScriptError is returned when a script throws an exception or does not
+// export a function.
+type ScriptError struct {
+	Script string
+	Err    error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("error in script %s: %s", e.Script, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+type Options struct {
+	PoolSize         int
+	Timeout          time.Duration
+	MaxCallStackSize int
+	FetchTimeout     time.Duration
+}
+
+// OptionsFromConfig converts the scripting configuration into options,
+// filling in defaults for unset values.
+func OptionsFromConfig(cfg *config.ScriptingConfiguration) (Options, error) {
+	options := Options{
+		PoolSize:         runtime.GOMAXPROCS(0),
+		Timeout:          time.Second,
+		MaxCallStackSize: 256,
+		FetchTimeout:     5 * time.Second,
+	}
+
+	if cfg.PoolSize > 0 {
+		options.PoolSize = cfg.PoolSize
+	}
+
+	if cfg.MaxCallStackSize > 0 {
+		options.MaxCallStackSize = cfg.MaxCallStackSize
+	}
+
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return options, fmt.Errorf("invalid script timeout: %s", err)
+		}
+		options.Timeout = d
+	}
+
+	if cfg.FetchTimeout != "" {
+		d, err := time.ParseDuration(cfg.FetchTimeout)
+		if err != nil {
+			return options, fmt.Errorf("invalid script fetch timeout: %s", err)
+		}
+		options.FetchTimeout = d
+	}
+
+	return options, nil
+}
+
+// Call holds the context of a single script invocation that is available to
+// host functions.
+type Call struct {
+	Context context.Context
+	Header  http.Header
+}
+
+// Runtime runs one script. Every VM of the pool evaluates the script once when
+// it is created; calls then only invoke the exported function.
+type Runtime struct {
+	name       string
+	program    *goja.Program
+	vms        chan *vm
+	options    Options
+	logger     *logging.Logger
+	metrics    *monitoring.PromMetrics
+	httpClient *http.Client
+}
+
+type vm struct {
+	rt      *goja.Runtime
+	exports goja.Callable
+	call    *Call
+}
+
+// NewRuntime compiles a script and fills the VM pool. The name identifies the
+// script in logs and metrics.
+func NewRuntime(name string, source string, options Options, logger *logging.Logger, metrics *monitoring.PromMetrics) (*Runtime, error) {
+	program, err := goja.Compile(name, source, false)
+	if err != nil {
+		return nil, &ScriptError{Script: name, Err: err}
+	}
+
+	r := &Runtime{
+		name:       name,
+		program:    program,
+		vms:        make(chan *vm, options.PoolSize),
+		options:    options,
+		logger:     logger,
+		metrics:    metrics,
+		httpClient: &http.Client{Timeout: options.FetchTimeout},
+	}
+
+	for i := 0; i < options.PoolSize; i++ {
+		v, err := r.newVM()
+		if err != nil {
+			return nil, err
+		}
+		r.vms <- v
+	}
+
+	return r, nil
+}
+
+func (r *Runtime) newVM() (*vm, error) {
+	v := &vm{rt: goja.New()}
+	v.rt.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+	v.rt.SetMaxCallStackSize(r.options.MaxCallStackSize)
+
+	if err := r.registerHostFunctions(v); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.Timeout)
+	defer cancel()
+
+	if _, err := r.run(ctx, v, func() (goja.Value, error) {
+		return v.rt.RunProgram(r.program)
+	}); err != nil {
+		return nil, err
+	}
+
+	exports, ok := goja.AssertFunction(v.rt.Get("exports"))
+	if !ok {
+		return nil, &ScriptError{Script: r.name, Err: fmt.Errorf("script must export a function")}
+	}
+
+	v.exports = exports
+	return v, nil
+}
+
+// Call invokes the exported function of the script with the given arguments
+// and returns its exported result (maps, slices and primitive values). The
+// time spent waiting for a VM counts towards the timeout, and the call is
+// interrupted when its context is canceled.
+func (r *Runtime) Call(call *Call, args ...interface{}) (interface{}, error) {
+	if call.Context == nil {
+		call.Context = context.Background()
+	}
+
+	ctx, cancel := context.WithTimeout(call.Context, r.options.Timeout)
+	defer cancel()
+
+	var v *vm
+	select {
+	case v = <-r.vms:
+	case <-ctx.Done():
+		err := contextError(ctx)
+		if err == ErrTimeout {
+			r.CountFailure("pool_exhausted")
+		} else {
+			r.CountFailure("canceled")
+		}
+		return nil, err
+	}
+
+	v.call = &Call{Context: ctx, Header: call.Header}
+
+	started := time.Now()
+	result, err := r.run(ctx, v, func() (goja.Value, error) {
+		values := make([]goja.Value, len(args))
+		for i := range args {
+			values[i] = v.rt.ToValue(args[i])
+		}
+
+		return v.exports(goja.Undefined(), values...)
+	})
+
+	if r.metrics != nil {
+		r.metrics.ScriptDurations.WithLabelValues(r.name).Observe(time.Since(started).Seconds())
+	}
+
+	var exported interface{}
+	if err == nil && result != nil {
+		exported = result.Export()
+	}
+
+	v.call = nil
+	r.release(v, err)
+
+	return exported, err
+}
+
+// run executes fn until it returns or ctx is done, whichever comes first.
+func (r *Runtime) run(ctx context.Context, v *vm, fn func() (goja.Value, error)) (goja.Value, error) {
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		v.rt.Interrupt(contextError(ctx))
+		close(interrupted)
+	})
+
+	result, err := fn()
+
+	// ctx may have been done just after fn returned; make sure that the
+	// interrupt does not hit the next call
+	if !stop() {
+		<-interrupted
+	}
+	v.rt.ClearInterrupt()
+
+	if err == nil {
+		return result, nil
+	}
+
+	var interruptedErr *goja.InterruptedError
+	var stackOverflow *goja.StackOverflowError
+
+	switch {
+	case errors.As(err, &interruptedErr):
+		if limitErr, ok := interruptedErr.Value().(error); ok {
+			err = limitErr
+		}
+	case errors.As(err, &stackOverflow):
+		err = &ScriptError{Script: r.name, Err: ErrStackOverflow}
+		r.CountFailure("stack_overflow")
+		return nil, err
+	default:
+		err = &ScriptError{Script: r.name, Err: err}
+		r.CountFailure("exception")
+		return nil, err
+	}
+
+	switch err {
+	case ErrTimeout:
+		r.CountFailure("timeout")
+	case ErrCanceled:
+		r.CountFailure("canceled")
+	}
+
+	return nil, err
+}
+
+// release returns a VM to the pool. VMs that were interrupted may be in an
+// inconsistent state and are replaced by a new one.
+func (r *Runtime) release(v *vm, err error) {
+	if err == nil || !isLimitError(err) {
+		r.vms <- v
+		return
+	}
+
+	go func() {
+		replacement, err := r.newVM()
+		if err != nil {
+			r.logger.Errorf("could not replace VM of script %s: %s", r.name, err)
+			v.rt.ClearInterrupt()
+			replacement = v
+		}
+		r.vms <- replacement
+	}()
+}
+
+func isLimitError(err error) bool {
+	return err == ErrTimeout || err == ErrCanceled || errors.Is(err, ErrStackOverflow)
+}
+
+// contextError returns the error of a call whose context is done.
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
+
+// CountFailure records a failed call. Callers use this to report results
+// that the script returned, but that they could not use.
+func (r *Runtime) CountFailure(reason string) {
+	r.logger.Warningf("script %s failed: %s", r.name, reason)
+
+	if r.metrics != nil {
+		r.metrics.ScriptFailures.WithLabelValues(r.name, reason).Inc()
+	}
+}
+
+// Truthy reports whether an exported script value is truthy in the sense of
+// JavaScript.
+func Truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	default:
+		return true
+	}
+}
+
+// Strings converts an exported script array into a string slice.
+func Strings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		l := make([]string, len(v))
+		for i := range v {
+			s, ok := v[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("expected array of strings, found %T", v[i])
+			}
+			l[i] = s
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("expected array of strings, found %T", value)
+	}
+}
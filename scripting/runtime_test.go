@@ -0,0 +1,139 @@
+package scripting
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const limitsScript = `exports = function(mode) {
+	if (mode === "loop") { for (;;) {} }
+	if (mode === "recursion") { const f = () => f(); f(); }
+	if (mode === "throw") { throw new Error("boom"); }
+	return mode;
+}`
+
+func newTestRuntime(t *testing.T, source string, options Options) *Runtime {
+	t.Helper()
+
+	r, err := NewRuntime("test", source, options, logging.MustGetLogger("test"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return r
+}
+
+func testOptions(poolSize int, timeout time.Duration) Options {
+	return Options{PoolSize: poolSize, Timeout: timeout, MaxCallStackSize: 100, FetchTimeout: time.Second}
+}
+
+func TestHostFunctions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"answer":` + req.Header.Get("X-Answer") + `}`))
+	}))
+	defer server.Close()
+
+	r := newTestRuntime(t, `exports = (user, password) => {
+		const res = fetch("`+server.URL+`", {headers: {"X-Answer": "42"}});
+		return {
+			user: `+"`${user}`"+`,
+			answer: res.json().answer,
+			encoded: base64.encode(password),
+			decoded: base64.decode("aGk="),
+			header: header("X-Foo"),
+			missing: header("X-Missing"),
+			apps: ["a", "b"],
+		};
+	};`, testOptions(1, time.Second))
+
+	header := http.Header{}
+	header.Set("X-Foo", "bar")
+
+	result, err := r.Call(&Call{Header: header}, "user", "pw")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m := result.(map[string]interface{})
+	if m["user"] != "user" || m["answer"] != int64(42) || m["encoded"] != "cHc=" || m["decoded"] != "hi" || m["header"] != "bar" || m["missing"] != nil {
+		t.Errorf("unexpected result %#v", m)
+	}
+
+	if apps, err := Strings(m["apps"]); err != nil || len(apps) != 2 {
+		t.Errorf("expected two applications, got %v (%v)", apps, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	r := newTestRuntime(t, limitsScript, testOptions(1, 200*time.Millisecond))
+
+	if _, err := r.Call(&Call{}, "loop"); err != ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	if _, err := r.Call(&Call{}, "recursion"); !errors.Is(err, ErrStackOverflow) {
+		t.Errorf("expected stack overflow, got %v", err)
+	}
+
+	var scriptErr *ScriptError
+	if _, err := r.Call(&Call{}, "throw"); !errors.As(err, &scriptErr) {
+		t.Errorf("expected script error, got %v", err)
+	}
+
+	// interrupted VMs are replaced, so that the pool keeps working
+	for i := 0; i < 5; i++ {
+		if result, err := r.Call(&Call{}, "ok"); err != nil || result != "ok" {
+			t.Fatalf("expected ok, got %v (%v)", result, err)
+		}
+	}
+}
+
+func TestTimeoutIncludesPoolWait(t *testing.T) {
+	timeout := 300 * time.Millisecond
+	r := newTestRuntime(t, limitsScript, testOptions(1, timeout))
+
+	// occupy the only VM, so that the next call has to wait for it
+	busy := make(chan struct{})
+	go func() {
+		defer close(busy)
+		_, _ = r.Call(&Call{}, "loop")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	started := time.Now()
+	_, err := r.Call(&Call{}, "loop")
+	elapsed := time.Since(started)
+
+	if err != ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if elapsed > timeout+timeout/2 {
+		t.Errorf("expected call to be interrupted within %s, took %s", timeout, elapsed)
+	}
+
+	<-busy
+}
+
+func TestCancelInterruptsCall(t *testing.T) {
+	r := newTestRuntime(t, limitsScript, testOptions(1, 5*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	if _, err := r.Call(&Call{Context: ctx}, "loop"); err != ErrCanceled {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("expected call to be interrupted on cancellation, took %s", elapsed)
+	}
+
+	if result, err := r.Call(&Call{}, "ok"); err != nil || result != "ok" {
+		t.Errorf("expected ok, got %v (%v)", result, err)
+	}
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DecorateHandler continues the trace of an incoming request (or starts a new
+// one) and wraps the request of an application in a server span.
+func (t *Tracing) DecorateHandler(appName string, handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := Start(
+			ctx,
+			req.Method+" "+appName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				ApplicationKey.String(appName),
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("client.address", req.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		writer := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		handler(writer, req.WithContext(ctx), params)
+
+		span.SetAttributes(attribute.Int("http.response.status_code", writer.status))
+		if writer.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(writer.status))
+		}
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,88 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/tracing"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestMetrics() *monitoring.PromMetrics {
+	return &monitoring.PromMetrics{
+		TotalResponseTimes:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "total"}, []string{"application"}),
+		UpstreamResponseTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "upstream"}, []string{"application"}),
+		BackendResponseTimes:  prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "backend"}, []string{"application", "backend"}),
+		BackendResponses:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "responses"}, []string{"application", "backend", "status_class"}),
+		Errors:                prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"application", "reason"}),
+	}
+}
+
+func TestTracePropagationAndSampling(t *testing.T) {
+	var exported int32
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/traces" {
+			atomic.AddInt32(&exported, 1)
+		}
+		rw.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	var parent atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		parent.Store(req.Header.Get("traceparent"))
+	}))
+	defer backend.Close()
+
+	logger := logging.MustGetLogger("test")
+
+	ratio := 1.0
+	tr, err := tracing.NewTracing(&config.TracingConfiguration{Enabled: true, Endpoint: collector.URL, SampleRatio: &ratio}, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tr.SetSampleRatio("never", 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	prx := proxy.NewProxyHandler(logger, &config.Configuration{}, newTestMetrics())
+	handle := func(appName string, req *http.Request) string {
+		tr.DecorateHandler(appName, func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			prx.HandleProxyRequest(rw, req, backend.URL+"/", appName, &config.Application{})
+		})(httptest.NewRecorder(), req, nil)
+		return parent.Load().(string)
+	}
+
+	// incoming trace context is continued with a new span of the gateway
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", incoming)
+
+	if traceparent := handle("app", req); !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || traceparent == incoming || !strings.HasSuffix(traceparent, "-01") {
+		t.Errorf("expected sampled child of incoming trace, got %s", traceparent)
+	}
+
+	if traceparent := handle("never", httptest.NewRequest("GET", "/", nil)); !strings.HasSuffix(traceparent, "-00") {
+		t.Errorf("expected trace of application with sample ratio 0 not to be sampled, got %s", traceparent)
+	}
+
+	if traceparent := handle("app", httptest.NewRequest("GET", "/", nil)); !strings.HasSuffix(traceparent, "-01") {
+		t.Errorf("expected new trace to be sampled, got %s", traceparent)
+	}
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if atomic.LoadInt32(&exported) == 0 {
+		t.Error("expected spans to be exported")
+	}
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"fmt"
+	"sync"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// applicationSampler samples root spans with the ratio configured for the
+// application named in the span's attributes.
+type applicationSampler struct {
+	fallback sdktrace.Sampler
+
+	lock     sync.RWMutex
+	samplers map[string]sdktrace.Sampler
+}
+
+func newApplicationSampler(defaultRatio float64) *applicationSampler {
+	return &applicationSampler{
+		fallback: sdktrace.TraceIDRatioBased(defaultRatio),
+		samplers: make(map[string]sdktrace.Sampler),
+	}
+}
+
+func (s *applicationSampler) setRatio(appName string, ratio float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.samplers[appName] = sdktrace.TraceIDRatioBased(ratio)
+}
+
+func (s *applicationSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key != ApplicationKey {
+			continue
+		}
+
+		s.lock.RLock()
+		sampler, ok := s.samplers[attr.Value.AsString()]
+		s.lock.RUnlock()
+
+		if ok {
+			return sampler.ShouldSample(p)
+		}
+		break
+	}
+
+	return s.fallback.ShouldSample(p)
+}
+
+func (s *applicationSampler) Description() string {
+	return fmt.Sprintf("ApplicationSampler{default=%s}", s.fallback.Description())
+}
@@ -0,0 +1,137 @@
+// Package tracing provides OpenTelemetry tracing for requests passing through
+// the gateway. Trace context is read from and written to W3C "traceparent"
+// headers; spans are exported over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/mittwald/servicegateway"
+
+// ApplicationKey is the span attribute holding the application name.
+const ApplicationKey = attribute.Key("servicegateway.application")
+
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	sampler  *applicationSampler
+	logger   *logging.Logger
+}
+
+// NewTracing installs the global trace context propagator and, if tracing is
+// enabled, a tracer provider that exports spans over OTLP/HTTP. When tracing
+// is disabled, incoming trace context is still passed on to upstream services.
+func NewTracing(cfg *config.TracingConfiguration, logger *logging.Logger) (*Tracing, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	t := Tracing{logger: logger}
+	if !cfg.Enabled {
+		return &t, nil
+	}
+
+	defaultRatio := 1.0
+	if cfg.SampleRatio != nil {
+		defaultRatio = *cfg.SampleRatio
+	}
+
+	if defaultRatio < 0 || defaultRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1, is %f", defaultRatio)
+	}
+
+	options := []otlptracehttp.Option{}
+	if cfg.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	}
+	if len(cfg.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter: %s", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "servicegateway"
+	}
+
+	res, err := resource.New(
+		context.Background(),
+		resource.WithFromEnv(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create tracing resource: %s", err)
+	}
+
+	t.sampler = newApplicationSampler(defaultRatio)
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(t.sampler)),
+	)
+
+	otel.SetTracerProvider(t.provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warningf("error while exporting traces: %s", err)
+	}))
+
+	logger.Infof("exporting traces with a sample ratio of %f", defaultRatio)
+
+	return &t, nil
+}
+
+// SetSampleRatio overrides the sampling ratio of traces started by an
+// application. Traces whose parent was sampled by the caller are always
+// recorded.
+func (t *Tracing) SetSampleRatio(appName string, ratio float64) error {
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1, is %f", ratio)
+	}
+
+	if t.sampler != nil {
+		t.sampler.setRatio(appName, ratio)
+	}
+	return nil
+}
+
+// Shutdown exports all pending spans.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// Start starts a span as a child of the span in ctx.
+func Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, options...)
+}
+
+// End ends a span, marking it as failed if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject writes the trace context of ctx into the headers of an outgoing
+// request.
+func Inject(ctx context.Context, header propagation.HeaderCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, header)
+}